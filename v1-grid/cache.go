@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+	. "github.com/stevegt/goadapt"
+	grid_cli "github.com/stevegt/grid-cli/v2"
+)
+
+// The cache holds modules and other data, each in a file named by the
+// hex of its multihash, and the blocks modules are split into for
+// peers.  evictCache keeps it within the quota set in the config file;
+// see grid_cli.ParseCacheQuota.  The current symbol table, the modules
+// it lists, and the hashes in the pin file kept by "grid-cli cache
+// pin" are never evicted.  A file was last used when its modification
+// time says, so reads touch it; use counts for LFU eviction only last
+// as long as the process.  Every read also checks the file against its
+// name, and a file that fails is quarantined and fetched again from
+// peers.
+
+// pinFile lists the pinned hashes, and is shared with grid-cli.
+const pinFile = ".grid/cache/pins"
+
+// cacheQuota reads the cache quota from the config file, if there is
+// one.
+func (sys *KernelNative) cacheQuota() (q grid_cli.CacheQuota, err error) {
+	return grid_cli.LoadCacheQuota(sys.fs, filepath.Join(sys.baseDir, configFile))
+}
+
+// pinned returns the names of the cache files that must not be
+// evicted.
+func (sys *KernelNative) pinned() (names map[string]bool, err error) {
+	defer Return(&err)
+	names = make(map[string]bool)
+	pins, err := grid_cli.LoadPins(sys.fs, filepath.Join(sys.baseDir, pinFile))
+	Ck(err)
+	for _, mh := range pins {
+		names[hex.EncodeToString(mh)] = true
+	}
+	hash, err := sys.getSymbolTableHash()
+	if err != nil {
+		// no symbol table, nothing more to protect
+		return names, nil
+	}
+	names[hash] = true
+	// the modules are only known if the symbol table is cached, which
+	// fetchSymbolTable sees to
+	symbolTable, err := sys.util.ReadFile(filepath.Join(sys.baseDir, cacheDir, hash))
+	if os.IsNotExist(err) {
+		return names, nil
+	}
+	Ck(err)
+	for _, line := range strings.Split(string(symbolTable), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			names[fields[1]] = true
+		}
+	}
+	return names, nil
+}
+
+// cacheItems returns the files in the cache, and the blocks of
+// modules split for peers, named by their path within the cache.
+// Files whose names aren't multihashes, such as the pin file, are
+// left out.  The caller holds sys.cacheMu.
+func (sys *KernelNative) cacheItems() (items []grid_cli.CacheItem, err error) {
+	defer Return(&err)
+	pinned, err := sys.pinned()
+	Ck(err)
+	sys.usesMu.Lock()
+	defer sys.usesMu.Unlock()
+	for _, sub := range []string{"", grid_cli.BlockDir} {
+		infos, err := sys.util.ReadDir(filepath.Join(sys.baseDir, cacheDir, sub))
+		if os.IsNotExist(err) {
+			continue
+		}
+		Ck(err)
+		for _, info := range infos {
+			if info.IsDir() || !grid_cli.IsHashName(info.Name()) {
+				continue
+			}
+			name := filepath.Join(sub, info.Name())
+			items = append(items, grid_cli.CacheItem{
+				Name:     name,
+				Size:     info.Size(),
+				Entries:  1,
+				LastUsed: info.ModTime(),
+				Uses:     sys.uses[name],
+				Pinned:   pinned[info.Name()],
+			})
+		}
+	}
+	return items, nil
+}
+
+// evictCache removes cache files until the cache is within its
+// quota, and returns what it removed.  It waits for reads of the
+// cache to finish.
+func (sys *KernelNative) evictCache() (victims []grid_cli.CacheItem, err error) {
+	defer Return(&err)
+	quota, err := sys.cacheQuota()
+	Ck(err)
+	sys.cacheMu.Lock()
+	defer sys.cacheMu.Unlock()
+	items, err := sys.cacheItems()
+	Ck(err)
+	victims = quota.Victims(items)
+	for _, item := range victims {
+		err = sys.fs.Remove(filepath.Join(sys.baseDir, cacheDir, item.Name))
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		Ck(err)
+		sys.usesMu.Lock()
+		delete(sys.uses, item.Name)
+		sys.usesMu.Unlock()
+	}
+	return victims, nil
+}
+
+// touchCache records a read of the cache file name.  The caller
+// holds sys.cacheMu.
+func (sys *KernelNative) touchCache(name string) {
+	now := time.Now()
+	sys.fs.Chtimes(filepath.Join(sys.baseDir, cacheDir, name), now, now)
+	sys.usesMu.Lock()
+	defer sys.usesMu.Unlock()
+	sys.uses[name]++
+}
+
+// dataPromise is the promise made when asking peers for a fresh
+// copy of cached data.
+const dataPromise = "I promise to use this data responsibly."
+
+// refetch quarantines the cache file name, which failed verification
+// with cause, and replaces it with a copy from peers, got with fetch,
+// which must check the copy against its hash and cache it.
+func (sys *KernelNative) refetch(name string, cause error, fetch func() error) (err error) {
+	dir := filepath.Join(sys.baseDir, cacheDir)
+	sys.cacheMu.Lock()
+	// another reader may have replaced it already
+	err = grid_cli.CheckCacheFile(sys.fs, dir, name)
+	if err == nil {
+		sys.cacheMu.Unlock()
+		return nil
+	}
+	_, err = grid_cli.Quarantine(sys.fs, dir, name)
+	sys.cacheMu.Unlock()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Quarantined %s: %v\n", name, cause)
+	err = fetch()
+	if err != nil {
+		return fmt.Errorf("%v; no fresh copy: %w", cause, err)
+	}
+	return nil
+}
+
+// fetchData asks peers for the data named name, checks it against
+// its hash, and caches it.
+func (sys *KernelNative) fetchData(name string) (err error) {
+	mBuf, err := hex.DecodeString(name)
+	if err != nil {
+		return err
+	}
+	data, err := askPeers(name, dataPromise)
+	if err != nil {
+		return err
+	}
+	err = grid_cli.VerifyHash(mBuf, []byte(data))
+	if err != nil {
+		return fmt.Errorf("the copy from peers is invalid: %w", err)
+	}
+	return sys.writeCache(name, []byte(data), 0644)
+}
+
+// writeCache adds a file to the cache and then evicts what is over
+// the quota.
+func (sys *KernelNative) writeCache(name string, data []byte, perm os.FileMode) (err error) {
+	return sys.streamCache(name, perm, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// streamCache adds a file to the cache with the content write writes,
+// and then evicts what is over the quota.  The content goes to a
+// temporary file that is only renamed into place if write succeeds,
+// so a failed or rejected download never takes the name.
+func (sys *KernelNative) streamCache(name string, perm os.FileMode, write func(w io.Writer) error) (err error) {
+	dir := filepath.Join(sys.baseDir, cacheDir)
+	err = sys.fs.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	// the dot keeps the temporary file out of cacheItems
+	f, err := afero.TempFile(sys.fs, dir, "."+name+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	err = write(f)
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = sys.fs.Chmod(tmp, perm)
+	}
+	if err == nil {
+		sys.cacheMu.Lock()
+		err = sys.fs.Rename(tmp, filepath.Join(dir, name))
+		sys.cacheMu.Unlock()
+	}
+	if err != nil {
+		sys.fs.Remove(tmp)
+		return err
+	}
+	_, err = sys.evictCache()
+	if err != nil {
+		return fmt.Errorf("evicting from cache: %w", err)
+	}
+	return nil
+}
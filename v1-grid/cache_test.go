@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/multiformats/go-multihash"
+	. "github.com/stevegt/goadapt"
+	grid_cli "github.com/stevegt/grid-cli/v2"
+)
+
+// cacheData writes data to the cache as if it were last used at t,
+// and returns its name.
+func cacheData(t *testing.T, sys *KernelNative, data string, last time.Time) string {
+	mBuf, err := GenerateHash(multihash.SHA2_256, []byte(data))
+	Tassert(t, err == nil, "Failed to generate hash: %v", err)
+	fn := fmt.Sprintf("%x", mBuf)
+	cachePath := filepath.Join(sys.baseDir, cacheDir, fn)
+	err = sys.util.WriteFile(cachePath, []byte(data), 0644)
+	Tassert(t, err == nil, "Failed to write test data: %v", err)
+	err = sys.fs.Chtimes(cachePath, last, last)
+	Tassert(t, err == nil, "Failed to set times: %v", err)
+	return fn
+}
+
+// cached reports whether the cache file name exists.
+func cached(sys *KernelNative, name string) bool {
+	_, err := sys.fs.Stat(filepath.Join(sys.baseDir, cacheDir, name))
+	return err == nil
+}
+
+// Test that eviction keeps the cache within its quota and spares
+// pinned files
+func TestEvictCache(t *testing.T) {
+	sys := setupTestEnv()
+	t0 := time.Now().Add(-time.Hour)
+
+	module1 := cacheData(t, sys, "module 1", t0)
+	module2 := cacheData(t, sys, "module 2", t0.Add(time.Second))
+	symbolTable := cacheData(t, sys, "ls "+module1+"\nrm "+module2+"\n", t0.Add(2*time.Second))
+	pinnedData := cacheData(t, sys, "pinned data", t0.Add(3*time.Second))
+	old := cacheData(t, sys, "old data", t0.Add(4*time.Second))
+	recent := cacheData(t, sys, "recent data", t0.Add(5*time.Second))
+	config := fmt.Sprintf("symbol_table_hash=%s\ncache_max_entries=5\n", symbolTable)
+	err := sys.util.WriteFile(filepath.Join(sys.baseDir, configFile), []byte(config), 0644)
+	Tassert(t, err == nil, "Failed to write config: %v", err)
+	mh, err := GenerateHash(multihash.SHA2_256, []byte("pinned data"))
+	Tassert(t, err == nil, "Failed to generate hash: %v", err)
+	_, err = grid_cli.PinHash(sys.fs, filepath.Join(sys.baseDir, pinFile), mh)
+	Tassert(t, err == nil, "Failed to pin: %v", err)
+
+	// the symbol table, its modules and the pin come first, and
+	// the pin file isn't an entry
+	victims, err := sys.evictCache()
+	Tassert(t, err == nil, "Failed to evict: %v", err)
+	Tassert(t, len(victims) == 1 && victims[0].Name == old, "Unexpected victims %v", victims)
+	for _, name := range []string{module1, module2, symbolTable, pinnedData, recent} {
+		Tassert(t, cached(sys, name), "Expected %s to be cached", name)
+	}
+
+	// reads count as use
+	another := cacheData(t, sys, "another", time.Now())
+	_, err = sys.fetchLocalData(mustDecodeHex(t, recent))
+	Tassert(t, err == nil, "Failed to read: %v", err)
+	victims, err = sys.evictCache()
+	Tassert(t, err == nil, "Failed to evict: %v", err)
+	Tassert(t, len(victims) == 1 && victims[0].Name == another, "Unexpected victims %v", victims)
+
+	// reading while evicting is safe
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				data, err := sys.fetchLocalData(mustDecodeHex(t, recent))
+				if err == nil && string(data) != "recent data" {
+					t.Errorf("Unexpected data %q", data)
+				}
+			}
+		}()
+	}
+	for j := 0; j < 10; j++ {
+		name := fmt.Sprintf("data %d", j)
+		mBuf, err := GenerateHash(multihash.SHA2_256, []byte(name))
+		Tassert(t, err == nil, "Failed to generate hash: %v", err)
+		err = sys.writeCache(fmt.Sprintf("%x", mBuf), []byte(name), 0644)
+		Tassert(t, err == nil, "Failed to write cache: %v", err)
+	}
+	wg.Wait()
+	items, err := sys.cacheItems()
+	Tassert(t, err == nil && len(items) == 5, "Expected 5 cache files but got %v: %v", items, err)
+}
+
+// Test that the blocks modules are split into for peers count
+// toward the quota, and are evicted like any other file
+func TestEvictBlocks(t *testing.T) {
+	ctx := context.Background()
+	sys := setupTestEnv()
+	module := strings.Repeat("echo hello\n", 100)
+	name := cacheData(t, sys, module, time.Now().Add(-time.Hour))
+	config := fmt.Sprintf("cache_max_bytes=%d\n", 2*len(module))
+	err := sys.util.WriteFile(filepath.Join(sys.baseDir, configFile), []byte(config), 0644)
+	Tassert(t, err == nil, "Failed to write config: %v", err)
+	_, err = grid_cli.PinHash(sys.fs, filepath.Join(sys.baseDir, pinFile), mustDecodeHex(t, name))
+	Tassert(t, err == nil, "Failed to pin: %v", err)
+	victims, err := sys.evictCache()
+	Tassert(t, err == nil && len(victims) == 0, "Unexpected victims %v: %v", victims, err)
+
+	// the pinned module and its block together are over the quota
+	ref, err := sys.payloadRef(ctx, name)
+	Tassert(t, err == nil, "Failed to split module: %v", err)
+	items, err := sys.cacheItems()
+	Tassert(t, err == nil && len(items) == 2, "Expected the module and its block but got %v: %v", items, err)
+	victims, err = sys.evictCache()
+	block := filepath.Join(grid_cli.BlockDir, ref.Root.HexString())
+	Tassert(t, err == nil && len(victims) == 1 && victims[0].Name == block, "Expected the block evicted but got %v: %v", victims, err)
+	Tassert(t, !sys.blocks().HasPayload(ctx, ref), "Expected the block removed")
+
+	// a module whose blocks have gone is split again when asked for
+	_, err = sys.payloadRef(ctx, name)
+	Tassert(t, err == nil && sys.blocks().HasPayload(ctx, ref), "Expected the blocks written again: %v", err)
+}
+
+// mustDecodeHex decodes the hex name of a cache file.
+func mustDecodeHex(t *testing.T, name string) []byte {
+	var buf []byte
+	_, err := fmt.Sscanf(name, "%x", &buf)
+	Tassert(t, err == nil, "Failed to decode %s: %v", name, err)
+	return buf
+}
+
+// usePeer replaces the peers with one that answers every query with
+// reply, and returns a function that restores them.
+func usePeer(t *testing.T, reply string) (restore func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			_, _, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(websocket.TextMessage, []byte(reply))
+		}
+	}))
+	peer := &Peer{Address: "ws" + strings.TrimPrefix(server.URL, "http")}
+	connectToPeer(peer)
+	Tassert(t, peer.Conn != nil, "Failed to connect to peer")
+	saved := Peers
+	Peers = map[string]*Peer{peer.Address: peer}
+	return func() {
+		Peers = saved
+		peer.Conn.Close()
+		server.Close()
+	}
+}
+
+// Test that a symbol table fetched from peers is cached, and pins the
+// modules it lists
+func TestFetchSymbolTable(t *testing.T) {
+	sys := setupTestEnv()
+	t0 := time.Now().Add(-time.Hour)
+	module1 := cacheData(t, sys, "module 1", t0)
+	module2 := cacheData(t, sys, "module 2", t0.Add(time.Second))
+	other := cacheData(t, sys, "other data", t0.Add(2*time.Second))
+	table := "ls " + module1 + "\nrm " + module2 + "\n"
+	mBuf, err := GenerateHash(multihash.SHA2_256, []byte(table))
+	Tassert(t, err == nil, "Failed to generate hash: %v", err)
+	hash := fmt.Sprintf("%x", mBuf)
+	config := fmt.Sprintf("symbol_table_hash=%s\ncache_max_entries=3\n", hash)
+	err = sys.util.WriteFile(filepath.Join(sys.baseDir, configFile), []byte(config), 0644)
+	Tassert(t, err == nil, "Failed to write config: %v", err)
+
+	restore := usePeer(t, table)
+	got, err := sys.fetchSymbolTable(hash)
+	restore()
+	Tassert(t, err == nil && got == table, "Unexpected symbol table %q: %v", got, err)
+	for _, name := range []string{hash, module1, module2} {
+		Tassert(t, cached(sys, name), "Expected %s to be cached", name)
+	}
+	Tassert(t, !cached(sys, other), "Expected %s to be evicted", other)
+
+	// with no peers, the cached table is used
+	got, err = sys.fetchSymbolTable(hash)
+	Tassert(t, err == nil && got == table, "Unexpected symbol table %q: %v", got, err)
+
+	// a table that doesn't match its hash is refused
+	defer usePeer(t, table)()
+	mBuf, err = GenerateHash(multihash.SHA2_256, []byte("another table"))
+	Tassert(t, err == nil, "Failed to generate hash: %v", err)
+	_, err = sys.fetchSymbolTable(fmt.Sprintf("%x", mBuf))
+	Tassert(t, err != nil, "Expected an error for a table that doesn't match its hash")
+}
+
+// Test that corrupt cache files are replaced with fresh copies from
+// peers
+func TestRefetchCorrupt(t *testing.T) {
+	sys := setupTestEnv()
+	defer usePeer(t, "test data")()
+
+	name := cacheData(t, sys, "test data", time.Now())
+	cachePath := filepath.Join(sys.baseDir, cacheDir, name)
+	err := sys.util.WriteFile(cachePath, []byte("tampered data"), 0644)
+	Tassert(t, err == nil, "Failed to write test data: %v", err)
+	data, err := sys.fetchLocalData(mustDecodeHex(t, name))
+	Tassert(t, err == nil && string(data) == "test data", "Unexpected data %q: %v", data, err)
+	data, err = sys.util.ReadFile(cachePath)
+	Tassert(t, err == nil && string(data) == "test data", "Expected the cache repaired but got %q: %v", data, err)
+}
@@ -1,14 +1,18 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
 	"path/filepath"
 	"sync"
 
 	"github.com/gorilla/websocket"
+	grid_cli "github.com/stevegt/grid-cli/v2"
 )
 
 func connectToPeers() {
@@ -34,7 +38,9 @@ func connectToPeer(peer *Peer) {
 	mu.Unlock()
 }
 
-func queryPeers(hash, promise string) string {
+// askPeers asks each connected peer in turn for the data with the
+// given hash, and returns the first answer.
+func askPeers(hash, promise string) (string, error) {
 	query := map[string]string{"hash": hash, "promise": promise}
 	queryJSON, _ := json.Marshal(query)
 
@@ -53,23 +59,103 @@ func queryPeers(hash, promise string) string {
 			fmt.Printf("Failed to read from peer %s: %v\n", peer.Address, err)
 			continue
 		}
-		return string(message)
+		if len(message) == 0 {
+			// the peer doesn't have it
+			continue
+		}
+		return string(message), nil
 	}
 
-	fmt.Println("Failed to fetch data from peers.")
-	os.Exit(1)
-	return ""
+	return "", fmt.Errorf("Failed to fetch data from peers.")
 }
 
-func fetchSymbolTable(hash string) string {
-	return queryPeers(hash, "I promise to use the symbol table responsibly.")
+// symbolTablePromise is the promise made when fetching a symbol
+// table.
+const symbolTablePromise = "I promise to use the symbol table responsibly."
+
+// fetchSymbolTable returns the symbol table with the given hash, from
+// the cache if it is there and from peers otherwise.  A table fetched
+// from peers is cached, which pins it and the modules it lists.
+func (sys *KernelNative) fetchSymbolTable(hash string) (symbolTable string, err error) {
+	mBuf, err := hex.DecodeString(hash)
+	if err != nil {
+		return "", fmt.Errorf("symbol table hash %q is invalid: %w", hash, err)
+	}
+	data, err := sys.fetchLocalData(mBuf)
+	if err == nil {
+		return string(data), nil
+	}
+	symbolTable, err = askPeers(hash, symbolTablePromise)
+	if err != nil {
+		return "", err
+	}
+	err = grid_cli.VerifyHash(mBuf, []byte(symbolTable))
+	if err != nil {
+		return "", fmt.Errorf("symbol table %s from peers is invalid: %w", hash, err)
+	}
+	err = sys.writeCache(hash, []byte(symbolTable), 0644)
+	if err != nil {
+		fmt.Printf("Failed to cache symbol table %s: %v\n", hash, err)
+	}
+	return symbolTable, nil
 }
 
-func (sys *KernelNative) fetchModule(hash string) string {
-	cachePath := filepath.Join(sys.baseDir, cacheDir, hash)
+// fetchModuleBlocks fetches a module from the first peer that can
+// send it, one block at a time, and caches it once it matches its
+// hash.  The module is written to disk as it arrives rather than put
+// together in memory, and the blocks are kept so it can be served to
+// other peers without chunking it again.
+func (sys *KernelNative) fetchModuleBlocks(hash string) (err error) {
+	mBuf, err := hex.DecodeString(hash)
+	if err != nil {
+		return err
+	}
+	for _, peer := range Peers {
+		p := grid_cli.NewWebSocketPeer(peer.Address)
+		var ref *grid_cli.PayloadRef
+		err = sys.streamCache(hash, 0755, func(w io.Writer) (err error) {
+			ref, err = p.FetchChunked(context.Background(), mBuf, sys.blocks(), w)
+			return err
+		})
+		p.Close()
+		if err == nil {
+			err = sys.saveRef(hash, ref)
+			if err != nil {
+				fmt.Printf("Failed to save the blocks of module %s: %v\n", hash, err)
+			}
+			return nil
+		}
+		fmt.Printf("Failed to fetch module %s from peer %s: %v\n", hash, peer.Address, err)
+	}
+	return fmt.Errorf("Failed to fetch module %s from peers.", hash)
+}
+
+// fetchModule returns the path of the cached module with the given
+// hash, fetching it from peers if it is missing or doesn't match its
+// hash.
+func (sys *KernelNative) fetchModule(hash string) (cachePath string, err error) {
+	cachePath = filepath.Join(sys.baseDir, cacheDir, hash)
 	if _, err := sys.fs.Stat(cachePath); os.IsNotExist(err) {
-		data := queryPeers(hash, "I promise to use this module responsibly.")
-		ioutil.WriteFile(cachePath, []byte(data), 0755)
+		err = sys.fetchModuleBlocks(hash)
+		if err != nil {
+			return "", err
+		}
+		return cachePath, nil
+	}
+	// never run a module that doesn't match its hash
+	sys.cacheMu.RLock()
+	err = grid_cli.CheckCacheFile(sys.fs, filepath.Join(sys.baseDir, cacheDir), hash)
+	if err == nil {
+		sys.touchCache(hash)
+	}
+	sys.cacheMu.RUnlock()
+	if errors.Is(err, grid_cli.ErrCorrupt) {
+		err = sys.refetch(hash, err, func() error {
+			return sys.fetchModuleBlocks(hash)
+		})
+	}
+	if err != nil {
+		return "", fmt.Errorf("Module %s is invalid: %w", hash, err)
 	}
-	return cachePath
+	return cachePath, nil
 }
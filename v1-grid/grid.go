@@ -15,6 +15,9 @@ const (
 	configFile = ".grid/config"
 	cacheDir   = ".grid/cache"
 	peerList   = ".grid/peers"
+	promiseDir = ".grid/promises"
+	blockDir   = ".grid/cache/blocks"
+	refDir     = ".grid/cache/refs"
 )
 
 type Peer struct {
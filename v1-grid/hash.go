@@ -1,19 +1,17 @@
 package main
 
 import (
-	"crypto/sha256"
-
-	"github.com/multiformats/go-multihash"
 	. "github.com/stevegt/goadapt"
+	grid_cli "github.com/stevegt/grid-cli/v2"
 )
 
-// GenerateHash generates a hash of the given data using the specified algorithm.
+// GenerateHash generates a hash of the given data using the specified
+// algorithm.  The algo is a multihash code; the hash function is
+// looked up in the registry shared with the v2 package, so the
+// resulting multihash always describes the digest it carries.
 func GenerateHash(algo int, inBuf []byte) (mBuf []byte, err error) {
-	sumBuf := sha256.Sum256(inBuf)
-	// Create a new multihash with it.
-	mBuf, err = multihash.Encode(sumBuf[:], uint64(algo))
+	defer Return(&err)
+	mBuf, err = grid_cli.Sum(uint64(algo), inBuf)
 	Ck(err)
-	// Print the multihash as hex string
-	// fmt.Printf("hex: %s\n", hex.EncodeToString(mHashBuf))
 	return
 }
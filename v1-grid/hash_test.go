@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"crypto/sha256"
+	"crypto/sha512"
 	"testing"
 
 	"github.com/multiformats/go-multihash"
@@ -35,3 +36,18 @@ func TestGenerateHash(t *testing.T) {
 		t.Errorf("Expected hash %s, got %s", expectedHash, hash)
 	}
 }
+
+// test that non-sha256 codes are not mislabeled sha256 digests
+func TestGenerateHashSHA512(t *testing.T) {
+	data := []byte("hello world")
+	hash, err := GenerateHash(multihash.SHA2_512, data)
+	if err != nil {
+		t.Fatalf("Failed to generate hash: %v", err)
+	}
+	sumBuf := sha512.Sum512(data)
+	expectedHash, err := multihash.Encode(sumBuf[:], multihash.SHA2_512)
+	Ck(err)
+	if bytes.Compare(hash, expectedHash) != 0 {
+		t.Errorf("Expected hash %x, got %x", expectedHash, hash)
+	}
+}
@@ -2,20 +2,29 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/spf13/afero"
 	. "github.com/stevegt/goadapt"
+	grid_cli "github.com/stevegt/grid-cli/v2"
 )
 
 type KernelNative struct {
 	fs      afero.Fs
 	baseDir string
 	util    *afero.Afero
+
+	// cacheMu is held for reading while reading the cache, and for
+	// writing while adding to it or evicting from it
+	cacheMu sync.RWMutex
+	usesMu  sync.Mutex
+	uses    map[string]int64 // reads of each cache file
 }
 
 // NewKernelNative creates a new Kernel instance that uses the native
@@ -25,6 +34,7 @@ func NewKernelNative(fs afero.Fs, baseDir string) *KernelNative {
 		fs:      fs,
 		baseDir: baseDir,
 		util:    &afero.Afero{Fs: fs},
+		uses:    make(map[string]int64),
 	}
 	sys.ensureDirectories()
 	return sys
@@ -75,9 +85,11 @@ func (sys *KernelNative) loadPeers() {
 func (sys *KernelNative) Exec(subcommand string, args []string) (err error) {
 	symbolTableHash, err := sys.getSymbolTableHash()
 	Ck(err)
-	symbolTable := fetchSymbolTable(symbolTableHash)
+	symbolTable, err := sys.fetchSymbolTable(symbolTableHash)
+	Ck(err)
 	subcommandHash := getSubcommandHash(symbolTable, subcommand)
-	module := sys.fetchModule(subcommandHash)
+	module, err := sys.fetchModule(subcommandHash)
+	Ck(err)
 	cmd := exec.Command(module, args...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
@@ -90,11 +102,29 @@ func (sys *KernelNative) Exec(subcommand string, args []string) (err error) {
 
 func (sys *KernelNative) fetchLocalData(mBuf []byte) ([]byte, error) {
 	fn := fmt.Sprintf("%x", mBuf)
-	cachePath := filepath.Join(sys.baseDir, cacheDir, fn)
-	data, err := sys.util.ReadFile(cachePath)
+	sys.cacheMu.RLock()
+	// verify the content against whatever algorithm the multihash
+	// declares
+	data, err := grid_cli.ReadCacheFile(sys.fs, filepath.Join(sys.baseDir, cacheDir), fn)
+	if err == nil {
+		sys.touchCache(fn)
+	}
+	sys.cacheMu.RUnlock()
 	if err == nil {
 		return data, nil
 	}
+	if errors.Is(err, grid_cli.ErrCorrupt) {
+		// never serve it; quarantine it and get a fresh copy
+		err = sys.refetch(fn, err, func() error {
+			return sys.fetchData(fn)
+		})
+		if err != nil {
+			return nil, err
+		}
+		sys.cacheMu.RLock()
+		defer sys.cacheMu.RUnlock()
+		return grid_cli.ReadCacheFile(sys.fs, filepath.Join(sys.baseDir, cacheDir), fn)
+	}
 
 	// XXX If data not found in cache, check if it's a known handler
 	// handlerPath := filepath.Join(os.Getenv("HOME"), gridDir, "handlers", hash)
@@ -110,9 +140,17 @@ func (sys *KernelNative) showPromise(subcommand string) {
 		os.Exit(1)
 	}
 
-	symbolTable := fetchSymbolTable(symbolTableHash)
+	symbolTable, err := sys.fetchSymbolTable(symbolTableHash)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 	subcommandHash := getSubcommandHash(symbolTable, subcommand)
-	module := sys.fetchModule(subcommandHash)
+	module, err := sys.fetchModule(subcommandHash)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 	cmd := exec.Command(module, "--show-promise")
 	output, err := cmd.Output()
 	if err != nil {
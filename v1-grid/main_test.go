@@ -61,6 +61,26 @@ func TestFetchLocalData(t *testing.T) {
 	}
 }
 
+// Test that cached data that doesn't match its hash is rejected
+func TestFetchLocalData_Corrupt(t *testing.T) {
+	sys := setupTestEnv()
+
+	mBuf, err := GenerateHash(multihash.SHA2_256, []byte("test data"))
+	Tassert(t, err == nil, "Failed to generate hash: %v", err)
+	cachePath := filepath.Join(sys.baseDir, cacheDir, fmt.Sprintf("%x", mBuf))
+	err = sys.util.WriteFile(cachePath, []byte("tampered data"), 0644)
+	Tassert(t, err == nil, "Failed to write test data: %v", err)
+
+	_, err = sys.fetchLocalData(mBuf)
+	if err == nil {
+		t.Error("Expected an error for corrupt data, but got nil")
+	}
+	_, err = sys.fs.Stat(cachePath)
+	Tassert(t, err != nil, "Expected the corrupt data to be quarantined")
+	data, err := sys.util.ReadFile(filepath.Join(sys.baseDir, cacheDir, "quarantine", fmt.Sprintf("%x", mBuf)))
+	Tassert(t, err == nil && string(data) == "tampered data", "Expected the corrupt data in quarantine: %v", err)
+}
+
 // Further tests would follow the established pattern of setting up necessary test data
 // and then calling the function under test. For example:
 
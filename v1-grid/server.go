@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"path/filepath"
 
 	"github.com/gorilla/websocket"
 	. "github.com/stevegt/goadapt"
+	grid_cli "github.com/stevegt/grid-cli/v2"
 )
 
 func (sys *KernelNative) startWebSocketServer() {
@@ -16,6 +21,106 @@ func (sys *KernelNative) startWebSocketServer() {
 	http.ListenAndServe(":8080", nil)
 }
 
+// blocks returns the store of the blocks served to peers.
+func (sys *KernelNative) blocks() *grid_cli.FsBlockStore {
+	return grid_cli.NewFsBlockStore(sys.fs, filepath.Join(sys.baseDir, blockDir))
+}
+
+// loadRef returns the saved root of the blocks of the cache file
+// name.
+func (sys *KernelNative) loadRef(name string) (ref *grid_cli.PayloadRef, err error) {
+	text, err := sys.util.ReadFile(filepath.Join(sys.baseDir, refDir, name))
+	if err != nil {
+		return nil, err
+	}
+	ref = &grid_cli.PayloadRef{}
+	err = ref.UnmarshalText(text)
+	if err != nil {
+		return nil, err
+	}
+	return ref, nil
+}
+
+// saveRef saves the root of the blocks of the cache file name.
+func (sys *KernelNative) saveRef(name string, ref *grid_cli.PayloadRef) (err error) {
+	text, err := ref.MarshalText()
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(sys.baseDir, refDir)
+	err = sys.fs.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	return sys.util.WriteFile(filepath.Join(dir, name), text, 0644)
+}
+
+// payloadRef returns the root of the blocks of the cache file name.
+// A file is only split into blocks the first time it is asked for,
+// or again if some of its blocks have gone since.  It is streamed
+// from disk and checked against its hash as it is split.
+func (sys *KernelNative) payloadRef(ctx context.Context, name string) (ref *grid_cli.PayloadRef, err error) {
+	ref, err = sys.loadRef(name)
+	if err == nil && sys.blocks().HasPayload(ctx, ref) {
+		return ref, nil
+	}
+	ref, err = sys.chunkCacheFile(name)
+	if errors.Is(err, grid_cli.ErrCorrupt) {
+		// never serve it; quarantine it and get a fresh copy
+		err = sys.refetch(name, err, func() error {
+			return sys.fetchData(name)
+		})
+		if err != nil {
+			return nil, err
+		}
+		ref, err = sys.chunkCacheFile(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = sys.saveRef(name, ref)
+	if err != nil {
+		return nil, err
+	}
+	return ref, nil
+}
+
+// chunkCacheFile splits the cache file name into blocks, checking it
+// against its hash on the way.
+func (sys *KernelNative) chunkCacheFile(name string) (ref *grid_cli.PayloadRef, err error) {
+	mBuf, err := hex.DecodeString(name)
+	if err != nil {
+		return nil, err
+	}
+	v, err := grid_cli.NewHashVerifier(mBuf)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(sys.baseDir, cacheDir, name)
+	sys.cacheMu.RLock()
+	defer sys.cacheMu.RUnlock()
+	f, err := sys.fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ref, err = grid_cli.WritePayload(sys.blocks(), io.TeeReader(f, v))
+	if err != nil {
+		return nil, err
+	}
+	err = v.Verify()
+	if err != nil {
+		return nil, fmt.Errorf("%w %s: %v", grid_cli.ErrCorrupt, path, err)
+	}
+	sys.touchCache(name)
+	return ref, nil
+}
+
+// catalog returns the promise catalog grid-cli keeps.
+func (sys *KernelNative) catalog() *grid_cli.PromiseCatalog {
+	return grid_cli.NewPromiseCatalog(sys.fs, filepath.Join(sys.baseDir, promiseDir))
+}
+
 func (sys *KernelNative) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	upgrader := websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool {
@@ -47,13 +152,30 @@ func (sys *KernelNative) handleWebSocket(w http.ResponseWriter, r *http.Request)
 		mBuf, err := hex.DecodeString(mStr)
 		Ck(err)
 
-		// promise := query["promise"]
-
-		// Check if the requested hash is for a module or handler
-		data, err := sys.fetchLocalData(mBuf)
+		var data []byte
+		switch query["promise"] {
+		case grid_cli.PromiseTextPromise:
+			var txt string
+			txt, err = sys.catalog().FetchPromise(mBuf)
+			data = []byte(txt)
+		case grid_cli.BlockPromise:
+			data, err = sys.blocks().FetchBlock(r.Context(), mBuf)
+		case grid_cli.PayloadRefPromise:
+			// the content split into blocks, to be fetched one at
+			// a time
+			var ref *grid_cli.PayloadRef
+			ref, err = sys.payloadRef(r.Context(), mStr)
+			if err == nil {
+				data, err = ref.MarshalText()
+			}
+		default:
+			// Check if the requested hash is for a module or handler
+			data, err = sys.fetchLocalData(mBuf)
+		}
 		if err != nil {
+			// an empty answer tells the asker to try elsewhere
 			fmt.Println("Failed to read data:", err)
-			continue
+			data = nil
 		}
 
 		if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
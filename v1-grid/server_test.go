@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/multiformats/go-multihash"
+	. "github.com/stevegt/goadapt"
+	grid_cli "github.com/stevegt/grid-cli/v2"
+)
+
+// Test that the server answers queries for promise text from the
+// catalog, and misses with an empty answer
+func TestServePromise(t *testing.T) {
+	sys := setupTestEnv()
+	server := httptest.NewServer(http.HandlerFunc(sys.handleWebSocket))
+	defer server.Close()
+	peer := grid_cli.NewWebSocketPeer("ws" + strings.TrimPrefix(server.URL, "http"))
+	defer peer.Close()
+
+	mh, err := sys.catalog().Add("I will say hello", "sha256")
+	Tassert(t, err == nil, "Failed to add promise: %v", err)
+	txt, err := peer.FetchPromise(mh)
+	Tassert(t, err == nil && txt == "I will say hello", "Unexpected promise %q: %v", txt, err)
+	missing, err := GenerateHash(multihash.SHA2_256, []byte("I will say goodbye"))
+	Tassert(t, err == nil, "Failed to generate hash: %v", err)
+	_, err = peer.FetchPromise(missing)
+	Tassert(t, errors.Is(err, grid_cli.ErrPromiseNotFound), "Expected ErrPromiseNotFound but got %v", err)
+}
+
+// Test that modules are fetched from peers one block at a time, and
+// fetched again when the cached copy fails
+func TestFetchModuleBlocks(t *testing.T) {
+	sys1 := setupTestEnv()
+	server := httptest.NewServer(http.HandlerFunc(sys1.handleWebSocket))
+	defer server.Close()
+	module := bytes.Repeat([]byte("#!/bin/sh\necho hello\n"), grid_cli.ChunkSize/8)
+	hash := cacheData(t, sys1, string(module), time.Now())
+	saved := Peers
+	address := "ws" + strings.TrimPrefix(server.URL, "http")
+	Peers = map[string]*Peer{address: {Address: address}}
+	defer func() { Peers = saved }()
+
+	sys2 := setupTestEnv()
+	path, err := sys2.fetchModule(hash)
+	Tassert(t, err == nil, "Failed to fetch module: %v", err)
+	data, err := sys2.util.ReadFile(path)
+	Tassert(t, err == nil && bytes.Equal(data, module), "Unexpected module of %d bytes: %v", len(data), err)
+	infos, err := sys1.util.ReadDir(filepath.Join(sys1.baseDir, blockDir))
+	Tassert(t, err == nil && len(infos) > 2, "Expected the module sent in several blocks but got %d: %v", len(infos), err)
+	_, err = sys2.loadRef(hash)
+	Tassert(t, err == nil, "Expected the fetcher to keep the blocks: %v", err)
+
+	// the module is only split once; later askers get the same blocks
+	// even once the file has gone
+	err = sys1.fs.Remove(filepath.Join(sys1.baseDir, cacheDir, hash))
+	Tassert(t, err == nil, "Failed to remove test data: %v", err)
+	sys3 := setupTestEnv()
+	path, err = sys3.fetchModule(hash)
+	Tassert(t, err == nil, "Failed to fetch module: %v", err)
+	data, err = sys3.util.ReadFile(path)
+	Tassert(t, err == nil && bytes.Equal(data, module), "Unexpected module of %d bytes: %v", len(data), err)
+
+	// a module that fails is fetched again before it is run
+	err = sys2.util.WriteFile(path, []byte("tampered module"), 0755)
+	Tassert(t, err == nil, "Failed to write test data: %v", err)
+	path, err = sys2.fetchModule(hash)
+	Tassert(t, err == nil, "Failed to fetch module: %v", err)
+	data, err = sys2.util.ReadFile(path)
+	Tassert(t, err == nil && bytes.Equal(data, module), "Expected the module repaired but got %d bytes: %v", len(data), err)
+	infos, err = sys2.util.ReadDir(filepath.Join(sys2.baseDir, cacheDir))
+	Tassert(t, err == nil, "Failed to read cache: %v", err)
+	for _, info := range infos {
+		Tassert(t, !strings.HasPrefix(info.Name(), "."), "Expected no temporary files left but got %s", info.Name())
+	}
+
+	// a module no peer has is an error
+	missing, err := GenerateHash(multihash.SHA2_256, []byte("no such module"))
+	Tassert(t, err == nil, "Failed to generate hash: %v", err)
+	_, err = sys2.fetchModule(fmt.Sprintf("%x", missing))
+	Tassert(t, err != nil, "Expected an error for a missing module")
+}
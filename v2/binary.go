@@ -0,0 +1,244 @@
+package grid_cli
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/multiformats/go-multihash"
+	"github.com/multiformats/go-varint"
+	. "github.com/stevegt/goadapt"
+)
+
+// BinaryMarker is the first byte of a binary-encoded message.  Text
+// messages always start with a printable multibase prefix, so a
+// leading zero byte is enough for Unmarshal to tell the two
+// encodings apart.
+const BinaryMarker byte = 0x00
+
+// Flags for the optional sections of a binary message.
+const (
+	flagSignature uint64 = 1 << iota
+	flagEnvelope
+	flagChunked
+	flagEncrypted
+)
+
+// The binary encoding is a sequence of unsigned varints and
+// varint-length-prefixed byte strings, in the same framing style
+// multiformats uses:
+//
+//	marker   byte     BinaryMarker
+//	flags    uvarint  which optional sections are present
+//	promise  bytes    the promise multihash
+//	nparms   uvarint  number of parameters
+//	parms    parm     nparms typed parameters; see parm.go
+//	[signer  bytes    signer's multikey, if flagSignature]
+//	[sig     bytes    signature, if flagSignature]
+//	[env     ...      envelope fields, if flagEnvelope; see envelope.go]
+//	[root    bytes    chunked payload root hash, if flagChunked]
+//	[size    uvarint  chunked payload size, if flagChunked]
+//	[enc     ...      encryption fields, if flagEncrypted; see crypt.go]
+//	payload  bytes    the payload, possibly empty
+//
+// The promise always comes first after the flags, so a router can
+// match on the promise without parsing the optional sections.
+// Because every field is length-prefixed, parameters may contain
+// whitespace and the payload may be arbitrary binary data.
+
+// maxFieldSize limits the size of the promise and of each parameter
+// read from a stream, so that a corrupt or hostile length prefix
+// can't make us allocate unbounded memory before the payload.  The
+// payload itself is not limited; stream decoders hand it out as an
+// io.Reader.
+const maxFieldSize = 1 << 20
+
+// byteReader is what the binary decoder needs from its input.
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// MarshalBinary marshals a message to the binary encoding.
+func MarshalBinary(msg *Message) (buf []byte, err error) {
+	defer Return(&err)
+	var b bytes.Buffer
+	err = writeBinaryHeader(&b, msg, uint64(len(msg.Payload)))
+	Ck(err)
+	b.WriteString(msg.Payload)
+	return b.Bytes(), nil
+}
+
+// writeBinaryHeader writes everything up to and including the
+// payload length prefix, leaving the caller to write the payload
+// bytes.
+func writeBinaryHeader(w io.Writer, msg *Message, payloadLen uint64) (err error) {
+	defer Return(&err)
+	Assert(msg.Promise != nil, "invalid message; missing promise hash")
+
+	m, err := multihash.Encode(msg.Promise.Digest, msg.Promise.Code)
+	Ck(err)
+
+	var flags uint64
+	if msg.Signature != nil {
+		flags |= flagSignature
+	}
+	if msg.Envelope != nil {
+		flags |= flagEnvelope
+	}
+	if msg.PayloadRef != nil {
+		flags |= flagChunked
+	}
+	if msg.Encryption != nil {
+		flags |= flagEncrypted
+	}
+
+	var b bytes.Buffer
+	b.WriteByte(BinaryMarker)
+	b.Write(varint.ToUvarint(flags))
+	writeBytes(&b, m)
+	b.Write(varint.ToUvarint(uint64(len(msg.Parms))))
+	for _, parm := range msg.Parms {
+		err = writeParm(&b, parm)
+		Ck(err)
+	}
+	if msg.Signature != nil {
+		writeBytes(&b, msg.Signature.PublicKey)
+		writeBytes(&b, msg.Signature.Sig)
+	}
+	if msg.Envelope != nil {
+		writeEnvelope(&b, msg.Envelope)
+	}
+	if msg.PayloadRef != nil {
+		writeBytes(&b, msg.PayloadRef.Root)
+		b.Write(varint.ToUvarint(uint64(msg.PayloadRef.Size)))
+	}
+	if msg.Encryption != nil {
+		writeEncryption(&b, msg.Encryption)
+	}
+	b.Write(varint.ToUvarint(payloadLen))
+
+	_, err = w.Write(b.Bytes())
+	Ck(err)
+	return nil
+}
+
+// unmarshalBinary decodes a binary-encoded message.
+func unmarshalBinary(data []byte, m *Message) (err error) {
+	defer Return(&err)
+	r := bytes.NewReader(data)
+
+	marker, err := r.ReadByte()
+	Ck(err)
+	Assert(marker == BinaryMarker, "invalid binary message marker: %#x", marker)
+
+	payloadLen, err := readBinaryHeader(r, m, uint64(r.Len()))
+	Ck(err)
+	Assert(payloadLen <= uint64(r.Len()), "invalid message; payload truncated")
+	payload := make([]byte, payloadLen)
+	_, err = io.ReadFull(r, payload)
+	Ck(err)
+	m.Payload = string(payload)
+
+	Assert(r.Len() == 0, "invalid message; %d trailing bytes", r.Len())
+	return nil
+}
+
+// readBinaryHeader reads the fields following the marker byte, up to
+// and including the payload length, which it returns.  No field may
+// be longer than max bytes.
+func readBinaryHeader(r byteReader, m *Message, max uint64) (payloadLen uint64, err error) {
+	defer Return(&err)
+
+	flags, err := varint.ReadUvarint(r)
+	Ck(err)
+	Assert(flags&^(flagSignature|flagEnvelope|flagChunked|flagEncrypted) == 0, "unsupported binary message flags: %#x", flags)
+
+	promiseBuf, err := readBytes(r, max)
+	Ck(err)
+	m.Promise, err = multihash.Decode(promiseBuf)
+	Ck(err)
+
+	n, err := varint.ReadUvarint(r)
+	Ck(err)
+	Assert(n <= max, "invalid message; parameter count %d too large", n)
+	m.Parms = nil
+	for i := uint64(0); i < n; i++ {
+		parm, err := readParm(r, max)
+		Ck(err)
+		m.Parms = append(m.Parms, parm)
+	}
+
+	m.Signature = nil
+	if flags&flagSignature != 0 {
+		sig := &Signature{}
+		sig.PublicKey, err = readBytes(r, max)
+		Ck(err)
+		sig.Sig, err = readBytes(r, max)
+		Ck(err)
+		m.Signature = sig
+	}
+
+	m.Envelope = nil
+	if flags&flagEnvelope != 0 {
+		m.Envelope, err = readEnvelope(r, max)
+		Ck(err)
+	}
+
+	m.PayloadRef = nil
+	if flags&flagChunked != 0 {
+		root, err := readBytes(r, max)
+		Ck(err)
+		mh, err := multihash.Cast(root)
+		Ck(err)
+		size, err := varint.ReadUvarint(r)
+		Ck(err)
+		m.PayloadRef = &PayloadRef{Root: mh, Size: int64(size)}
+	}
+
+	m.Encryption = nil
+	if flags&flagEncrypted != 0 {
+		m.Encryption, err = readEncryption(r, max)
+		Ck(err)
+	}
+	m.Payload = ""
+
+	payloadLen, err = varint.ReadUvarint(r)
+	Ck(err)
+	return payloadLen, nil
+}
+
+// writeBytes writes buf to b prefixed with its length as a uvarint.
+func writeBytes(b *bytes.Buffer, buf []byte) {
+	b.Write(varint.ToUvarint(uint64(len(buf))))
+	b.Write(buf)
+}
+
+// readBytes reads a uvarint length followed by that many bytes.  It
+// fails if the length is greater than max.
+func readBytes(r byteReader, max uint64) (buf []byte, err error) {
+	n, err := varint.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > max {
+		return nil, io.ErrUnexpectedEOF
+	}
+	buf = make([]byte, n)
+	_, err = io.ReadFull(r, buf)
+	return buf, err
+}
+
+// readVarint reads a zigzag-encoded signed varint, as written by
+// binary.AppendVarint.  Unlike binary.ReadVarint it rejects
+// non-minimal encodings, so each value has only one encoding.
+func readVarint(r byteReader) (n int64, err error) {
+	ux, err := varint.ReadUvarint(r)
+	if err != nil {
+		return 0, err
+	}
+	n = int64(ux >> 1)
+	if ux&1 != 0 {
+		n = ^n
+	}
+	return n, nil
+}
@@ -1,7 +1,60 @@
 package grid_cli
 
-// SyscallNode represents a node in the hierarchical syscall tree
+// SyscallNode represents a node in the hierarchical syscall tree.
+// Nodes reachable from a kernel's root are shared with running
+// lookups and must not be modified; see Kernel.updateTree.
 type SyscallNode struct {
 	Modules  []Module
 	Children map[string]*SyscallNode
+	// Mount is a tree mounted at this node, if any
+	Mount Mount
+	// Policy says how Modules share a message; nil means PolicyFirst
+	Policy *Policy
+	// segments are the pattern segments among the children's keys,
+	// in order of precedence
+	segments []Segment
+}
+
+func newSyscallNode() *SyscallNode {
+	return &SyscallNode{
+		Children: make(map[string]*SyscallNode),
+		Modules:  []Module{},
+	}
+}
+
+// clone returns a copy of n that can be changed without affecting n.
+// The children themselves are shared.
+func (n *SyscallNode) clone() *SyscallNode {
+	c := &SyscallNode{
+		Modules:  append([]Module{}, n.Modules...),
+		Children: make(map[string]*SyscallNode, len(n.Children)),
+		Mount:    n.Mount,
+		Policy:   n.Policy,
+		segments: n.segments,
+	}
+	for key, child := range n.Children {
+		c.Children[key] = child
+	}
+	return c
+}
+
+// setChild adds or replaces the child at key.
+func (n *SyscallNode) setChild(key string, child *SyscallNode) {
+	_, exists := n.Children[key]
+	n.Children[key] = child
+	if seg, err := ParseSegment(key); err == nil && !exists {
+		n.segments = append(n.segments[:len(n.segments):len(n.segments)], seg)
+		sortSegments(n.segments)
+	}
+}
+
+// deleteChild removes the child at key.
+func (n *SyscallNode) deleteChild(key string) {
+	delete(n.Children, key)
+	for i, seg := range n.segments {
+		if seg.key == key {
+			n.segments = append(n.segments[:i:i], n.segments[i+1:]...)
+			break
+		}
+	}
 }
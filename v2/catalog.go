@@ -0,0 +1,166 @@
+package grid_cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/multiformats/go-multibase"
+	"github.com/multiformats/go-multihash"
+	"github.com/spf13/afero"
+	. "github.com/stevegt/goadapt"
+)
+
+// ErrPromiseNotFound is returned when a promise hash isn't in the
+// catalog and no peer could supply it.
+var ErrPromiseNotFound = errors.New("promise not found")
+
+// PromiseSource is anywhere promise text can be fetched from by
+// hash, such as a peer's catalog.
+type PromiseSource interface {
+	FetchPromise(mh multihash.Multihash) (txt string, err error)
+}
+
+// PromiseEntry is a promise hash and the text it was made from.
+type PromiseEntry struct {
+	Hash multihash.Multihash
+	Text string
+}
+
+// PromiseCatalog maps promise hashes back to promise text.  It is
+// content-addressed: each promise is stored in a file named by the
+// multibase form of its hash, so an entry can always be checked
+// against its name.  On a local miss the catalog asks each of its
+// peers in turn, verifies what they return, and keeps a copy.
+type PromiseCatalog struct {
+	fs    afero.Fs
+	dir   string
+	Peers []PromiseSource
+}
+
+// NewPromiseCatalog returns a catalog stored in dir on fs.
+func NewPromiseCatalog(fs afero.Fs, dir string) *PromiseCatalog {
+	return &PromiseCatalog{fs: fs, dir: dir}
+}
+
+// Add hashes txt with the named algorithm, stores it, and returns
+// the promise hash.
+func (c *PromiseCatalog) Add(txt, algoName string) (mh multihash.Multihash, err error) {
+	defer Return(&err)
+	code, err := HashCode(algoName)
+	Ck(err)
+	mh, err = Sum(code, []byte(txt))
+	Ck(err)
+	err = c.store(mh, txt)
+	Ck(err)
+	return mh, nil
+}
+
+// Show returns the text of the promise with hash mh, asking peers if
+// it isn't in the local catalog.
+func (c *PromiseCatalog) Show(mh multihash.Multihash) (txt string, err error) {
+	txt, err = c.FetchPromise(mh)
+	if err == nil {
+		return txt, nil
+	}
+	if !errors.Is(err, ErrPromiseNotFound) {
+		return "", err
+	}
+	for _, peer := range c.Peers {
+		txt, err := peer.FetchPromise(mh)
+		if err != nil {
+			continue
+		}
+		// don't trust the peer; check the text hashes to mh
+		if VerifyHash(mh, []byte(txt)) != nil {
+			continue
+		}
+		err = c.store(mh, txt)
+		if err != nil {
+			return "", err
+		}
+		return txt, nil
+	}
+	return "", ErrPromiseNotFound
+}
+
+// FetchPromise looks mh up in the local catalog only.  It lets one
+// catalog serve as a PromiseSource for another.  An entry that
+// doesn't match its hash is a miss, so Show replaces it.
+func (c *PromiseCatalog) FetchPromise(mh multihash.Multihash) (txt string, err error) {
+	defer Return(&err)
+	fn, err := c.path(mh)
+	Ck(err)
+	buf, err := afero.ReadFile(c.fs, fn)
+	if os.IsNotExist(err) {
+		return "", ErrPromiseNotFound
+	}
+	Ck(err)
+	err = VerifyHash(mh, buf)
+	if err != nil {
+		return "", fmt.Errorf("%w: corrupt entry %s: %v", ErrPromiseNotFound, fn, err)
+	}
+	return string(buf), nil
+}
+
+// List returns every promise in the local catalog, sorted by text.
+func (c *PromiseCatalog) List() (entries []PromiseEntry, err error) {
+	return c.Search("")
+}
+
+// Search returns the promises in the local catalog whose text
+// contains substr, ignoring case, sorted by text.
+func (c *PromiseCatalog) Search(substr string) (entries []PromiseEntry, err error) {
+	defer Return(&err)
+	infos, err := afero.ReadDir(c.fs, c.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	Ck(err)
+	substr = strings.ToLower(substr)
+	for _, info := range infos {
+		_, buf, err := multibase.Decode(info.Name())
+		if err != nil {
+			continue
+		}
+		mh, err := multihash.Cast(buf)
+		if err != nil {
+			continue
+		}
+		txt, err := c.FetchPromise(mh)
+		if err != nil {
+			continue
+		}
+		if strings.Contains(strings.ToLower(txt), substr) {
+			entries = append(entries, PromiseEntry{Hash: mh, Text: txt})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Text < entries[j].Text
+	})
+	return entries, nil
+}
+
+// store writes txt to the catalog under mh.
+func (c *PromiseCatalog) store(mh multihash.Multihash, txt string) (err error) {
+	defer Return(&err)
+	fn, err := c.path(mh)
+	Ck(err)
+	err = c.fs.MkdirAll(c.dir, 0755)
+	Ck(err)
+	err = afero.WriteFile(c.fs, fn, []byte(txt), 0644)
+	Ck(err)
+	return nil
+}
+
+// path returns the file that holds the promise with hash mh.
+func (c *PromiseCatalog) path(mh multihash.Multihash) (fn string, err error) {
+	name, err := multibase.Encode(multibase.Base58BTC, mh)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(c.dir, name), nil
+}
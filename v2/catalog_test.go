@@ -0,0 +1,82 @@
+package grid_cli
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	. "github.com/stevegt/goadapt"
+)
+
+// TestPromiseCatalog tests adding, showing and searching promises,
+// and filling a miss from a peer
+func TestPromiseCatalog(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	peer := NewPromiseCatalog(fs, "/peer/promises")
+	mh, err := peer.Add("I will say hello", "sha256")
+	Tassert(t, err == nil, "Failed to add promise: %v", err)
+
+	// the hash matches the one NewPromise makes
+	promise, err := NewPromise("I will say hello", "sha256")
+	Tassert(t, err == nil, "Failed to create promise: %v", err)
+	Tassert(t, bytes.Equal(promise.Digest, mh[2:]), "Catalog hash doesn't match NewPromise")
+
+	catalog := NewPromiseCatalog(fs, "/local/promises")
+	_, err = catalog.Show(mh)
+	Tassert(t, errors.Is(err, ErrPromiseNotFound), "Expected ErrPromiseNotFound but got %v", err)
+
+	catalog.Peers = []PromiseSource{peer}
+	txt, err := catalog.Show(mh)
+	Tassert(t, err == nil, "Failed to show promise: %v", err)
+	Tassert(t, txt == "I will say hello", "Expected promise text but got %q", txt)
+
+	// the miss was filled locally
+	_, err = catalog.FetchPromise(mh)
+	Tassert(t, err == nil, "Expected promise in local catalog: %v", err)
+
+	// a corrupt entry is a miss, and is replaced from the peer
+	fn, err := catalog.path(mh)
+	Tassert(t, err == nil, "Failed to get path: %v", err)
+	err = afero.WriteFile(fs, fn, []byte("I will say goodbye"), 0644)
+	Tassert(t, err == nil, "Failed to write: %v", err)
+	_, err = catalog.FetchPromise(mh)
+	Tassert(t, errors.Is(err, ErrPromiseNotFound), "Expected ErrPromiseNotFound but got %v", err)
+	txt, err = catalog.Show(mh)
+	Tassert(t, err == nil && txt == "I will say hello", "Unexpected promise %q: %v", txt, err)
+	_, err = catalog.FetchPromise(mh)
+	Tassert(t, err == nil, "Expected the entry replaced: %v", err)
+
+	_, err = catalog.Add("I will say goodbye", "sha256")
+	Tassert(t, err == nil, "Failed to add promise: %v", err)
+	entries, err := catalog.List()
+	Tassert(t, err == nil, "Failed to list promises: %v", err)
+	Tassert(t, len(entries) == 2, "Expected 2 promises but got %d", len(entries))
+	entries, err = catalog.Search("HELLO")
+	Tassert(t, err == nil, "Failed to search promises: %v", err)
+	Tassert(t, len(entries) == 1 && entries[0].Text == "I will say hello", "Unexpected search result %v", entries)
+}
+
+// TestCliPromise tests the promise and msg subcommands
+func TestCliPromise(t *testing.T) {
+	var out bytes.Buffer
+	fs := afero.NewMemMapFs()
+	c := &cli{fs: fs, dir: "/home/.grid", out: &out}
+
+	err := c.run([]string{"promise", "add", "I", "will", "say", "hello"})
+	Tassert(t, err == nil, "Failed to add promise: %v", err)
+	hash := strings.TrimSpace(out.String())
+	Tassert(t, hash == "zQmddNuhGSReFgfv9rncrbEiruwPMu2YymprYHHC8YwqaQd", "Unexpected hash %q", hash)
+
+	data, err := afero.ReadFile(afero.NewOsFs(), "testdata/hello.msg")
+	Tassert(t, err == nil, "Failed to read test message file: %v", err)
+	err = afero.WriteFile(fs, "/hello.msg", data, 0644)
+	Tassert(t, err == nil, "Failed to write test message file: %v", err)
+
+	out.Reset()
+	err = c.run([]string{"msg", "show", "/hello.msg"})
+	Tassert(t, err == nil, "Failed to show message: %v", err)
+	Tassert(t, strings.Contains(out.String(), `"I will say hello"`), "Expected promise text in %q", out.String())
+	Tassert(t, strings.Contains(out.String(), "unsigned"), "Expected unsigned marker in %q", out.String())
+}
@@ -0,0 +1,405 @@
+package grid_cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/multiformats/go-multibase"
+	"github.com/multiformats/go-multihash"
+	"github.com/multiformats/go-varint"
+	"github.com/spf13/afero"
+	. "github.com/stevegt/goadapt"
+)
+
+// Large payloads travel as a Merkle DAG of content-addressed blocks,
+// with only the root hash and total size in the message; see
+// PayloadRef.  A block is either a leaf, holding up to ChunkSize
+// bytes of payload, or a node, holding up to chunkFanout links to
+// child blocks along with the number of payload bytes under each.
+// Every block is fetched and verified on its own, so a receiver
+// never needs more than one block per tree level in memory.
+const (
+	// ChunkSize is the most payload bytes in one leaf block.
+	ChunkSize = 256 * 1024
+	// ChunkThreshold is the payload size above which
+	// ChunkPayload moves a payload into blocks.
+	ChunkThreshold = ChunkSize
+)
+
+// chunkFanout is the most links in one node block.
+const chunkFanout = 1024
+
+// block type prefixes
+const (
+	blockLeaf byte = iota
+	blockNode
+)
+
+// ErrBlockNotFound is returned when a block is in neither the local
+// store nor any peer.
+var ErrBlockNotFound = errors.New("block not found")
+
+// PayloadRef stands in for a chunked payload.
+type PayloadRef struct {
+	Root multihash.Multihash
+	Size int64
+}
+
+// MarshalText encodes ref as the multibase root hash and the size,
+// as in the chunks header of a message.
+func (ref *PayloadRef) MarshalText() (text []byte, err error) {
+	root, err := multibase.Encode(multibase.Base58BTC, ref.Root)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(Spf("%s %d", root, ref.Size)), nil
+}
+
+// UnmarshalText decodes a ref encoded by MarshalText.
+func (ref *PayloadRef) UnmarshalText(text []byte) (err error) {
+	defer Return(&err)
+	fields := strings.Fields(string(text))
+	Assert(len(fields) == 2, "invalid payload ref %q", text)
+	_, buf, err := multibase.Decode(fields[0])
+	Ck(err)
+	root, err := multihash.Cast(buf)
+	Ck(err)
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	Ck(err)
+	Assert(size >= 0, "invalid payload size %d", size)
+	ref.Root, ref.Size = root, size
+	return nil
+}
+
+// BlockFetcher is anywhere blocks can be fetched from by hash, such
+// as a peer.
+type BlockFetcher interface {
+	FetchBlock(ctx context.Context, mh multihash.Multihash) ([]byte, error)
+}
+
+// BlockStore stores content-addressed blocks.
+type BlockStore interface {
+	BlockFetcher
+	PutBlock(data []byte) (mh multihash.Multihash, err error)
+	HasBlock(mh multihash.Multihash) bool
+}
+
+// FsBlockStore is a BlockStore kept in a directory on an afero
+// filesystem, one file per block named by the hex multihash, as in
+// the v1 cache.
+type FsBlockStore struct {
+	fs  afero.Fs
+	dir string
+}
+
+// NewFsBlockStore returns a block store in dir on fs.
+func NewFsBlockStore(fs afero.Fs, dir string) *FsBlockStore {
+	return &FsBlockStore{fs: fs, dir: dir}
+}
+
+// PutBlock stores data and returns its sha2-256 multihash.
+func (s *FsBlockStore) PutBlock(data []byte) (mh multihash.Multihash, err error) {
+	defer Return(&err)
+	mh, err = Sum(multihash.SHA2_256, data)
+	Ck(err)
+	if s.HasBlock(mh) {
+		return mh, nil
+	}
+	err = s.fs.MkdirAll(s.dir, 0755)
+	Ck(err)
+	err = afero.WriteFile(s.fs, s.path(mh), data, 0644)
+	Ck(err)
+	return mh, nil
+}
+
+// HasBlock reports whether the block is stored locally.
+func (s *FsBlockStore) HasBlock(mh multihash.Multihash) bool {
+	_, err := s.fs.Stat(s.path(mh))
+	return err == nil
+}
+
+// FetchBlock returns a locally stored block after checking that it
+// still matches its hash.
+func (s *FsBlockStore) FetchBlock(ctx context.Context, mh multihash.Multihash) (data []byte, err error) {
+	defer Return(&err)
+	data, err = afero.ReadFile(s.fs, s.path(mh))
+	if os.IsNotExist(err) {
+		return nil, ErrBlockNotFound
+	}
+	Ck(err)
+	err = VerifyHash(mh, data)
+	Ck(err)
+	return data, nil
+}
+
+func (s *FsBlockStore) path(mh multihash.Multihash) string {
+	return filepath.Join(s.dir, hex.EncodeToString(mh))
+}
+
+// HasPayload reports whether every block of the payload ref points to
+// is in the store.  Of the leaf blocks, only the first byte is read.
+func (s *FsBlockStore) HasPayload(ctx context.Context, ref *PayloadRef) bool {
+	stack := []multihash.Multihash{ref.Root}
+	for len(stack) > 0 {
+		mh := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		f, err := s.fs.Open(s.path(mh))
+		if err != nil {
+			return false
+		}
+		kind := make([]byte, 1)
+		_, err = io.ReadFull(f, kind)
+		f.Close()
+		if err != nil {
+			return false
+		}
+		if kind[0] != blockNode {
+			continue
+		}
+		data, err := s.FetchBlock(ctx, mh)
+		if err != nil {
+			return false
+		}
+		links, err := parseNode(data)
+		if err != nil {
+			return false
+		}
+		for _, l := range links {
+			stack = append(stack, l.mh)
+		}
+	}
+	return true
+}
+
+// link is a reference from a node block to a child block.
+type link struct {
+	mh   multihash.Multihash
+	size int64
+}
+
+// WritePayload splits everything read from r into blocks, stores
+// them in store, and returns a reference to the root.  Memory use is
+// bounded by the tree depth rather than the payload size.
+func WritePayload(store BlockStore, r io.Reader) (ref *PayloadRef, err error) {
+	return writePayload(store, r, chunkFanout)
+}
+
+// writePayload is WritePayload with at most fanout links per node
+// block, so tests can build deep trees from small payloads.
+func writePayload(store BlockStore, r io.Reader, fanout int) (ref *PayloadRef, err error) {
+	defer Return(&err)
+	// levels[i] holds the links collected so far at height i
+	var levels [][]link
+	var total int64
+
+	// push adds a link at height h, folding full levels into a
+	// node one level up
+	var push func(h int, l link)
+	push = func(h int, l link) {
+		if h == len(levels) {
+			levels = append(levels, nil)
+		}
+		levels[h] = append(levels[h], l)
+		if len(levels[h]) == fanout {
+			node, err := putNode(store, levels[h])
+			Ck(err)
+			levels[h] = nil
+			push(h+1, node)
+		}
+	}
+
+	buf := make([]byte, ChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			mh, err := store.PutBlock(append([]byte{blockLeaf}, buf[:n]...))
+			Ck(err)
+			push(0, link{mh: mh, size: int64(n)})
+			total += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		Ck(err)
+	}
+
+	// fold the partial levels into a single root
+	if len(levels) == 0 {
+		mh, err := store.PutBlock([]byte{blockLeaf})
+		Ck(err)
+		return &PayloadRef{Root: mh, Size: 0}, nil
+	}
+	var carry *link
+	for h := range levels {
+		links := levels[h]
+		if carry != nil {
+			links = append(links, *carry)
+		}
+		switch len(links) {
+		case 0:
+		case 1:
+			// a lone link needs no node of its own
+			l := links[0]
+			carry = &l
+		default:
+			node, err := putNode(store, links)
+			Ck(err)
+			carry = &node
+		}
+	}
+	return &PayloadRef{Root: carry.mh, Size: total}, nil
+}
+
+// putNode stores a node block linking to links.
+func putNode(store BlockStore, links []link) (l link, err error) {
+	var b bytes.Buffer
+	b.WriteByte(blockNode)
+	b.Write(varint.ToUvarint(uint64(len(links))))
+	for _, child := range links {
+		writeBytes(&b, child.mh)
+		b.Write(varint.ToUvarint(uint64(child.size)))
+		l.size += child.size
+	}
+	l.mh, err = store.PutBlock(b.Bytes())
+	return l, err
+}
+
+// parseNode decodes the links in a node block.
+func parseNode(data []byte) (links []link, err error) {
+	defer Return(&err)
+	r := bytes.NewReader(data[1:])
+	n, err := varint.ReadUvarint(r)
+	Ck(err)
+	Assert(n <= uint64(chunkFanout), "invalid node block; %d links", n)
+	for i := uint64(0); i < n; i++ {
+		mh, err := readBytes(r, uint64(r.Len()))
+		Ck(err)
+		size, err := varint.ReadUvarint(r)
+		Ck(err)
+		links = append(links, link{mh: mh, size: int64(size)})
+	}
+	Assert(r.Len() == 0, "invalid node block; %d trailing bytes", r.Len())
+	return links, nil
+}
+
+// PayloadReader reads a chunked payload.  Blocks missing from the
+// local store are fetched from the peers, verified, and kept in the
+// store.
+type PayloadReader struct {
+	ctx   context.Context
+	store BlockStore
+	peers []BlockFetcher
+	// stack of links still to visit, deepest last
+	stack [][]link
+	leaf  []byte
+	read  int64
+	size  int64
+}
+
+// NewPayloadReader returns a reader for the payload ref points to.
+func NewPayloadReader(ctx context.Context, ref *PayloadRef, store BlockStore, peers ...BlockFetcher) *PayloadReader {
+	return &PayloadReader{
+		ctx:   ctx,
+		store: store,
+		peers: peers,
+		stack: [][]link{{{mh: ref.Root, size: ref.Size}}},
+		size:  ref.Size,
+	}
+}
+
+func (p *PayloadReader) Read(buf []byte) (n int, err error) {
+	defer Return(&err)
+	for len(p.leaf) == 0 {
+		if len(p.stack) == 0 {
+			Assert(p.read == p.size, "payload is %d bytes, expected %d", p.read, p.size)
+			return 0, io.EOF
+		}
+		top := p.stack[len(p.stack)-1]
+		if len(top) == 0 {
+			p.stack = p.stack[:len(p.stack)-1]
+			continue
+		}
+		l := top[0]
+		p.stack[len(p.stack)-1] = top[1:]
+
+		data, err := p.fetch(l.mh)
+		Ck(err)
+		Assert(len(data) > 0, "empty block %x", []byte(l.mh))
+		switch data[0] {
+		case blockLeaf:
+			Assert(int64(len(data)-1) == l.size, "leaf block is %d bytes, expected %d", len(data)-1, l.size)
+			p.leaf = data[1:]
+		case blockNode:
+			links, err := parseNode(data)
+			Ck(err)
+			var size int64
+			for _, child := range links {
+				size += child.size
+			}
+			Assert(size == l.size, "node block covers %d bytes, expected %d", size, l.size)
+			p.stack = append(p.stack, links)
+		default:
+			Assert(false, "unknown block type %#x", data[0])
+		}
+	}
+	n = copy(buf, p.leaf)
+	p.leaf = p.leaf[n:]
+	p.read += int64(n)
+	return n, nil
+}
+
+// fetch returns a block from the local store, or from the first peer
+// that has a copy that matches its hash.
+func (p *PayloadReader) fetch(mh multihash.Multihash) (data []byte, err error) {
+	data, err = p.store.FetchBlock(p.ctx, mh)
+	if err == nil {
+		return data, nil
+	}
+	for _, peer := range p.peers {
+		data, err := peer.FetchBlock(p.ctx, mh)
+		if err != nil {
+			continue
+		}
+		if VerifyHash(mh, data) != nil {
+			continue
+		}
+		_, err = p.store.PutBlock(data)
+		if err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("%w: %x", ErrBlockNotFound, []byte(mh))
+}
+
+// ChunkPayload moves msg's payload into blocks in store if it is
+// larger than threshold, leaving only a PayloadRef in the message.
+func ChunkPayload(msg *Message, store BlockStore, threshold int) (err error) {
+	if len(msg.Payload) <= threshold {
+		return nil
+	}
+	ref, err := WritePayload(store, bytes.NewReader([]byte(msg.Payload)))
+	if err != nil {
+		return err
+	}
+	msg.PayloadRef = ref
+	msg.Payload = ""
+	return nil
+}
+
+// OpenPayload returns a reader for msg's payload, whether it is
+// carried in the message or chunked.
+func OpenPayload(ctx context.Context, msg *Message, store BlockStore, peers ...BlockFetcher) io.Reader {
+	if msg.PayloadRef == nil {
+		return bytes.NewReader([]byte(msg.Payload))
+	}
+	return NewPayloadReader(ctx, msg.PayloadRef, store, peers...)
+}
@@ -0,0 +1,65 @@
+package grid_cli
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+	. "github.com/stevegt/goadapt"
+)
+
+// TestChunkedPayload tests moving a payload into a block tree,
+// sending only the root, and fetching the blocks from a peer
+func TestChunkedPayload(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	sender := NewFsBlockStore(fs, "/sender/blocks")
+	receiver := NewFsBlockStore(fs, "/receiver/blocks")
+
+	payload := make([]byte, 5*ChunkSize+123)
+	rand.New(rand.NewSource(1)).Read(payload)
+	msg, err := NewMessage("I will say hello", "sha256", []interface{}{"hello"}, string(payload))
+	Tassert(t, err == nil, "Failed to create message: %v", err)
+	err = ChunkPayload(msg, sender, ChunkThreshold)
+	Tassert(t, err == nil, "Failed to chunk payload: %v", err)
+	Tassert(t, msg.Payload == "" && msg.PayloadRef != nil, "Expected payload to be chunked")
+	// a small fanout makes a deep tree of the same payload
+	msg.PayloadRef, err = writePayload(sender, bytes.NewReader(payload), 2)
+	Tassert(t, err == nil, "Failed to write payload: %v", err)
+
+	for _, marshal := range []func(*Message) ([]byte, error){Marshal, MarshalBinary} {
+		data, err := marshal(msg)
+		Tassert(t, err == nil, "Failed to marshal message: %v", err)
+		Tassert(t, len(data) < 1000, "Expected a small message but got %d bytes", len(data))
+		var got Message
+		err = Unmarshal(data, &got)
+		Tassert(t, err == nil, "Failed to unmarshal message: %v", err)
+		Tassert(t, got.PayloadRef.Size == int64(len(payload)), "Expected size %d but got %d", len(payload), got.PayloadRef.Size)
+
+		buf, err := io.ReadAll(OpenPayload(context.Background(), &got, receiver, sender))
+		Tassert(t, err == nil, "Failed to read payload: %v", err)
+		Tassert(t, bytes.Equal(buf, payload), "Payload mismatch")
+	}
+	Tassert(t, receiver.HasBlock(msg.PayloadRef.Root), "Expected receiver to keep fetched blocks")
+
+	// a tampered block is refused
+	empty := NewFsBlockStore(fs, "/empty/blocks")
+	infos, err := afero.ReadDir(fs, "/sender/blocks")
+	Tassert(t, err == nil, "Failed to read blocks: %v", err)
+	for _, info := range infos {
+		fn := filepath.Join("/sender/blocks", info.Name())
+		err = afero.WriteFile(fs, fn, []byte("tampered"), 0644)
+		Tassert(t, err == nil, "Failed to tamper with block: %v", err)
+	}
+	_, err = io.ReadAll(NewPayloadReader(context.Background(), msg.PayloadRef, empty, sender))
+	Tassert(t, err != nil, "Expected error for tampered blocks")
+
+	// the empty payload works too
+	ref, err := WritePayload(sender, bytes.NewReader(nil))
+	Tassert(t, err == nil, "Failed to write payload: %v", err)
+	buf, err := io.ReadAll(NewPayloadReader(context.Background(), ref, sender))
+	Tassert(t, err == nil && len(buf) == 0, "Expected empty payload but got %d bytes, %v", len(buf), err)
+}
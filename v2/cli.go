@@ -0,0 +1,411 @@
+package grid_cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/multiformats/go-multibase"
+	"github.com/multiformats/go-multihash"
+	"github.com/spf13/afero"
+	. "github.com/stevegt/goadapt"
+)
+
+// gridDir is the per-user grid directory, relative to $HOME.
+const gridDir = ".grid"
+
+// promiseDir holds the promise catalog, relative to the grid
+// directory.
+const promiseDir = "promises"
+
+// cacheDir holds the local cache, configFile the key=value config,
+// and peerList the peers' addresses, relative to the grid directory.
+const (
+	cacheDir   = "cache"
+	configFile = "config"
+	peerList   = "peers"
+)
+
+const usage = `Usage: grid-cli {command} [args...]
+
+  promise add {text...}         add a promise to the catalog
+  promise show {hash}           show the text of a promise
+  promise list                  list the promises in the catalog
+  promise search {text}         search the catalog
+  msg show {file}               pretty-print a message file
+  msg keygen {name}             write an X25519 key pair to name.key and name.pub
+  msg encrypt [-parms] {keyfile} {in} {out} {pubfile...}
+                                seal a message's payload, and its parms
+                                if -parms is given, to the recipients
+  msg decrypt {keyfile} {pubfile} {in} {out}
+                                open a message sealed by pubfile's owner
+  kernel tree [-dot]            show the syscall tree as JSON, or as
+                                Graphviz DOT if -dot is given
+  kernel explain {file}         show how a message file would be routed
+  cache usage                   show the size of the cache and its quota
+  cache pin [hash...]           keep entries from eviction, or list pins
+  cache unpin {hash...}         let pinned entries be evicted again
+  cache verify [--repair]       check every cache file against its hash,
+                                and quarantine corrupt ones if --repair
+                                is given`
+
+var errUsage = errors.New(usage)
+
+// cli holds what the subcommands need, so that tests can run them
+// against an in-memory filesystem.
+type cli struct {
+	fs  afero.Fs
+	dir string // grid directory
+	out io.Writer
+}
+
+// Main runs the grid-cli command with the given os.Args.
+func Main(args []string) {
+	c := &cli{
+		fs:  afero.NewOsFs(),
+		dir: filepath.Join(os.Getenv("HOME"), gridDir),
+		out: os.Stdout,
+	}
+	err := c.run(args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func (c *cli) run(args []string) (err error) {
+	if len(args) < 1 {
+		return errUsage
+	}
+	switch args[0] {
+	case "promise":
+		return c.promise(args[1:])
+	case "msg":
+		return c.msg(args[1:])
+	case "kernel":
+		return c.kernel(args[1:])
+	case "cache":
+		return c.cache(args[1:])
+	}
+	return errUsage
+}
+
+// catalog returns the local promise catalog, which asks the peers in
+// the peer list for the promises it lacks.
+func (c *cli) catalog() (catalog *PromiseCatalog, err error) {
+	peers, err := LoadPeers(c.fs, filepath.Join(c.dir, peerList))
+	if err != nil {
+		return nil, err
+	}
+	catalog = NewPromiseCatalog(c.fs, filepath.Join(c.dir, promiseDir))
+	for _, peer := range peers {
+		catalog.Peers = append(catalog.Peers, peer)
+	}
+	return catalog, nil
+}
+
+func (c *cli) promise(args []string) (err error) {
+	defer Return(&err)
+	if len(args) < 1 {
+		return errUsage
+	}
+	catalog, err := c.catalog()
+	Ck(err)
+	switch args[0] {
+	case "add":
+		Assert(len(args) > 1, "missing promise text")
+		mh, err := catalog.Add(strings.Join(args[1:], " "), "sha256")
+		Ck(err)
+		hashStr, err := multibase.Encode(multibase.Base58BTC, mh)
+		Ck(err)
+		fmt.Fprintln(c.out, hashStr)
+	case "show":
+		Assert(len(args) == 2, "usage: promise show {hash}")
+		mh, err := parseHash(args[1])
+		Ck(err)
+		txt, err := catalog.Show(mh)
+		Ck(err)
+		fmt.Fprintln(c.out, txt)
+	case "list", "search":
+		substr := strings.Join(args[1:], " ")
+		entries, err := catalog.Search(substr)
+		Ck(err)
+		for _, entry := range entries {
+			hashStr, err := multibase.Encode(multibase.Base58BTC, entry.Hash)
+			Ck(err)
+			fmt.Fprintf(c.out, "%s %s\n", hashStr, entry.Text)
+		}
+	default:
+		return errUsage
+	}
+	return nil
+}
+
+func (c *cli) msg(args []string) (err error) {
+	defer Return(&err)
+	if len(args) < 1 {
+		return errUsage
+	}
+	switch args[0] {
+	case "show":
+		Assert(len(args) == 2, "usage: msg show {file}")
+		msg, err := c.readMessage(args[1])
+		Ck(err)
+		catalog, err := c.catalog()
+		Ck(err)
+		txt, err := Pretty(msg, catalog)
+		Ck(err)
+		fmt.Fprint(c.out, txt)
+	case "keygen":
+		Assert(len(args) == 2, "usage: msg keygen {name}")
+		pub, priv, err := GenerateBoxKey()
+		Ck(err)
+		err = c.writeKey(args[1]+".pub", pub, 0644)
+		Ck(err)
+		err = c.writeKey(args[1]+".key", priv, 0600)
+		Ck(err)
+	case "encrypt":
+		args = args[1:]
+		parms := len(args) > 0 && args[0] == "-parms"
+		if parms {
+			args = args[1:]
+		}
+		Assert(len(args) >= 4, "usage: msg encrypt [-parms] {keyfile} {in} {out} {pubfile...}")
+		priv, err := c.readKey(args[0])
+		Ck(err)
+		var recipients []*[32]byte
+		for _, fn := range args[3:] {
+			pub, err := c.readKey(fn)
+			Ck(err)
+			recipients = append(recipients, pub)
+		}
+		msg, err := c.readMessage(args[1])
+		Ck(err)
+		err = Encrypt(msg, priv, recipients, parms)
+		Ck(err)
+		err = c.writeMessage(args[2], msg)
+		Ck(err)
+	case "decrypt":
+		Assert(len(args) == 5, "usage: msg decrypt {keyfile} {pubfile} {in} {out}")
+		priv, err := c.readKey(args[1])
+		Ck(err)
+		want, err := c.readKey(args[2])
+		Ck(err)
+		msg, err := c.readMessage(args[3])
+		Ck(err)
+		sender, err := Decrypt(msg, priv)
+		Ck(err)
+		Assert(*sender == *want, "message was not sealed by %s", args[2])
+		err = c.writeMessage(args[4], msg)
+		Ck(err)
+	default:
+		return errUsage
+	}
+	return nil
+}
+
+func (c *cli) kernel(args []string) (err error) {
+	defer Return(&err)
+	if len(args) < 1 {
+		return errUsage
+	}
+	k, err := NewKernelFs(c.fs, c.dir)
+	Ck(err)
+	switch args[0] {
+	case "tree":
+		dot := len(args) == 2 && args[1] == "-dot"
+		Assert(len(args) == 1 || dot, "usage: kernel tree [-dot]")
+		catalog, err := c.catalog()
+		Ck(err)
+		tree := k.Tree(catalog)
+		if dot {
+			return tree.WriteDOT(c.out)
+		}
+		buf, err := json.MarshalIndent(tree, "", "  ")
+		Ck(err)
+		fmt.Fprintln(c.out, string(buf))
+	case "explain":
+		Assert(len(args) == 2, "usage: kernel explain {file}")
+		msg, err := c.readMessage(args[1])
+		Ck(err)
+		ex, err := k.Explain(context.Background(), msg)
+		Ck(err)
+		fmt.Fprintf(c.out, "path:    %s\n", strings.Join(ex.Path, " "))
+		fmt.Fprintf(c.out, "literal: %d of %d elements\n", ex.Literal, len(ex.Path))
+		for _, e := range ex.Errors {
+			fmt.Fprintf(c.out, "error:   %s\n", e)
+		}
+		if len(ex.Candidates) == 0 {
+			fmt.Fprintln(c.out, "no modules match")
+		}
+		for i, cand := range ex.Candidates {
+			route := strings.Join(cand.Route, " ")
+			if route == "" {
+				route = "(root)"
+			}
+			if cand.Mounted {
+				route += " (mounted)"
+			}
+			fmt.Fprintf(c.out, "%d. %s\n", i+1, route)
+			fmt.Fprintf(c.out, "   depth %d, policy %s\n", cand.Depth, cand.Policy)
+			if len(cand.Captures) > 0 {
+				fmt.Fprintf(c.out, "   captures: %s\n", strings.Join(cand.Captures, " "))
+			}
+			for _, m := range cand.Modules {
+				fmt.Fprintf(c.out, "   module %s\n", m)
+			}
+		}
+	default:
+		return errUsage
+	}
+	return nil
+}
+
+func (c *cli) cache(args []string) (err error) {
+	defer Return(&err)
+	if len(args) < 1 {
+		return errUsage
+	}
+	cache, err := c.localCache()
+	Ck(err)
+	switch args[0] {
+	case "usage":
+		Assert(len(args) == 1, "usage: cache usage")
+		u, err := cache.Usage()
+		Ck(err)
+		// v1 keeps its modules and data in files beside the blobs
+		files, err := CacheFileItems(c.fs, filepath.Join(c.dir, cacheDir), cache.PinFile())
+		Ck(err)
+		fu := Usage(files)
+		fmt.Fprintf(c.out, "entries: %d\n", u.Entries+fu.Entries)
+		fmt.Fprintf(c.out, "bytes:   %d\n", u.Bytes+fu.Bytes)
+		fmt.Fprintf(c.out, "blobs:   %d, %d pinned\n", u.Items, u.Pinned)
+		fmt.Fprintf(c.out, "files:   %d, %d pinned\n", fu.Items, fu.Pinned)
+		quota := cache.Quota()
+		limit := func(n int64) string {
+			if n == 0 {
+				return "unlimited"
+			}
+			return Spf("%d", n)
+		}
+		fmt.Fprintf(c.out, "quota:   %s bytes, %s entries, %s eviction\n",
+			limit(quota.MaxBytes), limit(int64(quota.MaxEntries)), quota.Policy)
+	case "pin":
+		if len(args) == 1 {
+			pins, err := LoadPins(c.fs, cache.PinFile())
+			Ck(err)
+			for _, mh := range pins {
+				hashStr, err := multibase.Encode(multibase.Base58BTC, mh)
+				Ck(err)
+				fmt.Fprintln(c.out, hashStr)
+			}
+			return nil
+		}
+		for _, arg := range args[1:] {
+			mh, err := parseHash(arg)
+			Ck(err)
+			_, err = PinHash(c.fs, cache.PinFile(), mh)
+			Ck(err)
+		}
+	case "unpin":
+		Assert(len(args) > 1, "usage: cache unpin {hash...}")
+		for _, arg := range args[1:] {
+			mh, err := parseHash(arg)
+			Ck(err)
+			found, err := UnpinHash(c.fs, cache.PinFile(), mh)
+			Ck(err)
+			Assert(found, "%s is not pinned", arg)
+		}
+	case "verify":
+		repair := len(args) == 2 && (args[1] == "--repair" || args[1] == "-repair")
+		Assert(len(args) == 1 || repair, "usage: cache verify [--repair]")
+		// the cache directory holds v1's files and blocks as well as
+		// the blobs
+		checked, problems, err := VerifyCacheDir(c.fs, filepath.Join(c.dir, cacheDir), repair)
+		Ck(err)
+		n, blobProblems, err := cache.Verify(repair)
+		Ck(err)
+		checked += n
+		problems = append(problems, blobProblems...)
+		for _, p := range problems {
+			fmt.Fprintln(c.out, p)
+		}
+		fmt.Fprintf(c.out, "checked %d files, %d problems\n", checked, len(problems))
+		if !repair && len(problems) > 0 {
+			return fmt.Errorf("cache has %d problems; run cache verify --repair", len(problems))
+		}
+	default:
+		return errUsage
+	}
+	return nil
+}
+
+// localCache returns the local cache, kept within the quota set in
+// the config file.
+func (c *cli) localCache() (cache *LocalCacheModule, err error) {
+	quota, err := LoadCacheQuota(c.fs, filepath.Join(c.dir, configFile))
+	if err != nil {
+		return nil, err
+	}
+	cache = NewLocalCacheModule(c.fs, filepath.Join(c.dir, cacheDir))
+	cache.SetQuota(quota)
+	return cache, nil
+}
+
+// readMessage reads and unmarshals a message file.
+func (c *cli) readMessage(fn string) (msg *Message, err error) {
+	defer Return(&err)
+	data, err := afero.ReadFile(c.fs, fn)
+	Ck(err)
+	msg = &Message{}
+	err = Unmarshal(data, msg)
+	Ck(err)
+	return msg, nil
+}
+
+// writeMessage marshals msg to a message file.
+func (c *cli) writeMessage(fn string, msg *Message) (err error) {
+	defer Return(&err)
+	data, err := Marshal(msg)
+	Ck(err)
+	err = afero.WriteFile(c.fs, fn, data, 0644)
+	Ck(err)
+	return nil
+}
+
+// writeKey writes a 32-byte key to a file in multibase form.
+func (c *cli) writeKey(fn string, key *[32]byte, perm os.FileMode) (err error) {
+	defer Return(&err)
+	txt, err := multibase.Encode(multibase.Base58BTC, key[:])
+	Ck(err)
+	err = afero.WriteFile(c.fs, fn, []byte(txt+"\n"), perm)
+	Ck(err)
+	return nil
+}
+
+// readKey reads a 32-byte key written by writeKey.
+func (c *cli) readKey(fn string) (key *[32]byte, err error) {
+	defer Return(&err)
+	txt, err := afero.ReadFile(c.fs, fn)
+	Ck(err)
+	_, buf, err := multibase.Decode(strings.TrimSpace(string(txt)))
+	Ck(err)
+	Assert(len(buf) == 32, "invalid key length %d in %s", len(buf), fn)
+	key = new([32]byte)
+	copy(key[:], buf)
+	return key, nil
+}
+
+// parseHash parses a multibase-encoded multihash.
+func parseHash(s string) (mh multihash.Multihash, err error) {
+	_, buf, err := multibase.Decode(s)
+	if err != nil {
+		return nil, err
+	}
+	return multihash.Cast(buf)
+}
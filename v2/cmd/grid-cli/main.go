@@ -2,6 +2,8 @@ package main
 
 import (
 	"os"
+
+	grid_cli "github.com/stevegt/grid-cli/v2"
 )
 
 /*
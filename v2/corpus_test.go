@@ -0,0 +1,84 @@
+package grid_cli
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+const corpusDir = "testdata/corpus"
+
+// corpusFiles returns the files in a corpus subdirectory that have
+// one of the given extensions.
+func corpusFiles(t *testing.T, sub string, exts ...string) (fns []string) {
+	for _, ext := range exts {
+		matches, err := filepath.Glob(filepath.Join(corpusDir, sub, "*"+ext))
+		Tassert(t, err == nil, "glob failed: %v", err)
+		fns = append(fns, matches...)
+	}
+	Tassert(t, len(fns) > 0, "no corpus files in %s", sub)
+	return fns
+}
+
+// TestCorpus checks the message encodings against the conformance
+// corpus.
+func TestCorpus(t *testing.T) {
+	for _, fn := range corpusFiles(t, "valid", ".msg", ".bin") {
+		data, err := os.ReadFile(fn)
+		Tassert(t, err == nil, "%s: %v", fn, err)
+		var msg Message
+		err = Unmarshal(data, &msg)
+		Tassert(t, err == nil, "%s: %v", fn, err)
+		var got []byte
+		if strings.HasSuffix(fn, ".bin") {
+			got, err = MarshalBinary(&msg)
+		} else {
+			got, err = Marshal(&msg)
+		}
+		Tassert(t, err == nil, "%s: %v", fn, err)
+		Tassert(t, bytes.Equal(got, data), "%s: round trip changed\n%q\nto\n%q", fn, data, got)
+		Tassert(t, IsCanonical(data), "%s: not canonical", fn)
+	}
+
+	// the text and binary vectors of the same name carry the same
+	// message
+	for _, fn := range corpusFiles(t, "valid", ".bin") {
+		bin, err := os.ReadFile(fn)
+		Tassert(t, err == nil, "%s: %v", fn, err)
+		txt, err := os.ReadFile(strings.TrimSuffix(fn, ".bin") + ".msg")
+		Tassert(t, err == nil, "%s: %v", fn, err)
+		var binMsg, txtMsg Message
+		err = Unmarshal(bin, &binMsg)
+		Tassert(t, err == nil, "%s: %v", fn, err)
+		err = Unmarshal(txt, &txtMsg)
+		Tassert(t, err == nil, "%s: %v", fn, err)
+		Tassert(t, reflect.DeepEqual(binMsg, txtMsg), "%s: text and binary messages differ", fn)
+	}
+
+	for _, fn := range corpusFiles(t, "noncanonical", ".msg") {
+		data, err := os.ReadFile(fn)
+		Tassert(t, err == nil, "%s: %v", fn, err)
+		want, err := os.ReadFile(strings.TrimSuffix(fn, ".msg") + ".canonical")
+		Tassert(t, err == nil, "%s: %v", fn, err)
+		Tassert(t, !IsCanonical(data), "%s: unexpectedly canonical", fn)
+		got, err := Canonicalize(data)
+		Tassert(t, err == nil, "%s: %v", fn, err)
+		Tassert(t, bytes.Equal(got, want), "%s: expected\n%q\nbut got\n%q", fn, want, got)
+		Tassert(t, IsCanonical(want), "%s: canonical form is not canonical", fn)
+	}
+
+	for _, fn := range corpusFiles(t, "invalid", ".msg", ".bin") {
+		data, err := os.ReadFile(fn)
+		Tassert(t, err == nil, "%s: %v", fn, err)
+		var msg Message
+		err = Unmarshal(data, &msg)
+		Tassert(t, err != nil, "%s: expected an error", fn)
+		_, err = Canonicalize(data)
+		Tassert(t, err != nil, "%s: expected an error", fn)
+	}
+}
@@ -0,0 +1,290 @@
+package grid_cli
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/multiformats/go-multibase"
+	"github.com/multiformats/go-multihash"
+	"github.com/multiformats/go-varint"
+	. "github.com/stevegt/goadapt"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// An encrypted message keeps its promise in cleartext, so it can
+// still be routed, but its payload, and optionally its parameters,
+// are sealed.  The content is encrypted once with XChaCha20-Poly1305
+// under a random content key.  The content key is sealed to each
+// recipient's X25519 key with a NaCl box from the sender's X25519
+// key, so a recipient knows who sealed it.  The promise and the whole
+// encryption section are the additional data, so neither can be
+// changed, nor the ciphertext moved under another promise, without
+// decryption failing.
+
+// Encryption describes how a message's content was sealed.
+type Encryption struct {
+	Nonce      []byte      // XChaCha20-Poly1305 nonce
+	Sender     []byte      // the sender's X25519 public key
+	Parms      bool        // whether the parameters are sealed too
+	Recipients []Recipient // one sealed copy of the content key each
+}
+
+// Recipient is a content key sealed to one X25519 public key.
+type Recipient struct {
+	PublicKey []byte
+	// SealedKey is the box nonce followed by the box
+	SealedKey []byte
+}
+
+var (
+	// ErrNotRecipient is returned by Decrypt when the content key
+	// wasn't sealed to the given key.
+	ErrNotRecipient = errors.New("not a recipient of this message")
+	// ErrDecrypt is returned when the content fails to decrypt.
+	ErrDecrypt = errors.New("message decryption failed")
+)
+
+// GenerateBoxKey returns a new X25519 key pair for receiving
+// encrypted messages.
+func GenerateBoxKey() (pub, priv *[32]byte, err error) {
+	return box.GenerateKey(rand.Reader)
+}
+
+// BoxPublicKey returns the X25519 public key for priv.
+func BoxPublicKey(priv *[32]byte) (pub *[32]byte) {
+	pub = new([32]byte)
+	curve25519.ScalarBaseMult(pub, priv)
+	return pub
+}
+
+// Encrypt seals msg's payload, and its parameters if parms is true,
+// from the sender's X25519 private key to each of the recipients.
+// Sign the message after encrypting it, not before.  Chunked payloads
+// can't be encrypted.
+func Encrypt(msg *Message, sender *[32]byte, recipients []*[32]byte, parms bool) (err error) {
+	defer Return(&err)
+	Assert(msg.Encryption == nil, "message is already encrypted")
+	Assert(msg.PayloadRef == nil, "can't encrypt a chunked payload")
+	Assert(len(recipients) > 0, "no recipients")
+
+	var plain bytes.Buffer
+	if parms {
+		plain.Write(varint.ToUvarint(uint64(len(msg.Parms))))
+		for _, parm := range msg.Parms {
+			err = writeParm(&plain, parm)
+			Ck(err)
+		}
+	}
+	plain.WriteString(msg.Payload)
+
+	key := make([]byte, chacha20poly1305.KeySize)
+	_, err = rand.Read(key)
+	Ck(err)
+	aead, err := chacha20poly1305.NewX(key)
+	Ck(err)
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	Ck(err)
+
+	enc := &Encryption{Nonce: nonce, Sender: BoxPublicKey(sender)[:], Parms: parms}
+	for _, pub := range recipients {
+		var boxNonce [24]byte
+		_, err = rand.Read(boxNonce[:])
+		Ck(err)
+		enc.Recipients = append(enc.Recipients, Recipient{
+			PublicKey: append([]byte{}, pub[:]...),
+			SealedKey: box.Seal(boxNonce[:], key, &boxNonce, pub, sender),
+		})
+	}
+	ad, err := encryptionAD(msg.Promise, enc)
+	Ck(err)
+
+	msg.Payload = string(aead.Seal(nil, nonce, plain.Bytes(), ad))
+	if parms {
+		msg.Parms = nil
+	}
+	msg.Encryption = enc
+	return nil
+}
+
+// Decrypt opens a message encrypted to the X25519 key pair with
+// private key priv, restoring its payload and parameters, and returns
+// the X25519 public key of the sender that sealed it.  Check the
+// sender before trusting the content.  Any signature is dropped,
+// since it covered the ciphertext; check it with Verify before
+// decrypting.
+func Decrypt(msg *Message, priv *[32]byte) (sender *[32]byte, err error) {
+	defer Return(&err)
+	enc := msg.Encryption
+	Assert(enc != nil, "message is not encrypted")
+	Assert(len(enc.Sender) == 32, "invalid sender key length %d", len(enc.Sender))
+	sender = new([32]byte)
+	copy(sender[:], enc.Sender)
+	pub := BoxPublicKey(priv)
+
+	var key []byte
+	for _, r := range enc.Recipients {
+		if bytes.Equal(r.PublicKey, pub[:]) {
+			var boxNonce [24]byte
+			if len(r.SealedKey) < len(boxNonce) {
+				return nil, ErrDecrypt
+			}
+			copy(boxNonce[:], r.SealedKey)
+			var ok bool
+			key, ok = box.Open(nil, r.SealedKey[len(boxNonce):], &boxNonce, sender, priv)
+			if !ok {
+				return nil, ErrDecrypt
+			}
+			break
+		}
+	}
+	if key == nil {
+		return nil, ErrNotRecipient
+	}
+
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil || len(enc.Nonce) != chacha20poly1305.NonceSizeX {
+		return nil, ErrDecrypt
+	}
+	ad, err := encryptionAD(msg.Promise, enc)
+	Ck(err)
+	plain, err := aead.Open(nil, enc.Nonce, []byte(msg.Payload), ad)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+
+	r := bytes.NewReader(plain)
+	if enc.Parms {
+		n, err := varint.ReadUvarint(r)
+		Ck(err)
+		Assert(n <= uint64(r.Len()), "invalid sealed parameter count %d", n)
+		msg.Parms = nil
+		for i := uint64(0); i < n; i++ {
+			parm, err := readParm(r, uint64(r.Len()))
+			Ck(err)
+			msg.Parms = append(msg.Parms, parm)
+		}
+	}
+	payload, err := io.ReadAll(r)
+	Ck(err)
+	msg.Payload = string(payload)
+	msg.Encryption = nil
+	msg.Signature = nil
+	return sender, nil
+}
+
+// encryptionAD returns the additional data the content is sealed
+// with: the promise multihash followed by the binary encoding of enc.
+func encryptionAD(promise *multihash.DecodedMultihash, enc *Encryption) (ad []byte, err error) {
+	mh, err := multihash.Encode(promise.Digest, promise.Code)
+	if err != nil {
+		return nil, err
+	}
+	b := bytes.NewBuffer(mh)
+	writeEncryption(b, enc)
+	return b.Bytes(), nil
+}
+
+// writeEncryption appends the binary encoding of enc to b.
+func writeEncryption(b *bytes.Buffer, enc *Encryption) {
+	writeBytes(b, enc.Nonce)
+	writeBytes(b, enc.Sender)
+	if enc.Parms {
+		b.WriteByte(1)
+	} else {
+		b.WriteByte(0)
+	}
+	b.Write(varint.ToUvarint(uint64(len(enc.Recipients))))
+	for _, r := range enc.Recipients {
+		writeBytes(b, r.PublicKey)
+		writeBytes(b, r.SealedKey)
+	}
+}
+
+// readEncryption reads a binary-encoded encryption section.
+func readEncryption(r byteReader, max uint64) (enc *Encryption, err error) {
+	defer Return(&err)
+	enc = &Encryption{}
+	enc.Nonce, err = readBytes(r, max)
+	Ck(err)
+	enc.Sender, err = readBytes(r, max)
+	Ck(err)
+	parms, err := r.ReadByte()
+	Ck(err)
+	Assert(parms <= 1, "invalid encryption parms flag %d", parms)
+	enc.Parms = parms == 1
+	n, err := varint.ReadUvarint(r)
+	Ck(err)
+	Assert(n <= max, "invalid recipient count %d", n)
+	for i := uint64(0); i < n; i++ {
+		var rcpt Recipient
+		rcpt.PublicKey, err = readBytes(r, max)
+		Ck(err)
+		rcpt.SealedKey, err = readBytes(r, max)
+		Ck(err)
+		enc.Recipients = append(enc.Recipients, rcpt)
+	}
+	return enc, nil
+}
+
+// In the text encoding the encryption section is an "enc" header
+// line: the nonce, the sender's key, "parms" or "payload" to say what
+// is sealed, and a key:sealed-key pair per recipient, all multibase
+// encoded.  The sealed payload follows the header as usual.
+//
+//	enc zNonce... zSender... parms zKey1...:zSealed1... zKey2...:zSealed2...
+
+// encryptionText returns the fields of the enc header line.
+func encryptionText(enc *Encryption) (txt string, err error) {
+	defer Return(&err)
+	nonce, err := multibase.Encode(multibase.Base58BTC, enc.Nonce)
+	Ck(err)
+	sender, err := multibase.Encode(multibase.Base58BTC, enc.Sender)
+	Ck(err)
+	fields := []string{nonce, sender, "payload"}
+	if enc.Parms {
+		fields[2] = "parms"
+	}
+	for _, r := range enc.Recipients {
+		key, err := multibase.Encode(multibase.Base58BTC, r.PublicKey)
+		Ck(err)
+		sealed, err := multibase.Encode(multibase.Base58BTC, r.SealedKey)
+		Ck(err)
+		fields = append(fields, key+":"+sealed)
+	}
+	return strings.Join(fields, " "), nil
+}
+
+// parseEncryptionText parses the fields of an enc header line.
+func parseEncryptionText(fields []string) (enc *Encryption, err error) {
+	defer Return(&err)
+	Assert(len(fields) >= 4, "invalid enc header field")
+	enc = &Encryption{}
+	enc.Nonce, err = decodeBytes(fields[0])
+	Ck(err)
+	enc.Sender, err = decodeBytes(fields[1])
+	Ck(err)
+	switch fields[2] {
+	case "parms":
+		enc.Parms = true
+	case "payload":
+	default:
+		Assert(false, "invalid enc header field %q", fields[2])
+	}
+	for _, field := range fields[3:] {
+		key, sealed, ok := strings.Cut(field, ":")
+		Assert(ok, "invalid enc recipient %q", field)
+		var r Recipient
+		r.PublicKey, err = decodeBytes(key)
+		Ck(err)
+		r.SealedKey, err = decodeBytes(sealed)
+		Ck(err)
+		enc.Recipients = append(enc.Recipients, r)
+	}
+	return enc, nil
+}
@@ -0,0 +1,133 @@
+package grid_cli
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/afero"
+	. "github.com/stevegt/goadapt"
+)
+
+// TestEncryptDecrypt tests sealing a message to several recipients
+// and opening it after a round trip through both encodings
+func TestEncryptDecrypt(t *testing.T) {
+	alicePub, alicePriv, err := GenerateBoxKey()
+	Tassert(t, err == nil, "Failed to generate key: %v", err)
+	bobPub, bobPriv, err := GenerateBoxKey()
+	Tassert(t, err == nil, "Failed to generate key: %v", err)
+	_, evePriv, err := GenerateBoxKey()
+	Tassert(t, err == nil, "Failed to generate key: %v", err)
+	carolPub, carolPriv, err := GenerateBoxKey()
+	Tassert(t, err == nil, "Failed to generate key: %v", err)
+
+	for _, parms := range []bool{false, true} {
+		msg, err := NewMessage("I will say hello", "sha256", []interface{}{"hello", int64(7)}, "world")
+		Tassert(t, err == nil, "Failed to create message: %v", err)
+		err = Encrypt(msg, carolPriv, []*[32]byte{alicePub, bobPub}, parms)
+		Tassert(t, err == nil, "Failed to encrypt message: %v", err)
+		Tassert(t, msg.Payload != "world", "Expected payload to be sealed")
+		Tassert(t, (len(msg.Parms) == 0) == parms, "Unexpected cleartext parms %v", msg.Parms)
+
+		for _, marshal := range []func(*Message) ([]byte, error){Marshal, MarshalBinary} {
+			data, err := marshal(msg)
+			Tassert(t, err == nil, "Failed to marshal message: %v", err)
+			Tassert(t, !bytes.Contains(data, []byte("world")), "Expected no cleartext payload")
+
+			for _, priv := range []*[32]byte{alicePriv, bobPriv} {
+				var got Message
+				err = Unmarshal(data, &got)
+				Tassert(t, err == nil, "Failed to unmarshal message: %v", err)
+				// the promise is still readable for routing
+				Tassert(t, bytes.Equal(got.Promise.Digest, msg.Promise.Digest), "Promise mismatch")
+				sender, err := Decrypt(&got, priv)
+				Tassert(t, err == nil, "Failed to decrypt message: %v", err)
+				Tassert(t, *sender == *carolPub, "Unexpected sender %x", sender)
+				Tassert(t, got.Payload == "world", "Expected payload %q but got %q", "world", got.Payload)
+				Tassert(t, reflect.DeepEqual(got.Parms, []interface{}{"hello", int64(7)}), "Unexpected parms %v", got.Parms)
+			}
+
+			var got Message
+			err = Unmarshal(data, &got)
+			Tassert(t, err == nil, "Failed to unmarshal message: %v", err)
+			_, err = Decrypt(&got, evePriv)
+			Tassert(t, errors.Is(err, ErrNotRecipient), "Expected ErrNotRecipient but got %v", err)
+		}
+	}
+}
+
+// TestEncryptTamper tests that changing any part of the encryption
+// section makes decryption fail, and that a resealed message names
+// its new sender
+func TestEncryptTamper(t *testing.T) {
+	alicePub, alicePriv, err := GenerateBoxKey()
+	Tassert(t, err == nil, "Failed to generate key: %v", err)
+	bobPub, bobPriv, err := GenerateBoxKey()
+	Tassert(t, err == nil, "Failed to generate key: %v", err)
+	carolPub, carolPriv, err := GenerateBoxKey()
+	Tassert(t, err == nil, "Failed to generate key: %v", err)
+	malloryPub, malloryPriv, err := GenerateBoxKey()
+	Tassert(t, err == nil, "Failed to generate key: %v", err)
+
+	sealed := func(parms bool) *Message {
+		msg, err := NewMessage("I will say hello", "sha256", []interface{}{"hello"}, "world")
+		Tassert(t, err == nil, "Failed to create message: %v", err)
+		err = Encrypt(msg, carolPriv, []*[32]byte{alicePub, bobPub}, parms)
+		Tassert(t, err == nil, "Failed to encrypt message: %v", err)
+		return msg
+	}
+	for name, tamper := range map[string]func(enc *Encryption){
+		"parms":     func(enc *Encryption) { enc.Parms = !enc.Parms },
+		"sender":    func(enc *Encryption) { enc.Sender = malloryPub[:] },
+		"recipient": func(enc *Encryption) { enc.Recipients = enc.Recipients[1:] },
+		"nonce":     func(enc *Encryption) { enc.Nonce[0] ^= 1 },
+		// a nonce of the wrong length must not panic
+		"short nonce": func(enc *Encryption) { enc.Nonce = enc.Nonce[:12] },
+		"long nonce":  func(enc *Encryption) { enc.Nonce = append(enc.Nonce, 0) },
+	} {
+		for _, parms := range []bool{false, true} {
+			msg := sealed(parms)
+			tamper(msg.Encryption)
+			_, err = Decrypt(msg, bobPriv)
+			Tassert(t, errors.Is(err, ErrDecrypt), "%s: expected ErrDecrypt but got %v", name, err)
+		}
+	}
+
+	// mallory can only reseal the content under mallory's own key
+	msg := sealed(false)
+	_, err = Decrypt(msg, alicePriv)
+	Tassert(t, err == nil, "Failed to decrypt message: %v", err)
+	err = Encrypt(msg, malloryPriv, []*[32]byte{bobPub}, true)
+	Tassert(t, err == nil, "Failed to encrypt message: %v", err)
+	sender, err := Decrypt(msg, bobPriv)
+	Tassert(t, err == nil, "Failed to decrypt message: %v", err)
+	Tassert(t, *sender == *malloryPub && *sender != *carolPub, "Unexpected sender %x", sender)
+}
+
+// TestCliEncrypt tests the msg keygen, encrypt and decrypt subcommands
+func TestCliEncrypt(t *testing.T) {
+	var out bytes.Buffer
+	fs := afero.NewMemMapFs()
+	c := &cli{fs: fs, dir: "/home/.grid", out: &out}
+
+	data, err := afero.ReadFile(afero.NewOsFs(), "testdata/hello.msg")
+	Tassert(t, err == nil, "Failed to read test message file: %v", err)
+	err = afero.WriteFile(fs, "/hello.msg", data, 0644)
+	Tassert(t, err == nil, "Failed to write test message file: %v", err)
+
+	for _, name := range []string{"/alice", "/bob"} {
+		err = c.run([]string{"msg", "keygen", name})
+		Tassert(t, err == nil, "Failed to generate key: %v", err)
+	}
+	err = c.run([]string{"msg", "encrypt", "-parms", "/alice.key", "/hello.msg", "/sealed.msg", "/bob.pub"})
+	Tassert(t, err == nil, "Failed to encrypt: %v", err)
+	err = c.run([]string{"msg", "decrypt", "/bob.key", "/bob.pub", "/sealed.msg", "/opened.msg"})
+	Tassert(t, err != nil, "Expected an error for the wrong sender")
+	err = c.run([]string{"msg", "decrypt", "/bob.key", "/alice.pub", "/sealed.msg", "/opened.msg"})
+	Tassert(t, err == nil, "Failed to decrypt: %v", err)
+
+	opened, err := afero.ReadFile(fs, "/opened.msg")
+	Tassert(t, err == nil, "Failed to read decrypted message: %v", err)
+	Tassert(t, bytes.Equal(opened, data), "Expected %q but got %q", data, opened)
+}
@@ -0,0 +1,227 @@
+package grid_cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/multiformats/go-multibase"
+	"github.com/multiformats/go-multihash"
+	. "github.com/stevegt/goadapt"
+)
+
+// ErrNoHandler is what a NoHandlerError matches with errors.Is.
+var ErrNoHandler = errors.New("no handler")
+
+// NoHandlerError is returned by Dispatch when no module along the
+// message's path accepted it.
+type NoHandlerError struct {
+	Promise multihash.Multihash
+	Parms   []interface{}
+	// Depth is the most elements of the path, counting the promise,
+	// that matched nodes in the syscall tree.
+	Depth int
+	// Declined holds the errors returned by mounts that failed, and
+	// then by the modules that declined or failed, in the order they
+	// were offered the message.
+	Declined []error
+}
+
+func (e *NoHandlerError) Error() string {
+	promise, _ := multibase.Encode(multibase.Base58BTC, e.Promise)
+	return fmt.Sprintf("%v for promise %s with %d parms; matched %d of %d path elements, %d modules declined",
+		ErrNoHandler, promise, len(e.Parms), e.Depth, len(e.Parms)+1, len(e.Declined))
+}
+
+func (e *NoHandlerError) Is(target error) bool {
+	return target == ErrNoHandler
+}
+
+// msgKey is the context key for the message being dispatched.
+type msgKey struct{}
+
+// MessageFromContext returns the message that Dispatch is handling,
+// so modules can get at its payload and envelope.
+func MessageFromContext(ctx context.Context) (msg *Message, ok bool) {
+	msg, ok = ctx.Value(msgKey{}).(*Message)
+	return msg, ok
+}
+
+// messagePath returns the syscall tree path for msg: its promise
+// multihash followed by its parameters.
+func messagePath(msg *Message) (path []interface{}, err error) {
+	defer Return(&err)
+	Assert(msg.Promise != nil, "invalid message; missing promise hash")
+	mh, err := multihash.Encode(msg.Promise.Digest, msg.Promise.Code)
+	Ck(err)
+	path = append([]interface{}{multihash.Multihash(mh)}, msg.Parms...)
+	return path, nil
+}
+
+// Dispatch routes msg through the syscall tree.  It follows the
+// message's promise and then its parameters as far down the tree as
+// they match, then offers the message to the modules at the deepest
+// matching node, and then at each parent in turn, up to the root.
+// Where segments give more than one way down the tree, each is
+// tried in order of precedence before falling back to the parent;
+// see segment.go.  At a mount point, the modules the mounted tree
+// matches are tried after any deeper local match and before the
+// modules at the mount point itself; see mount.go.  The kernel's
+// first-level cache, if any, is tried before everything else; see
+// MountCache.  Modules see the whole path, promise first, and can
+// get what the segments captured with Captures.  How the modules at
+// a node share the message is decided by the node's Policy; by
+// default the first module whose Accept returns no error handles
+// it, and Dispatch returns what its HandleMessage returns.  If no
+// module handles the message, Dispatch returns a *NoHandlerError.
+func (k *Kernel) Dispatch(ctx context.Context, msg *Message) (out []byte, err error) {
+	res, err := k.DispatchResult(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+	return res.Out, nil
+}
+
+// DispatchResult is Dispatch, returning the result along with what
+// each module offered the message did with it.  The result is
+// returned even when err is not nil.
+func (k *Kernel) DispatchResult(ctx context.Context, msg *Message) (res *Result, err error) {
+	path, err := messagePath(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx = context.WithValue(ctx, msgKey{}, msg)
+	// match against the tree as it was when the dispatch started
+	m := &matcher{ctx: ctx}
+	k.matchPath(m, path)
+
+	res = &Result{}
+	depth := 0
+	for _, cand := range m.cands {
+		if cand.depth > depth {
+			depth = cand.depth
+		}
+		if len(cand.modules) == 0 {
+			continue
+		}
+		cctx := context.WithValue(ctx, capturesKey{}, cand.captures)
+		done, err := k.handle(cctx, cand, path, res)
+		if done {
+			return res, err
+		}
+	}
+	declined := m.errs
+	for _, o := range res.Outcomes {
+		if o.Err != nil {
+			declined = append(declined, o.Err)
+		}
+	}
+	return res, &NoHandlerError{
+		Promise:  path[0].(multihash.Multihash),
+		Parms:    msg.Parms,
+		Depth:    depth,
+		Declined: declined,
+	}
+}
+
+// matchPath adds the candidates for path: the first-level cache's,
+// then the syscall tree's.
+func (k *Kernel) matchPath(m *matcher, path []interface{}) {
+	if cache := k.cache.Load(); cache != nil {
+		m.mount(cache.tree, nil, path, nil, 0)
+	}
+	m.match(k.root.Load(), nil, path, nil, 0)
+}
+
+// candidate is a set of modules that matched a prefix of a
+// message's path.
+type candidate struct {
+	modules  []Module
+	policy   *Policy
+	captures []interface{}
+	// depth is how many path elements the match covers
+	depth int
+	// route is the tree keys leading to the node, or to the mount
+	// point if mounted is set
+	route   []string
+	mounted bool
+}
+
+// matcher collects the candidates for a path, in the order Dispatch
+// should offer them the message.
+type matcher struct {
+	ctx   context.Context
+	cands []candidate
+	errs  []error // from failed mount lookups
+}
+
+// match adds the candidates at and under node that match path: each
+// subtree in precedence order, deepest first, then whatever is
+// mounted at node, and then node's own modules.
+func (m *matcher) match(node *SyscallNode, route []string, path, captures []interface{}, depth int) {
+	// captures and route are shared between branches, so copy
+	// before adding
+	capture := func(c ...interface{}) []interface{} {
+		return append(captures[:len(captures):len(captures)], c...)
+	}
+	step := func(key string) []string {
+		return append(route[:len(route):len(route)], key)
+	}
+	if len(path) > 0 {
+		key := parmKey(path[0])
+		if child, exists := node.Children[key]; exists {
+			m.match(child, step(key), path[1:], captures, depth+1)
+		}
+	}
+	for _, seg := range node.segments {
+		child := node.Children[seg.key]
+		if seg.kind == segRest {
+			rest := append([]interface{}{}, path...)
+			m.match(child, step(seg.key), nil, capture(rest), depth+len(path))
+			continue
+		}
+		if len(path) == 0 {
+			continue
+		}
+		if c, ok := seg.match(path[0]); ok {
+			m.match(child, step(seg.key), path[1:], capture(c), depth+1)
+		}
+	}
+	if node.Mount != nil {
+		m.mount(node.Mount, route, path, captures, depth)
+	}
+	m.cands = append(m.cands, candidate{
+		modules:  node.Modules,
+		policy:   node.Policy,
+		captures: captures,
+		depth:    depth,
+		route:    route,
+	})
+}
+
+// mount adds the candidates that tree, mounted at a node reached by
+// route, matches for the remaining path.
+func (m *matcher) mount(tree Mount, route []string, path, captures []interface{}, depth int) {
+	matches, err := tree.Lookup(m.ctx, path)
+	if err != nil {
+		m.errs = append(m.errs, err)
+	}
+	for i, match := range matches {
+		// matches from the same node share a policy
+		last := len(m.cands) - 1
+		if i > 0 && match.Policy != nil && match.Policy == m.cands[last].policy &&
+			depth+match.Depth == m.cands[last].depth {
+			m.cands[last].modules = append(m.cands[last].modules, match.Module)
+			continue
+		}
+		m.cands = append(m.cands, candidate{
+			modules:  []Module{match.Module},
+			policy:   match.Policy,
+			captures: append(captures[:len(captures):len(captures)], match.Captures...),
+			depth:    depth + match.Depth,
+			route:    route,
+			mounted:  true,
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package grid_cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/multiformats/go-multihash"
+	. "github.com/stevegt/goadapt"
+)
+
+// TestDispatch tests longest-prefix routing and fallback to parents.
+func TestDispatch(t *testing.T) {
+	msg, err := NewMessage("I will say hello", "sha256", []interface{}{"hello", "world"}, "payload")
+	Tassert(t, err == nil, "Failed to create message: %v", err)
+	path, err := messagePath(msg)
+	Tassert(t, err == nil, "Failed to get path: %v", err)
+	promise := path[0].(multihash.Multihash)
+
+	k := NewKernel()
+	ctx := context.Background()
+
+	// nothing bound
+	_, err = k.Dispatch(ctx, msg)
+	Tassert(t, errors.Is(err, ErrNoHandler), "Expected ErrNoHandler but got %v", err)
+	var nh *NoHandlerError
+	Tassert(t, errors.As(err, &nh), "Expected *NoHandlerError but got %T", err)
+	Tassert(t, nh.Depth == 0, "Expected depth 0 but got %d", nh.Depth)
+
+	top := &fakeModule{name: "top", payload: true, rec: &fakeRecord{}}
+	mid := &fakeModule{name: "mid", payload: true, rec: &fakeRecord{}}
+	deep := &fakeModule{name: "deep", payload: true, rec: &fakeRecord{}}
+	other := &fakeModule{name: "other", payload: true, rec: &fakeRecord{}}
+	k.bindSyscall(top, promise)
+	k.bindSyscall(mid, promise, "hello")
+	k.bindSyscall(deep, promise, "hello", "world")
+	k.bindSyscall(other, promise, "goodbye")
+
+	// the deepest match wins
+	out, err := k.Dispatch(ctx, msg)
+	Tassert(t, err == nil, "Dispatch failed: %v", err)
+	Tassert(t, string(out) == "deep:payload", "Expected deep:payload but got %q", out)
+	Tassert(t, len(deep.rec.parms) == 3 && deep.rec.parms[2] == "world", "Expected the whole path but got %v", deep.rec.parms)
+
+	// a longer path matches as far as it can
+	msg.Parms = []interface{}{"hello", "there", "world"}
+	out, err = k.Dispatch(ctx, msg)
+	Tassert(t, err == nil, "Dispatch failed: %v", err)
+	Tassert(t, string(out) == "mid:payload", "Expected mid:payload but got %q", out)
+
+	// a declining module falls back to its parents
+	msg.Parms = []interface{}{"hello", "world"}
+	deep.decline = true
+	out, err = k.Dispatch(ctx, msg)
+	Tassert(t, err == nil, "Dispatch failed: %v", err)
+	Tassert(t, string(out) == "mid:payload", "Expected mid:payload but got %q", out)
+	mid.decline = true
+	out, err = k.Dispatch(ctx, msg)
+	Tassert(t, err == nil, "Dispatch failed: %v", err)
+	Tassert(t, string(out) == "top:payload", "Expected top:payload but got %q", out)
+
+	// everyone declines
+	top.decline = true
+	_, err = k.Dispatch(ctx, msg)
+	Tassert(t, errors.As(err, &nh), "Expected *NoHandlerError but got %v", err)
+	Tassert(t, nh.Depth == 3, "Expected depth 3 but got %d", nh.Depth)
+	Tassert(t, len(nh.Declined) == 3, "Expected 3 declines but got %d", len(nh.Declined))
+
+	// typed parameters don't match their string forms
+	k.bindSyscall(fakeModule{name: "int", payload: true}, promise, int64(1))
+	msg.Parms = []interface{}{"1"}
+	_, err = k.Dispatch(ctx, msg)
+	Tassert(t, errors.Is(err, ErrNoHandler), "Expected ErrNoHandler but got %v", err)
+	msg.Parms = []interface{}{int64(1)}
+	out, err = k.Dispatch(ctx, msg)
+	Tassert(t, err == nil, "Dispatch failed: %v", err)
+	Tassert(t, string(out) == "int:payload", "Expected int:payload but got %q", out)
+}
+
+// TestDispatchConcurrent dispatches while modules are being bound
+// and unbound.  Run it with -race.
+func TestDispatchConcurrent(t *testing.T) {
+	msg, err := NewMessage("I will say hello", "sha256", []interface{}{"a", "b", "c"}, "")
+	Tassert(t, err == nil, "Failed to create message: %v", err)
+	path, err := messagePath(msg)
+	Tassert(t, err == nil, "Failed to get path: %v", err)
+
+	k := NewKernel()
+	k.bindSyscall(fakeModule{name: "root"}, path[0])
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				module := fakeModule{name: fmt.Sprintf("m%d-%d", i, j)}
+				p := path[:1+(i+j)%len(path)]
+				k.bindSyscall(module, p...)
+				k.bindSyscall(module, append(p[:len(p):len(p)], j)...)
+				if !k.unbindSyscall(module, p...) || !k.unbindSyscall(module, append(p[:len(p):len(p)], j)...) {
+					t.Errorf("Failed to unbind %s", module.name)
+					return
+				}
+			}
+		}(i)
+	}
+
+	var readers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				out, err := k.Dispatch(ctx, msg)
+				if err != nil || len(out) == 0 {
+					t.Errorf("Dispatch failed: %q, %v", out, err)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(stop)
+	readers.Wait()
+
+	// everything but the root binding was removed, and the empty
+	// nodes were pruned
+	out, err := k.Dispatch(ctx, msg)
+	Tassert(t, err == nil, "Dispatch failed: %v", err)
+	Tassert(t, string(out) == "root", "Expected root but got %q", out)
+	node := k.findBestMatch(path...)
+	Tassert(t, len(node.Children) == 0, "Expected no children but got %d", len(node.Children))
+}
+
+// TestTreeSnapshot tests that a lookup keeps seeing the tree it
+// started with.
+func TestTreeSnapshot(t *testing.T) {
+	k := NewKernel()
+	k.bindSyscall(fakeModule{name: "a"}, "x", "y")
+	old := k.root.Load()
+	k.bindSyscall(fakeModule{name: "b"}, "x", "y")
+	k.unbindSyscall(fakeModule{name: "a"}, "x", "y")
+	k.bindSyscall(fakeModule{name: "c"}, "x", "z")
+
+	nodes := walk(old, "x", "y")
+	Tassert(t, len(nodes) == 3, "Expected 3 nodes but got %d", len(nodes))
+	Tassert(t, len(nodes[2].Modules) == 1 && nodes[2].Modules[0] == Module(fakeModule{name: "a"}), "Old tree changed: %v", nodes[2].Modules)
+	Tassert(t, len(nodes[1].Children) == 1, "Old tree changed: %v", nodes[1].Children)
+
+	nodes = walk(k.root.Load(), "x", "y")
+	Tassert(t, len(nodes[2].Modules) == 1 && nodes[2].Modules[0] == Module(fakeModule{name: "b"}), "Expected b but got %v", nodes[2].Modules)
+	Tassert(t, len(nodes[1].Children) == 2, "Expected 2 children but got %d", len(nodes[1].Children))
+}
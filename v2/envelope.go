@@ -0,0 +1,257 @@
+package grid_cli
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/multiformats/go-multibase"
+	"github.com/multiformats/go-varint"
+	. "github.com/stevegt/goadapt"
+)
+
+// Envelope carries the optional delivery fields of a message: when
+// it was sent, how long and how far it may travel, and how to match
+// a reply to its request.  None of it affects routing, which still
+// starts with the promise.
+type Envelope struct {
+	// Timestamp is when the message was sent, in nanoseconds since
+	// the Unix epoch.  NewEnvelope never hands out the same
+	// timestamp twice.
+	Timestamp int64
+	// Nonce makes the message unique, so a replay can be detected.
+	Nonce []byte
+	// TTL is how long after Timestamp the message expires; zero
+	// means it doesn't.
+	TTL time.Duration
+	// Hops counts the nodes the message has passed through, and
+	// HopLimit is the most it may pass through; zero means no
+	// limit.  Hops is not covered by a signature.
+	Hops     uint32
+	HopLimit uint32
+	// ReplyTo names the reply port replies should be sent to
+	// rather than back to the sender; see Kernel.OpenReplyPort.
+	ReplyTo string
+	// CorrelationID is set by a requester and copied into the reply.
+	CorrelationID string
+}
+
+var (
+	// ErrExpired is returned for a message received after its TTL.
+	ErrExpired = errors.New("message expired")
+	// ErrFuture is returned for a message whose timestamp is further
+	// ahead than clock skew explains.
+	ErrFuture = errors.New("message timestamp in the future")
+	// ErrHopLimit is returned for a message that has passed through
+	// more nodes than its hop limit allows.
+	ErrHopLimit = errors.New("message hop limit exceeded")
+	// ErrReplay is returned for a message whose nonce has been seen
+	// before, or which is too old for its nonce to be checked.
+	ErrReplay = errors.New("message replayed")
+	// ErrNoCorrelationID is returned for a request that has no
+	// correlation ID to match its reply by.
+	ErrNoCorrelationID = errors.New("request has no correlation ID")
+	// ErrNoReplyPort is returned for a reply to a port that isn't
+	// open.
+	ErrNoReplyPort = errors.New("no such reply port")
+	// ErrReplyPortInUse is returned for opening a reply port that is
+	// already open.
+	ErrReplyPortInUse = errors.New("reply port in use")
+	// ErrReplyPortFull is returned for a reply to a port whose queue
+	// is full.
+	ErrReplyPortFull = errors.New("reply port full")
+)
+
+// clock hands out strictly increasing timestamps even if the wall
+// clock stalls or steps backwards.
+var clock struct {
+	sync.Mutex
+	last int64
+}
+
+func monotonicNow() int64 {
+	clock.Lock()
+	defer clock.Unlock()
+	t := time.Now().UnixNano()
+	if t <= clock.last {
+		t = clock.last + 1
+	}
+	clock.last = t
+	return t
+}
+
+// NewEnvelope returns an envelope with a fresh timestamp, nonce and
+// correlation ID, expiring after ttl.
+func NewEnvelope(ttl time.Duration) (env *Envelope, err error) {
+	defer Return(&err)
+	nonce := make([]byte, 16)
+	_, err = rand.Read(nonce)
+	Ck(err)
+	corr := make([]byte, 8)
+	_, err = rand.Read(corr)
+	Ck(err)
+	env = &Envelope{
+		Timestamp:     monotonicNow(),
+		Nonce:         nonce,
+		TTL:           ttl,
+		CorrelationID: hex.EncodeToString(corr),
+	}
+	return env, nil
+}
+
+// NewReplyEnvelope returns an envelope for a reply to a request with
+// envelope req, carrying the request's correlation ID.
+func NewReplyEnvelope(req *Envelope, ttl time.Duration) (env *Envelope, err error) {
+	env, err = NewEnvelope(ttl)
+	if err != nil {
+		return nil, err
+	}
+	env.CorrelationID = req.CorrelationID
+	return env, nil
+}
+
+// NewReply returns a reply to req under the same promise, carrying
+// payload in a fresh envelope with req's correlation ID, if it has
+// one, and expiring after ttl.
+func NewReply(req *Message, payload []byte, ttl time.Duration) (reply *Message, err error) {
+	defer Return(&err)
+	env, err := NewEnvelope(ttl)
+	Ck(err)
+	env.CorrelationID = ""
+	if req.Envelope != nil {
+		env.CorrelationID = req.Envelope.CorrelationID
+	}
+	reply = &Message{Promise: req.Promise, Payload: string(payload), Envelope: env}
+	return reply, nil
+}
+
+// Expired reports whether the envelope's TTL has run out at now.
+func (env *Envelope) Expired(now time.Time) bool {
+	if env.TTL == 0 {
+		return false
+	}
+	return now.UnixNano() > env.Timestamp+int64(env.TTL)
+}
+
+// Hop records that the message has reached another node, and returns
+// ErrHopLimit if that takes it past its hop limit.
+func (env *Envelope) Hop() error {
+	env.Hops++
+	if env.HopLimit > 0 && env.Hops > env.HopLimit {
+		return ErrHopLimit
+	}
+	return nil
+}
+
+// writeEnvelope appends the binary encoding of env to b.
+func writeEnvelope(b *bytes.Buffer, env *Envelope) {
+	b.Write(binary.AppendVarint(nil, env.Timestamp))
+	writeBytes(b, env.Nonce)
+	b.Write(varint.ToUvarint(uint64(env.TTL)))
+	b.Write(varint.ToUvarint(uint64(env.Hops)))
+	b.Write(varint.ToUvarint(uint64(env.HopLimit)))
+	writeBytes(b, []byte(env.ReplyTo))
+	writeBytes(b, []byte(env.CorrelationID))
+}
+
+// readEnvelope reads a binary-encoded envelope.
+func readEnvelope(r byteReader, max uint64) (env *Envelope, err error) {
+	defer Return(&err)
+	env = &Envelope{}
+	env.Timestamp, err = readVarint(r)
+	Ck(err)
+	env.Nonce, err = readBytes(r, max)
+	Ck(err)
+	ttl, err := varint.ReadUvarint(r)
+	Ck(err)
+	env.TTL = time.Duration(ttl)
+	hops, err := varint.ReadUvarint(r)
+	Ck(err)
+	env.Hops = uint32(hops)
+	limit, err := varint.ReadUvarint(r)
+	Ck(err)
+	env.HopLimit = uint32(limit)
+	replyTo, err := readBytes(r, max)
+	Ck(err)
+	env.ReplyTo = string(replyTo)
+	corr, err := readBytes(r, max)
+	Ck(err)
+	env.CorrelationID = string(corr)
+	return env, nil
+}
+
+// In the text encoding the envelope is an "env" header line of
+// key=value fields, with empty fields left out:
+//
+//	env ts=1718000000000000000 nonce=z3yMU... ttl=30s hops=1 hoplimit=8 reply=stdin corr=a1b2
+//
+// The reply and corr values are URL path-escaped.
+
+// envelopeText returns the fields of the env header line.
+func envelopeText(env *Envelope) (txt string, err error) {
+	fields := []string{"ts=" + strconv.FormatInt(env.Timestamp, 10)}
+	if len(env.Nonce) > 0 {
+		nonce, err := multibase.Encode(multibase.Base58BTC, env.Nonce)
+		if err != nil {
+			return "", err
+		}
+		fields = append(fields, "nonce="+nonce)
+	}
+	if env.TTL != 0 {
+		fields = append(fields, "ttl="+env.TTL.String())
+	}
+	if env.Hops != 0 {
+		fields = append(fields, "hops="+strconv.FormatUint(uint64(env.Hops), 10))
+	}
+	if env.HopLimit != 0 {
+		fields = append(fields, "hoplimit="+strconv.FormatUint(uint64(env.HopLimit), 10))
+	}
+	if env.ReplyTo != "" {
+		fields = append(fields, "reply="+url.PathEscape(env.ReplyTo))
+	}
+	if env.CorrelationID != "" {
+		fields = append(fields, "corr="+url.PathEscape(env.CorrelationID))
+	}
+	return strings.Join(fields, " "), nil
+}
+
+// parseEnvelopeText parses the fields of an env header line.
+func parseEnvelopeText(fields []string) (env *Envelope, err error) {
+	defer Return(&err)
+	env = &Envelope{}
+	for _, field := range fields {
+		key, val, ok := strings.Cut(field, "=")
+		Assert(ok, "invalid env field %q", field)
+		switch key {
+		case "ts":
+			env.Timestamp, err = strconv.ParseInt(val, 10, 64)
+		case "nonce":
+			_, env.Nonce, err = multibase.Decode(val)
+		case "ttl":
+			env.TTL, err = time.ParseDuration(val)
+		case "hops":
+			var n uint64
+			n, err = strconv.ParseUint(val, 10, 32)
+			env.Hops = uint32(n)
+		case "hoplimit":
+			var n uint64
+			n, err = strconv.ParseUint(val, 10, 32)
+			env.HopLimit = uint32(n)
+		case "reply":
+			env.ReplyTo, err = url.PathUnescape(val)
+		case "corr":
+			env.CorrelationID, err = url.PathUnescape(val)
+		default:
+			Assert(false, "unknown env field %q", key)
+		}
+		Ck(err, "env field %q", key)
+	}
+	return env, nil
+}
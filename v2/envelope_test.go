@@ -0,0 +1,142 @@
+package grid_cli
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// TestEnvelopeRoundTrip tests that envelopes survive both encodings,
+// and that a signature survives a change to the hop count
+func TestEnvelopeRoundTrip(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(nil)
+	Tassert(t, err == nil, "Failed to generate key: %v", err)
+	msg, err := NewMessage("I will say hello", "sha256", []interface{}{"hello"}, "world")
+	Tassert(t, err == nil, "Failed to create message: %v", err)
+	msg.Envelope, err = NewEnvelope(30 * time.Second)
+	Tassert(t, err == nil, "Failed to create envelope: %v", err)
+	msg.Envelope.HopLimit = 8
+	msg.Envelope.ReplyTo = "my port"
+	err = Sign(msg, priv)
+	Tassert(t, err == nil, "Failed to sign message: %v", err)
+	msg.Envelope.Hops = 3
+
+	for _, marshal := range []func(*Message) ([]byte, error){Marshal, MarshalBinary} {
+		data, err := marshal(msg)
+		Tassert(t, err == nil, "Failed to marshal message: %v", err)
+		var got Message
+		err = Unmarshal(data, &got)
+		Tassert(t, err == nil, "Failed to unmarshal %q: %v", data, err)
+		Tassert(t, reflect.DeepEqual(got.Envelope, msg.Envelope), "Expected envelope %#v but got %#v", msg.Envelope, got.Envelope)
+	}
+
+	// timestamps never repeat
+	env2, err := NewEnvelope(0)
+	Tassert(t, err == nil, "Failed to create envelope: %v", err)
+	Tassert(t, env2.Timestamp > msg.Envelope.Timestamp, "Expected increasing timestamps")
+}
+
+// TestKernelReceive tests that the kernel drops expired, replayed and
+// over-limit messages and routes replies by correlation ID
+func TestKernelReceive(t *testing.T) {
+	k := NewKernel()
+	newMsg := func() *Message {
+		msg, err := NewMessage("I will say hello", "sha256", nil, "")
+		Tassert(t, err == nil, "Failed to create message: %v", err)
+		msg.Envelope, err = NewEnvelope(time.Minute)
+		Tassert(t, err == nil, "Failed to create envelope: %v", err)
+		return msg
+	}
+
+	msg := newMsg()
+	replied, err := k.Receive(msg)
+	Tassert(t, err == nil && !replied, "Expected plain delivery but got %v %v", replied, err)
+	_, err = k.Receive(msg)
+	Tassert(t, errors.Is(err, ErrReplay), "Expected ErrReplay but got %v", err)
+
+	msg = newMsg()
+	msg.Envelope.Timestamp -= int64(2 * time.Minute)
+	_, err = k.Receive(msg)
+	Tassert(t, errors.Is(err, ErrExpired), "Expected ErrExpired but got %v", err)
+
+	// clocks may disagree a little, but not a lot
+	msg = newMsg()
+	msg.Envelope.Timestamp += int64(clockSkew / 2)
+	_, err = k.Receive(msg)
+	Tassert(t, err == nil, "Expected a slightly early message but got %v", err)
+	msg = newMsg()
+	msg.Envelope.Timestamp += int64(2 * clockSkew)
+	_, err = k.Receive(msg)
+	Tassert(t, errors.Is(err, ErrFuture), "Expected ErrFuture but got %v", err)
+
+	msg = newMsg()
+	msg.Envelope.HopLimit = 1
+	msg.Envelope.Hops = 1
+	_, err = k.Receive(msg)
+	Tassert(t, errors.Is(err, ErrHopLimit), "Expected ErrHopLimit but got %v", err)
+
+	req := newMsg()
+	reply, cancel, err := k.Request(req)
+	Tassert(t, err == nil, "Failed to request: %v", err)
+	defer cancel()
+	resp := newMsg()
+	resp.Envelope, err = NewReplyEnvelope(req.Envelope, time.Minute)
+	Tassert(t, err == nil, "Failed to create envelope: %v", err)
+	replied, err = k.Receive(resp)
+	Tassert(t, err == nil && replied, "Expected reply routing but got %v %v", replied, err)
+	got := <-reply
+	Tassert(t, got == resp, "Expected the reply message")
+
+	// requests need a correlation ID
+	req.Envelope = nil
+	_, _, err = k.Request(req)
+	Tassert(t, errors.Is(err, ErrNoCorrelationID), "Expected ErrNoCorrelationID but got %v", err)
+}
+
+// TestKernelReply tests that replies go to the reply port their
+// request names.
+func TestKernelReply(t *testing.T) {
+	k := NewKernel()
+	req, err := NewMessage("I will say hello", "sha256", nil, "")
+	Tassert(t, err == nil, "Failed to create message: %v", err)
+	req.Envelope, err = NewEnvelope(time.Minute)
+	Tassert(t, err == nil, "Failed to create envelope: %v", err)
+	reply, err := NewReply(req, []byte("world"), time.Minute)
+	Tassert(t, err == nil, "Failed to create reply: %v", err)
+
+	// without a reply port, the reply goes back the way it came
+	routed, err := k.Reply(req, reply)
+	Tassert(t, err == nil && !routed, "Expected no routing but got %v %v", routed, err)
+
+	req.Envelope.ReplyTo = "inbox"
+	_, err = k.Reply(req, reply)
+	Tassert(t, errors.Is(err, ErrNoReplyPort), "Expected ErrNoReplyPort but got %v", err)
+	replies, closePort, err := k.OpenReplyPort("inbox")
+	Tassert(t, err == nil, "Failed to open reply port: %v", err)
+	_, _, err = k.OpenReplyPort("inbox")
+	Tassert(t, errors.Is(err, ErrReplyPortInUse), "Expected ErrReplyPortInUse but got %v", err)
+	routed, err = k.Reply(req, reply)
+	Tassert(t, err == nil && routed, "Expected the reply routed but got %v %v", routed, err)
+	Tassert(t, <-replies == reply, "Expected the reply message")
+
+	for i := 0; i < replyPortQueue; i++ {
+		_, err = k.Reply(req, reply)
+		Tassert(t, err == nil, "Failed to reply: %v", err)
+	}
+	_, err = k.Reply(req, reply)
+	Tassert(t, errors.Is(err, ErrReplyPortFull), "Expected ErrReplyPortFull but got %v", err)
+
+	closePort()
+	closePort()
+	_, err = k.Reply(req, reply)
+	Tassert(t, errors.Is(err, ErrNoReplyPort), "Expected ErrNoReplyPort but got %v", err)
+	n := 0
+	for range replies {
+		n++
+	}
+	Tassert(t, n == replyPortQueue, "Expected %d queued replies but got %d", replyPortQueue, n)
+}
@@ -7,8 +7,11 @@ require (
 	github.com/gorilla/websocket v1.5.3
 	github.com/multiformats/go-multibase v0.2.0
 	github.com/multiformats/go-multihash v0.2.3
+	github.com/multiformats/go-varint v0.0.6
 	github.com/spf13/afero v1.11.0
 	github.com/stevegt/goadapt v0.7.0
+	golang.org/x/crypto v0.16.0
+	lukechampine.com/blake3 v1.1.6
 )
 
 require (
@@ -17,10 +20,7 @@ require (
 	github.com/mr-tron/base58 v1.2.0 // indirect
 	github.com/multiformats/go-base32 v0.0.3 // indirect
 	github.com/multiformats/go-base36 v0.1.0 // indirect
-	github.com/multiformats/go-varint v0.0.6 // indirect
 	github.com/spaolacci/murmur3 v1.1.0 // indirect
-	golang.org/x/crypto v0.16.0 // indirect
 	golang.org/x/sys v0.15.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
-	lukechampine.com/blake3 v1.1.6 // indirect
 )
@@ -0,0 +1,203 @@
+package grid_cli
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+	"sync"
+
+	"github.com/multiformats/go-multihash"
+	. "github.com/stevegt/goadapt"
+	"golang.org/x/crypto/sha3"
+	"lukechampine.com/blake3"
+)
+
+// HashFunc returns the digest of data.
+type HashFunc func(data []byte) []byte
+
+// hashAlgo is an entry in the hash registry.
+type hashAlgo struct {
+	name string
+	fn   HashFunc
+	// newHash is nil if the function has no streaming form
+	newHash func() hash.Hash
+}
+
+// The hash registry maps multihash codes to hash functions.  It is
+// the one place that decides what a multihash code means, so that a
+// multihash is never labeled with one algorithm while its digest was
+// computed with another.
+var hashRegistry = struct {
+	sync.RWMutex
+	byCode map[uint64]hashAlgo
+	byName map[string]uint64
+}{
+	byCode: make(map[uint64]hashAlgo),
+	byName: make(map[string]uint64),
+}
+
+// ErrHashMismatch is returned when content does not hash to the
+// multihash it is supposed to match.
+var ErrHashMismatch = errors.New("content does not match multihash")
+
+func init() {
+	RegisterHash(multihash.IDENTITY, "identity", func(data []byte) []byte {
+		return append([]byte{}, data...)
+	})
+	RegisterHasher(multihash.SHA2_256, "sha2-256", sha256.New, "sha256")
+	RegisterHasher(multihash.SHA2_512, "sha2-512", sha512.New, "sha512")
+	RegisterHasher(multihash.SHA3_256, "sha3-256", sha3.New256)
+	RegisterHasher(multihash.SHA3_512, "sha3-512", sha3.New512)
+	RegisterHasher(multihash.BLAKE3, "blake3", func() hash.Hash {
+		return blake3.New(32, nil)
+	})
+}
+
+// RegisterHash adds a hash function to the registry under the given
+// multihash code, canonical name, and optional aliases.  Registering
+// an existing code replaces it.
+func RegisterHash(code uint64, name string, fn HashFunc, aliases ...string) {
+	hashRegistry.Lock()
+	defer hashRegistry.Unlock()
+	register(code, name, hashAlgo{name: name, fn: fn}, aliases)
+}
+
+// RegisterHasher is RegisterHash for a hash function with a
+// streaming form, so that NewHash can hash content as it is read.
+func RegisterHasher(code uint64, name string, newHash func() hash.Hash, aliases ...string) {
+	hashRegistry.Lock()
+	defer hashRegistry.Unlock()
+	fn := func(data []byte) []byte {
+		h := newHash()
+		h.Write(data)
+		return h.Sum(nil)
+	}
+	register(code, name, hashAlgo{name: name, fn: fn, newHash: newHash}, aliases)
+}
+
+// register adds algo to the registry.  The caller holds
+// hashRegistry.
+func register(code uint64, name string, algo hashAlgo, aliases []string) {
+	hashRegistry.byCode[code] = algo
+	hashRegistry.byName[name] = code
+	for _, alias := range aliases {
+		hashRegistry.byName[alias] = code
+	}
+}
+
+// NewHash returns a hash.Hash for the function registered under
+// code.  A function registered without a streaming form buffers what
+// is written until Sum.
+func NewHash(code uint64) (h hash.Hash, err error) {
+	algo, err := lookupHash(code)
+	if err != nil {
+		return nil, err
+	}
+	if algo.newHash != nil {
+		return algo.newHash(), nil
+	}
+	return &bufferedHash{fn: algo.fn}, nil
+}
+
+// bufferedHash is a hash.Hash for a HashFunc.
+type bufferedHash struct {
+	fn  HashFunc
+	buf bytes.Buffer
+}
+
+func (h *bufferedHash) Write(p []byte) (int, error) { return h.buf.Write(p) }
+func (h *bufferedHash) Sum(b []byte) []byte         { return append(b, h.fn(h.buf.Bytes())...) }
+func (h *bufferedHash) Reset()                      { h.buf.Reset() }
+func (h *bufferedHash) Size() int                   { return len(h.fn(nil)) }
+func (h *bufferedHash) BlockSize() int              { return 1 }
+
+// HashCode returns the multihash code registered under name.
+func HashCode(name string) (code uint64, err error) {
+	hashRegistry.RLock()
+	defer hashRegistry.RUnlock()
+	code, ok := hashRegistry.byName[name]
+	if !ok {
+		return 0, fmt.Errorf("unsupported hash algorithm: %s", name)
+	}
+	return code, nil
+}
+
+// HashName returns the canonical name of the hash function
+// registered under code.
+func HashName(code uint64) (name string, err error) {
+	algo, err := lookupHash(code)
+	if err != nil {
+		return "", err
+	}
+	return algo.name, nil
+}
+
+func lookupHash(code uint64) (algo hashAlgo, err error) {
+	hashRegistry.RLock()
+	defer hashRegistry.RUnlock()
+	algo, ok := hashRegistry.byCode[code]
+	if !ok {
+		return algo, fmt.Errorf("unsupported multihash code: %#x", code)
+	}
+	return algo, nil
+}
+
+// Sum hashes data with the function registered under code and
+// returns the result as a multihash.
+func Sum(code uint64, data []byte) (mh multihash.Multihash, err error) {
+	defer Return(&err)
+	algo, err := lookupHash(code)
+	Ck(err)
+	mh, err = multihash.Encode(algo.fn(data), code)
+	Ck(err)
+	return mh, nil
+}
+
+// HashVerifier hashes what is written to it with the function a
+// multihash declares, so content can be checked against the
+// multihash as it streams by, without holding it all.
+type HashVerifier struct {
+	hash.Hash
+	name   string
+	digest []byte
+}
+
+// NewHashVerifier returns a HashVerifier for mh.
+func NewHashVerifier(mh []byte) (v *HashVerifier, err error) {
+	defer Return(&err)
+	decoded, err := multihash.Decode(mh)
+	Ck(err)
+	algo, err := lookupHash(decoded.Code)
+	Ck(err)
+	h, err := NewHash(decoded.Code)
+	Ck(err)
+	return &HashVerifier{Hash: h, name: algo.name, digest: decoded.Digest}, nil
+}
+
+// Verify checks what was written against the multihash, as
+// VerifyHash does.
+func (v *HashVerifier) Verify() error {
+	if !bytes.Equal(v.Sum(nil), v.digest) {
+		return fmt.Errorf("%w: %s", ErrHashMismatch, v.name)
+	}
+	return nil
+}
+
+// VerifyHash checks that data hashes to mh using whatever algorithm
+// mh declares.  It returns an error wrapping ErrHashMismatch if it
+// doesn't.
+func VerifyHash(mh []byte, data []byte) (err error) {
+	defer Return(&err)
+	decoded, err := multihash.Decode(mh)
+	Ck(err)
+	algo, err := lookupHash(decoded.Code)
+	Ck(err)
+	digest := algo.fn(data)
+	if string(digest) != string(decoded.Digest) {
+		return fmt.Errorf("%w: %s", ErrHashMismatch, algo.name)
+	}
+	return nil
+}
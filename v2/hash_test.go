@@ -0,0 +1,57 @@
+package grid_cli
+
+import (
+	"crypto/sha512"
+	"errors"
+	"testing"
+
+	"github.com/multiformats/go-multihash"
+	. "github.com/stevegt/goadapt"
+)
+
+// TestSum tests that each registered algorithm labels its own digest
+func TestSum(t *testing.T) {
+	data := []byte("hello world")
+	for _, name := range []string{"identity", "sha2-256", "sha2-512", "sha3-256", "sha3-512", "blake3"} {
+		code, err := HashCode(name)
+		Tassert(t, err == nil, "Failed to look up %s: %v", name, err)
+		mh, err := Sum(code, data)
+		Tassert(t, err == nil, "Failed to hash with %s: %v", name, err)
+		decoded, err := multihash.Decode(mh)
+		Tassert(t, err == nil, "Failed to decode %s multihash: %v", name, err)
+		Tassert(t, decoded.Code == code, "Expected code %#x but got %#x", code, decoded.Code)
+		err = VerifyHash(mh, data)
+		Tassert(t, err == nil, "Failed to verify %s: %v", name, err)
+		err = VerifyHash(mh, []byte("hello world!"))
+		Tassert(t, errors.Is(err, ErrHashMismatch), "Expected %s mismatch but got %v", name, err)
+
+		// the streaming form agrees, a piece at a time
+		v, err := NewHashVerifier(mh)
+		Tassert(t, err == nil, "Failed to make %s verifier: %v", name, err)
+		v.Write(data[:5])
+		v.Write(data[5:])
+		err = v.Verify()
+		Tassert(t, err == nil, "Failed to verify %s stream: %v", name, err)
+		v.Write([]byte("!"))
+		err = v.Verify()
+		Tassert(t, errors.Is(err, ErrHashMismatch), "Expected %s stream mismatch but got %v", name, err)
+	}
+
+	// sha2-512 must not be a relabeled sha2-256
+	mh, err := Sum(multihash.SHA2_512, data)
+	Tassert(t, err == nil, "Failed to hash: %v", err)
+	want := sha512.Sum512(data)
+	decoded, err := multihash.Decode(mh)
+	Tassert(t, err == nil, "Failed to decode multihash: %v", err)
+	Tassert(t, string(decoded.Digest) == string(want[:]), "sha2-512 digest mismatch")
+
+	_, err = Sum(0x9999, data)
+	Tassert(t, err != nil, "Expected error for unregistered code")
+}
+
+// mustSum returns the sha2-256 multihash of s.
+func mustSum(t *testing.T, s string) multihash.Multihash {
+	mh, err := Sum(multihash.SHA2_256, []byte(s))
+	Tassert(t, err == nil, "Failed to hash: %v", err)
+	return mh
+}
@@ -0,0 +1,250 @@
+package grid_cli
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/multiformats/go-multihash"
+	"github.com/spf13/afero"
+	. "github.com/stevegt/goadapt"
+)
+
+// The cache index maps cache keys to the completions cached for
+// them, as described in doc/000-TODO.md: a key is a byte sequence,
+// and a lookup completes it.  A key is the promise multihash, then
+// the module multihash, then each argument, so every completion of
+// a promise shares a prefix, and every completion by one module of
+// that promise shares a longer one.  The index holds only a
+// reference for each key, such as the hash of the blob holding the
+// completion, and is saved on its own, so it doesn't care how or
+// where the blobs are stored.
+
+// indexMagic starts a saved cache index, and gives its version.
+const indexMagic = "grid cache index 1\n"
+
+// CacheKey returns the byte sequence for a promise, a module and the
+// module's arguments.  Each argument is encoded as its encodeKeyArg
+// segment, prefixed by its length, so the key is
+// unambiguous and the keys for a call's arguments are prefixes of
+// the keys for longer calls.
+func CacheKey(promise, module multihash.Multihash, args ...interface{}) (key []byte, err error) {
+	var b bytes.Buffer
+	b.Write(promise)
+	b.Write(module)
+	for i, arg := range args {
+		seg, err := encodeKeyArg(arg)
+		if err != nil {
+			return nil, fmt.Errorf("cache key argument %d: %w", i, err)
+		}
+		writeBytes(&b, []byte(seg))
+	}
+	return b.Bytes(), nil
+}
+
+// IndexEntry is a key in a CacheIndex and its reference.
+type IndexEntry struct {
+	Key []byte
+	Ref []byte
+}
+
+// CacheIndex is a byte trie from cache keys to references.  It is
+// safe for concurrent use.
+type CacheIndex struct {
+	mu   sync.RWMutex
+	root *indexNode
+	n    int
+}
+
+// indexNode is a node of the trie; ref is set if a key ends here.
+type indexNode struct {
+	children map[byte]*indexNode
+	ref      []byte
+	has      bool
+}
+
+// NewCacheIndex returns an empty index.
+func NewCacheIndex() *CacheIndex {
+	return &CacheIndex{root: &indexNode{}}
+}
+
+// Len returns the number of keys in the index.
+func (x *CacheIndex) Len() int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.n
+}
+
+// Put sets the reference for key.
+func (x *CacheIndex) Put(key, ref []byte) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	node := x.root
+	for _, c := range key {
+		child, ok := node.children[c]
+		if !ok {
+			if node.children == nil {
+				node.children = make(map[byte]*indexNode)
+			}
+			child = &indexNode{}
+			node.children[c] = child
+		}
+		node = child
+	}
+	if !node.has {
+		x.n++
+	}
+	node.ref = append([]byte{}, ref...)
+	node.has = true
+}
+
+// Get returns the reference for key.
+func (x *CacheIndex) Get(key []byte) (ref []byte, ok bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	node := x.find(key)
+	if node == nil || !node.has {
+		return nil, false
+	}
+	return node.ref, true
+}
+
+// find returns the node for key, or nil.  The caller holds x.mu.
+func (x *CacheIndex) find(key []byte) *indexNode {
+	node := x.root
+	for _, c := range key {
+		node = node.children[c]
+		if node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+// LongestPrefix returns the longest key in the index that is a
+// prefix of key, and its reference.
+func (x *CacheIndex) LongestPrefix(key []byte) (prefix, ref []byte, ok bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	node := x.root
+	end := -1
+	for i := 0; ; i++ {
+		if node.has {
+			end, ref = i, node.ref
+		}
+		if i == len(key) {
+			break
+		}
+		node = node.children[key[i]]
+		if node == nil {
+			break
+		}
+	}
+	if end < 0 {
+		return nil, nil, false
+	}
+	return key[:end], ref, true
+}
+
+// Completions returns the keys that start with prefix, including
+// prefix itself, in byte order.
+func (x *CacheIndex) Completions(prefix []byte) (entries []IndexEntry) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	node := x.find(prefix)
+	if node == nil {
+		return nil
+	}
+	var visit func(node *indexNode, key []byte)
+	visit = func(node *indexNode, key []byte) {
+		if node.has {
+			entries = append(entries, IndexEntry{Key: append([]byte{}, key...), Ref: node.ref})
+		}
+		cs := make([]int, 0, len(node.children))
+		for c := range node.children {
+			cs = append(cs, int(c))
+		}
+		sort.Ints(cs)
+		for _, c := range cs {
+			visit(node.children[byte(c)], append(key, byte(c)))
+		}
+	}
+	visit(node, append([]byte{}, prefix...))
+	return entries
+}
+
+// Delete removes key from the index, and reports whether it was
+// there.
+func (x *CacheIndex) Delete(key []byte) (found bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	path := []*indexNode{x.root}
+	for _, c := range key {
+		child := path[len(path)-1].children[c]
+		if child == nil {
+			return false
+		}
+		path = append(path, child)
+	}
+	node := path[len(path)-1]
+	if !node.has {
+		return false
+	}
+	node.has, node.ref = false, nil
+	x.n--
+	// prune the nodes left with nothing under them
+	for i := len(path) - 1; i > 0; i-- {
+		if path[i].has || len(path[i].children) > 0 {
+			break
+		}
+		delete(path[i-1].children, key[i-1])
+	}
+	return true
+}
+
+// Save writes the index to fn on fs, replacing it atomically.  The
+// file is indexMagic followed by each key and its reference, in key
+// order, as length-prefixed byte strings.
+func (x *CacheIndex) Save(fs afero.Fs, fn string) (err error) {
+	var b bytes.Buffer
+	b.WriteString(indexMagic)
+	for _, e := range x.Completions(nil) {
+		writeBytes(&b, e.Key)
+		writeBytes(&b, e.Ref)
+	}
+	return writeFileAtomic(fs, fn, b.Bytes(), 0644)
+}
+
+// LoadCacheIndex reads an index saved by Save.  A missing file loads
+// an empty index.
+func LoadCacheIndex(fs afero.Fs, fn string) (x *CacheIndex, err error) {
+	defer Return(&err)
+	x = NewCacheIndex()
+	f, err := fs.Open(fn)
+	if os.IsNotExist(err) {
+		return x, nil
+	}
+	Ck(err)
+	defer f.Close()
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(indexMagic))
+	_, err = io.ReadFull(r, magic)
+	Ck(err, "%s", fn)
+	Assert(string(magic) == indexMagic, "%s: not a cache index", fn)
+	for {
+		_, err := r.Peek(1)
+		if err == io.EOF {
+			break
+		}
+		key, err := readBytes(r, maxFieldSize)
+		Ck(err, "%s", fn)
+		ref, err := readBytes(r, maxFieldSize)
+		Ck(err, "%s", fn)
+		x.Put(key, ref)
+	}
+	return x, nil
+}
@@ -0,0 +1,100 @@
+package grid_cli
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/multiformats/go-multihash"
+	"github.com/spf13/afero"
+	. "github.com/stevegt/goadapt"
+)
+
+// TestCacheIndex tests exact, longest-prefix and completion lookups,
+// and saving and loading the index.
+func TestCacheIndex(t *testing.T) {
+	x := NewCacheIndex()
+	for _, k := range []string{"ab", "abc", "abd", "b", "", "abcd"} {
+		x.Put([]byte(k), []byte("ref "+k))
+	}
+	x.Put([]byte("ab"), []byte("new ab"))
+	Tassert(t, x.Len() == 6, "Expected 6 keys but got %d", x.Len())
+
+	ref, ok := x.Get([]byte("ab"))
+	Tassert(t, ok && string(ref) == "new ab", "Unexpected ref %q", ref)
+	_, ok = x.Get([]byte("a"))
+	Tassert(t, !ok, "Expected no key a")
+
+	for _, c := range []struct{ key, prefix string }{
+		{"abce", "abc"}, {"abcd", "abcd"}, {"a", ""}, {"bz", "b"}, {"ac", ""},
+	} {
+		prefix, ref, ok := x.LongestPrefix([]byte(c.key))
+		Tassert(t, ok && string(prefix) == c.prefix, "Expected prefix %q of %q but got %q", c.prefix, c.key, prefix)
+		Tassert(t, bytes.Equal(ref, x.mustGet(t, prefix)), "Unexpected ref %q for %q", ref, c.key)
+	}
+
+	keys := func(entries []IndexEntry) (ks []string) {
+		for _, e := range entries {
+			ks = append(ks, string(e.Key))
+		}
+		return ks
+	}
+	got := keys(x.Completions([]byte("ab")))
+	Tassert(t, Spf("%q", got) == `["ab" "abc" "abcd" "abd"]`, "Unexpected completions %q", got)
+	got = keys(x.Completions([]byte("x")))
+	Tassert(t, got == nil, "Unexpected completions %q", got)
+
+	Tassert(t, x.Delete([]byte("abc")), "Expected to delete abc")
+	Tassert(t, !x.Delete([]byte("abc")), "Expected abc to be gone")
+	Tassert(t, !x.Delete([]byte("a")), "Expected no key a")
+	Tassert(t, x.Delete([]byte("abcd")), "Expected to delete abcd")
+	Tassert(t, x.find([]byte("abc")) == nil, "Expected the abc branch to be pruned")
+	Tassert(t, x.Len() == 4, "Expected 4 keys but got %d", x.Len())
+
+	fs := afero.NewMemMapFs()
+	empty, err := LoadCacheIndex(fs, "/index")
+	Tassert(t, err == nil && empty.Len() == 0, "Expected an empty index: %v", err)
+	err = x.Save(fs, "/index")
+	Tassert(t, err == nil, "Failed to save: %v", err)
+	y, err := LoadCacheIndex(fs, "/index")
+	Tassert(t, err == nil, "Failed to load: %v", err)
+	Tassert(t, Spf("%q", y.Completions(nil)) == Spf("%q", x.Completions(nil)),
+		"Expected %q but loaded %q", x.Completions(nil), y.Completions(nil))
+
+	err = afero.WriteFile(fs, "/bad", []byte("not an index"), 0644)
+	Tassert(t, err == nil, "Failed to write: %v", err)
+	_, err = LoadCacheIndex(fs, "/bad")
+	Tassert(t, err != nil, "Expected an error loading a bad index")
+	data, err := afero.ReadFile(fs, "/index")
+	Tassert(t, err == nil, "Failed to read: %v", err)
+	err = afero.WriteFile(fs, "/bad", data[:len(data)-1], 0644)
+	Tassert(t, err == nil, "Failed to write: %v", err)
+	_, err = LoadCacheIndex(fs, "/bad")
+	Tassert(t, err != nil, "Expected an error loading a truncated index")
+}
+
+// mustGet returns the ref for key.
+func (x *CacheIndex) mustGet(t *testing.T, key []byte) []byte {
+	ref, ok := x.Get(key)
+	Tassert(t, ok, "Expected key %q", key)
+	return ref
+}
+
+// TestCacheKeyPrefixes tests that the keys for a promise, a module
+// and a call's arguments are prefixes of the keys for longer calls.
+func TestCacheKeyPrefixes(t *testing.T) {
+	promise, err := Sum(multihash.SHA2_256, []byte("I will say hello"))
+	Tassert(t, err == nil, "Failed to hash: %v", err)
+	module, err := Sum(multihash.SHA2_256, []byte("hello module"))
+	Tassert(t, err == nil, "Failed to hash: %v", err)
+	short, err := CacheKey(promise, module, "a")
+	Tassert(t, err == nil, "Failed to make key: %v", err)
+	long, err := CacheKey(promise, module, "a", 1)
+	Tassert(t, err == nil, "Failed to make key: %v", err)
+	other, err := CacheKey(promise, module, "ab")
+	Tassert(t, err == nil, "Failed to make key: %v", err)
+	Tassert(t, bytes.HasPrefix(short, append(append([]byte{}, promise...), module...)), "Expected the hashes first")
+	Tassert(t, bytes.HasPrefix(long, short), "Expected %x to start with %x", long, short)
+	Tassert(t, !bytes.HasPrefix(other, short), "Expected %x not to start with %x", other, short)
+	_, err = CacheKey(promise, module, nil)
+	Tassert(t, err != nil, "Expected an error for a nil argument")
+}
@@ -0,0 +1,250 @@
+package grid_cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/multiformats/go-multihash"
+	. "github.com/stevegt/goadapt"
+)
+
+// TreeNode is a node of the syscall tree as exported by Tree, for
+// people and tools to read.  It marshals to JSON as is; WriteDOT
+// renders it for Graphviz.
+type TreeNode struct {
+	// Key is the parameter token or segment key of the node; it is
+	// empty for the root.
+	Key string `json:"key,omitempty"`
+	// Promise is the text of the promise whose hash is Key, for the
+	// children of the root that the promise catalog knows.
+	Promise string       `json:"promise,omitempty"`
+	Modules []TreeModule `json:"modules,omitempty"`
+	Policy  string       `json:"policy,omitempty"`
+	Quorum  int          `json:"quorum,omitempty"`
+	// Mount is the Go type of the tree mounted at the node, if any.
+	Mount    string      `json:"mount,omitempty"`
+	Children []*TreeNode `json:"children,omitempty"`
+}
+
+// TreeModule is a module bound to a node.
+type TreeModule struct {
+	// Hash is the token for the module's hash, or empty if it isn't
+	// registered.
+	Hash string `json:"hash,omitempty"`
+	// Type is the Go type of a module without a hash.
+	Type string `json:"type,omitempty"`
+	// Loaded is false for a saved binding whose module hasn't been
+	// registered yet.
+	Loaded bool `json:"loaded"`
+}
+
+// Tree exports the syscall tree, with children sorted by key.  If
+// catalog is not nil, it is used to fill in the text of the promises
+// at the top of the tree.
+func (k *Kernel) Tree(catalog *PromiseCatalog) *TreeNode {
+	var export func(node *SyscallNode, key string, depth int) *TreeNode
+	export = func(node *SyscallNode, key string, depth int) *TreeNode {
+		tn := &TreeNode{Key: key, Modules: k.treeModules(node.Modules)}
+		if depth == 1 && catalog != nil {
+			p, err := DecodeParm(key)
+			if mh, ok := p.(multihash.Multihash); err == nil && ok {
+				txt, err := catalog.Show(mh)
+				if err == nil {
+					tn.Promise = txt
+				}
+			}
+		}
+		if node.Policy != nil {
+			tn.Policy = node.Policy.Mode.String()
+			tn.Quorum = node.Policy.Quorum
+		}
+		if node.Mount != nil {
+			tn.Mount = fmt.Sprintf("%T", node.Mount)
+		}
+		keys := make([]string, 0, len(node.Children))
+		for key := range node.Children {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			tn.Children = append(tn.Children, export(node.Children[key], key, depth+1))
+		}
+		return tn
+	}
+	return export(k.root.Load(), "", 0)
+}
+
+// treeModules describes modules for Tree and Explain.
+func (k *Kernel) treeModules(modules []Module) (tms []TreeModule) {
+	for _, m := range modules {
+		tm := TreeModule{Loaded: true}
+		key, ok := k.moduleKey(m)
+		if ok {
+			tm.Hash = key
+		} else {
+			tm.Type = fmt.Sprintf("%T", m)
+		}
+		if _, unloaded := m.(unloadedModule); unloaded {
+			tm.Loaded = false
+		}
+		tms = append(tms, tm)
+	}
+	return tms
+}
+
+// WriteDOT writes the tree as a Graphviz digraph, one box per node,
+// labelled with its key, promise, policy, mount and modules.
+func (tn *TreeNode) WriteDOT(w io.Writer) (err error) {
+	defer Return(&err)
+	lines := []string{"digraph syscalls {", "\tnode [shape=box];"}
+	n := 0
+	var visit func(node *TreeNode) string
+	visit = func(node *TreeNode) string {
+		id := Spf("n%d", n)
+		n++
+		label := []string{node.Key}
+		if node.Key == "" {
+			label[0] = "(root)"
+		}
+		if node.Promise != "" {
+			label = append(label, Spf("%q", node.Promise))
+		}
+		if node.Policy != "" {
+			policy := "policy " + node.Policy
+			if node.Quorum > 0 {
+				policy += Spf(" %d", node.Quorum)
+			}
+			label = append(label, policy)
+		}
+		if node.Mount != "" {
+			label = append(label, "mount "+node.Mount)
+		}
+		for _, m := range node.Modules {
+			label = append(label, m.String())
+		}
+		for i := range label {
+			label[i] = dotEscape(label[i])
+		}
+		lines = append(lines, Spf("\t%s [label=\"%s\"];", id, strings.Join(label, `\n`)))
+		for _, child := range node.Children {
+			lines = append(lines, Spf("\t%s -> %s;", id, visit(child)))
+		}
+		return id
+	}
+	visit(tn)
+	lines = append(lines, "}")
+	_, err = io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	Ck(err)
+	return nil
+}
+
+// String returns the module's hash, or its type if it has none,
+// marked if the module isn't loaded.
+func (tm TreeModule) String() string {
+	s := tm.Hash
+	if s == "" {
+		s = tm.Type
+	}
+	if !tm.Loaded {
+		s += " (not loaded)"
+	}
+	return s
+}
+
+// dotEscape escapes s for a quoted DOT string.
+func dotEscape(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return strings.ReplaceAll(s, "\n", `\n`)
+}
+
+// Explanation is what Dispatch would do with a message, as worked
+// out by Explain.
+type Explanation struct {
+	// Path is the message's path as tokens, promise first.
+	Path []string `json:"path"`
+	// Literal is how many path elements findBestMatch follows down
+	// the tree without segments or mounts.
+	Literal int `json:"literal"`
+	// Candidates are the nodes with modules that match the path, in
+	// the order Dispatch offers them the message.
+	Candidates []ExplainedCandidate `json:"candidates"`
+	// Errors are from mounts whose lookups failed.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// ExplainedCandidate is a node whose modules would be offered a
+// message.
+type ExplainedCandidate struct {
+	// Route is the tree keys leading to the node, or to the mount
+	// point if Mounted is set.
+	Route   []string `json:"route"`
+	Mounted bool     `json:"mounted,omitempty"`
+	// Depth is how many path elements the match covers.
+	Depth int `json:"depth"`
+	// Captures are the tokens of what the segments captured; a rest
+	// segment's capture is shown as a bracketed list.
+	Captures []string     `json:"captures,omitempty"`
+	Policy   string       `json:"policy"`
+	Modules  []TreeModule `json:"modules"`
+}
+
+// Explain works out how Dispatch would route msg, without offering
+// it to any module.  Mounts are looked up as usual.  Which module
+// actually handles the message depends on the modules' Accept
+// methods and on the policies, so Explain lists every module that
+// could be offered it.
+func (k *Kernel) Explain(ctx context.Context, msg *Message) (ex *Explanation, err error) {
+	defer Return(&err)
+	path, err := messagePath(msg)
+	Ck(err)
+	ex = &Explanation{Candidates: []ExplainedCandidate{}}
+	for _, p := range path {
+		ex.Path = append(ex.Path, parmKey(p))
+	}
+	ex.Literal = len(walk(k.root.Load(), path...)) - 1
+
+	ctx = context.WithValue(ctx, msgKey{}, msg)
+	m := &matcher{ctx: ctx}
+	k.matchPath(m, path)
+	for _, err := range m.errs {
+		ex.Errors = append(ex.Errors, err.Error())
+	}
+	for _, cand := range m.cands {
+		if len(cand.modules) == 0 {
+			continue
+		}
+		policy := PolicyFirst
+		if cand.policy != nil {
+			policy = cand.policy.Mode
+		}
+		ec := ExplainedCandidate{
+			Route:   append([]string{}, cand.route...),
+			Mounted: cand.mounted,
+			Depth:   cand.depth,
+			Policy:  policy.String(),
+			Modules: k.treeModules(cand.modules),
+		}
+		for _, c := range cand.captures {
+			ec.Captures = append(ec.Captures, captureToken(c))
+		}
+		ex.Candidates = append(ex.Candidates, ec)
+	}
+	return ex, nil
+}
+
+// captureToken returns the token for a captured value.
+func captureToken(c interface{}) string {
+	rest, ok := c.([]interface{})
+	if !ok {
+		return parmKey(c)
+	}
+	tokens := make([]string, len(rest))
+	for i, p := range rest {
+		tokens[i] = parmKey(p)
+	}
+	return "[" + strings.Join(tokens, " ") + "]"
+}
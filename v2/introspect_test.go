@@ -0,0 +1,157 @@
+package grid_cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	. "github.com/stevegt/goadapt"
+)
+
+// TestIntrospect tests exporting the tree and explaining a dispatch.
+func TestIntrospect(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	catalog := NewPromiseCatalog(fs, "/grid/promises")
+	_, err := catalog.Add("I will say hello", "sha256")
+	Tassert(t, err == nil, "Failed to add promise: %v", err)
+	k, err := NewKernelFs(fs, "/grid")
+	Tassert(t, err == nil, "Failed to create kernel: %v", err)
+	msg, err := NewMessage("I will say hello", "sha256", []interface{}{"hello", "world"}, "")
+	Tassert(t, err == nil, "Failed to create message: %v", err)
+	path, err := messagePath(msg)
+	Tassert(t, err == nil, "Failed to get path: %v", err)
+	promise := parmKey(path[0])
+
+	a, err := k.RegisterModule(fakeModule{name: "a"})
+	Tassert(t, err == nil, "Failed to register module: %v", err)
+	b, err := k.RegisterModule(fakeModule{name: "b"})
+	Tassert(t, err == nil, "Failed to register module: %v", err)
+	err = k.Bind(path[:2], a)
+	Tassert(t, err == nil, "Failed to bind: %v", err)
+	err = k.Bind([]interface{}{path[0], Wildcard(), Rest()}, b)
+	Tassert(t, err == nil, "Failed to bind: %v", err)
+	err = k.SetPolicy(path[:1], &Policy{Mode: PolicyQuorum, Quorum: 2})
+	Tassert(t, err == nil, "Failed to set policy: %v", err)
+	err = k.bindSyscall(fakeModule{name: "unregistered"}, path[:1]...)
+	Tassert(t, err == nil, "Failed to bind: %v", err)
+
+	tree := k.Tree(catalog)
+	Tassert(t, tree.Key == "" && len(tree.Children) == 1, "Unexpected root %#v", tree)
+	top := tree.Children[0]
+	Tassert(t, top.Key == promise, "Expected key %s but got %s", promise, top.Key)
+	Tassert(t, top.Promise == "I will say hello", "Expected the promise text but got %q", top.Promise)
+	Tassert(t, top.Policy == "quorum" && top.Quorum == 2, "Unexpected policy %q %d", top.Policy, top.Quorum)
+	Tassert(t, reflect.DeepEqual(top.Modules, []TreeModule{{Type: "grid_cli.fakeModule", Loaded: true}}),
+		"Unexpected modules %#v", top.Modules)
+	// children are sorted by key
+	Tassert(t, len(top.Children) == 2 && top.Children[0].Key == "!*" && top.Children[1].Key == "hello",
+		"Unexpected children %#v", top.Children)
+	Tassert(t, top.Children[1].Modules[0].Hash == parmKey(a), "Expected module a")
+	rest := top.Children[0].Children[0]
+	Tassert(t, rest.Key == "!**" && rest.Modules[0].Hash == parmKey(b), "Unexpected rest node %#v", rest)
+
+	buf, err := json.Marshal(tree)
+	Tassert(t, err == nil, "Failed to marshal tree: %v", err)
+	var back TreeNode
+	err = json.Unmarshal(buf, &back)
+	Tassert(t, err == nil, "Failed to unmarshal tree: %v", err)
+	Tassert(t, reflect.DeepEqual(&back, tree), "Tree changed in JSON round trip")
+
+	var dot bytes.Buffer
+	err = tree.WriteDOT(&dot)
+	Tassert(t, err == nil, "Failed to write DOT: %v", err)
+	for _, want := range []string{
+		"digraph syscalls {",
+		`n0 [label="(root)"];`,
+		`n1 [label="` + promise + `\n\"I will say hello\"\npolicy quorum 2\ngrid_cli.fakeModule"];`,
+		`n2 [label="!*"];`,
+		`n4 [label="hello\n` + parmKey(a) + `"];`,
+		"n0 -> n1;",
+		"n1 -> n4;",
+	} {
+		Tassert(t, strings.Contains(dot.String(), want), "Expected %q in DOT:\n%s", want, dot.String())
+	}
+
+	ex, err := k.Explain(context.Background(), msg)
+	Tassert(t, err == nil, "Failed to explain: %v", err)
+	Tassert(t, reflect.DeepEqual(ex.Path, []string{promise, "hello", "world"}), "Unexpected path %v", ex.Path)
+	Tassert(t, ex.Literal == 2, "Expected 2 literal elements but got %d", ex.Literal)
+	want := []ExplainedCandidate{
+		{Route: []string{promise, "hello"}, Depth: 2, Policy: "first",
+			Modules: []TreeModule{{Hash: parmKey(a), Loaded: true}}},
+		{Route: []string{promise, "!*", "!**"}, Depth: 3, Policy: "first",
+			Captures: []string{"hello", "[world]"},
+			Modules:  []TreeModule{{Hash: parmKey(b), Loaded: true}}},
+		{Route: []string{promise}, Depth: 1, Policy: "quorum",
+			Modules: []TreeModule{{Type: "grid_cli.fakeModule", Loaded: true}}},
+	}
+	Tassert(t, reflect.DeepEqual(ex.Candidates, want), "Unexpected candidates %#v", ex.Candidates)
+
+	// mounted modules are marked, and routed at the mount point
+	other := NewKernel()
+	err = other.bindSyscall(fakeModule{name: "mounted"}, "world")
+	Tassert(t, err == nil, "Failed to bind: %v", err)
+	err = k.Mount(path[:2], other)
+	Tassert(t, err == nil, "Failed to mount: %v", err)
+	ex, err = k.Explain(context.Background(), msg)
+	Tassert(t, err == nil, "Failed to explain: %v", err)
+	Tassert(t, len(ex.Candidates) == 4, "Expected 4 candidates but got %d", len(ex.Candidates))
+	mounted := ex.Candidates[0]
+	Tassert(t, mounted.Mounted && mounted.Depth == 3 && reflect.DeepEqual(mounted.Route, []string{promise, "hello"}),
+		"Unexpected mounted candidate %#v", mounted)
+}
+
+// TestCliKernel tests the kernel subcommands against a saved tree.
+func TestCliKernel(t *testing.T) {
+	var out bytes.Buffer
+	fs := afero.NewMemMapFs()
+	c := &cli{fs: fs, dir: "/home/.grid", out: &out}
+
+	k, err := NewKernelFs(fs, c.dir)
+	Tassert(t, err == nil, "Failed to create kernel: %v", err)
+	msg, err := NewMessage("I will say hello", "sha256", []interface{}{"hello"}, "")
+	Tassert(t, err == nil, "Failed to create message: %v", err)
+	path, err := messagePath(msg)
+	Tassert(t, err == nil, "Failed to get path: %v", err)
+	a, err := k.RegisterModule(fakeModule{name: "a"})
+	Tassert(t, err == nil, "Failed to register module: %v", err)
+	err = k.Bind(path, a)
+	Tassert(t, err == nil, "Failed to bind: %v", err)
+	err = k.SaveTree()
+	Tassert(t, err == nil, "Failed to save tree: %v", err)
+	err = c.writeMessage("/hello.msg", msg)
+	Tassert(t, err == nil, "Failed to write message: %v", err)
+
+	// the command's kernel has no modules registered
+	err = c.run([]string{"kernel", "tree"})
+	Tassert(t, err == nil, "Failed to show tree: %v", err)
+	var tree TreeNode
+	err = json.Unmarshal(out.Bytes(), &tree)
+	Tassert(t, err == nil, "Failed to parse tree %q: %v", out.String(), err)
+	leaf := tree.Children[0].Children[0]
+	Tassert(t, reflect.DeepEqual(leaf.Modules, []TreeModule{{Hash: parmKey(a)}}), "Unexpected modules %#v", leaf.Modules)
+
+	out.Reset()
+	err = c.run([]string{"kernel", "tree", "-dot"})
+	Tassert(t, err == nil, "Failed to show tree: %v", err)
+	Tassert(t, strings.HasPrefix(out.String(), "digraph syscalls {"), "Expected DOT but got %q", out.String())
+
+	out.Reset()
+	err = c.run([]string{"kernel", "explain", "/hello.msg"})
+	Tassert(t, err == nil, "Failed to explain: %v", err)
+	for _, want := range []string{
+		"literal: 2 of 2 elements",
+		"1. " + parmKey(path[0]) + " hello",
+		"depth 2, policy first",
+		"module " + parmKey(a) + " (not loaded)",
+	} {
+		Tassert(t, strings.Contains(out.String(), want), "Expected %q in %q", want, out.String())
+	}
+
+	err = c.run([]string{"kernel", "tree", "-svg"})
+	Tassert(t, err != nil, "Expected a usage error")
+}
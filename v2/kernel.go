@@ -1,57 +1,286 @@
 package grid_cli
 
 import (
+	"encoding/hex"
 	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/spf13/afero"
 )
 
+// replayWindow is how long the kernel remembers message nonces.  A
+// message with a nonce that is older than this can't be checked for
+// replay, so it is rejected.
+const replayWindow = 10 * time.Minute
+
+// clockSkew is how far ahead of the kernel's clock a message's
+// timestamp may be, since the sender's clock may run fast.
+const clockSkew = time.Minute
+
 // Kernel struct with the syscall tree root and file system abstraction
 type Kernel struct {
-	root    *SyscallNode
+	// root is the current syscall tree.  A published tree is never
+	// modified; updates copy the nodes along the changed path and
+	// swap in a new root, so a lookup that loaded the old root sees
+	// a consistent tree however long it runs.
+	root atomic.Pointer[SyscallNode]
+	// cache is the first-level cache, if any; see MountCache
+	cache   atomic.Pointer[cacheMount]
+	treeMu  sync.Mutex // serializes tree updates; guards modules
 	fs      afero.Fs
-	modules map[string]Module // Known modules
+	dir     string            // grid directory
+	modules map[string]Module // registered modules by hash token
+	// space holds the kernel's rights, including its ends of the
+	// modules' standard ports
+	space *PortSpace
+	ports map[string]*stdPorts // standard ports by module hash token
+	// grants are the syscall prefixes granted, by module hash token
+	grants   map[string][][]string
+	services Services // what the core syscalls act on
+
+	mu        sync.Mutex
+	pending   map[string]chan *Message // outstanding requests by correlation ID
+	replyTo   map[string]chan *Message // open reply ports by name
+	seen      map[string]int64         // nonce to when it can be forgotten
+	lastPrune int64
 }
 
 // NewKernel initializes a new Kernel instance with embedded modules
 func NewKernel() *Kernel {
-	return &Kernel{
-		root: &SyscallNode{
-			Children: make(map[string]*SyscallNode),
-			Modules:  []Module{},
-		},
+	k := &Kernel{
 		fs:      afero.NewOsFs(),
+		dir:     filepath.Join(os.Getenv("HOME"), gridDir),
 		modules: make(map[string]Module),
+		space:   NewPortSpace(),
+		ports:   make(map[string]*stdPorts),
+		grants:  make(map[string][][]string),
+		pending: make(map[string]chan *Message),
+		replyTo: make(map[string]chan *Message),
+		seen:    make(map[string]int64),
 	}
+	k.root.Store(newSyscallNode())
+	return k
 }
 
-func (k *Kernel) addSyscall(parms ...interface{}) {
-	current := k.root
-	for _, parm := range parms {
-		key := fmt.Sprintf("%v", parm)
-		if _, exists := current.Children[key]; !exists {
-			current.Children[key] = &SyscallNode{
-				Children: make(map[string]*SyscallNode),
-				Modules:  []Module{},
-			}
+// updateTree applies fn to a private copy of the node at path,
+// creating any missing nodes, and then publishes the new tree.
+// Nodes that are left with no modules, mount, policy or children
+// are pruned.
+func (k *Kernel) updateTree(path []interface{}, fn func(node *SyscallNode)) (err error) {
+	for i, p := range path {
+		if seg, ok := p.(Segment); ok && seg.kind == segRest && i < len(path)-1 {
+			return fmt.Errorf("rest segment must end the path")
+		}
+	}
+	k.treeMu.Lock()
+	defer k.treeMu.Unlock()
+	root := k.root.Load().clone()
+	nodes := []*SyscallNode{root}
+	keys := make([]string, len(path))
+	for i, parm := range path {
+		keys[i] = pathKey(parm)
+		child, exists := nodes[i].Children[keys[i]]
+		if exists {
+			child = child.clone()
+		} else {
+			child = newSyscallNode()
 		}
-		current = current.Children[key]
+		nodes[i].setChild(keys[i], child)
+		nodes = append(nodes, child)
 	}
-	// Assuming module is pre-initialized and available in context
-	if module, exists := k.modules[fmt.Sprintf("%v", parms[len(parms)-1])]; exists {
-		current.Modules = append(current.Modules, module)
+	fn(nodes[len(path)])
+	for i := len(path); i > 0; i-- {
+		if len(nodes[i].Modules) > 0 || nodes[i].Mount != nil || nodes[i].Policy != nil || len(nodes[i].Children) > 0 {
+			break
+		}
+		nodes[i-1].deleteChild(keys[i-1])
 	}
+	k.root.Store(root)
+	return nil
 }
 
-func (k *Kernel) findBestMatch(parms ...interface{}) *SyscallNode {
-	current := k.root
-	for _, parm := range parms {
-		key := fmt.Sprintf("%v", parm)
-		if next, exists := current.Children[key]; exists {
-			current = next
-		} else {
+// bindSyscall adds module to the node at path.  The path may
+// contain Segments.
+func (k *Kernel) bindSyscall(module Module, path ...interface{}) error {
+	return k.updateTree(path, func(node *SyscallNode) {
+		node.Modules = append(node.Modules, module)
+	})
+}
+
+// unbindSyscall removes module from the node at path, and reports
+// whether it was there.
+func (k *Kernel) unbindSyscall(module Module, path ...interface{}) (found bool) {
+	_ = k.updateTree(path, func(node *SyscallNode) {
+		for i, m := range node.Modules {
+			if sameModule(m, module) {
+				node.Modules = append(node.Modules[:i:i], node.Modules[i+1:]...)
+				found = true
+				return
+			}
+		}
+	})
+	return found
+}
+
+// walk follows path down from root as far as it matches, and
+// returns the nodes it passes through, starting with root.
+func walk(root *SyscallNode, path ...interface{}) (nodes []*SyscallNode) {
+	nodes = []*SyscallNode{root}
+	current := root
+	for _, parm := range path {
+		next, exists := current.Children[pathKey(parm)]
+		if !exists {
 			break
 		}
+		nodes = append(nodes, next)
+		current = next
+	}
+	return nodes
+}
+
+func (k *Kernel) findBestMatch(parms ...interface{}) *SyscallNode {
+	nodes := walk(k.root.Load(), parms...)
+	return nodes[len(nodes)-1]
+}
+
+// Receive applies the envelope rules to a message arriving from
+// outside the kernel.  Expired, future-dated, over-hop-limit and
+// replayed messages are dropped with an error.  A reply whose
+// correlation ID matches an outstanding Request is handed to the
+// requester, and Receive returns true.  Otherwise it returns false,
+// and the message should be routed by its promise as usual.
+// Messages without an envelope are passed through.
+func (k *Kernel) Receive(msg *Message) (replied bool, err error) {
+	env := msg.Envelope
+	if env == nil {
+		return false, nil
+	}
+	now := time.Now()
+	if env.Expired(now) {
+		return false, ErrExpired
+	}
+	// a timestamp far ahead would also keep its nonce remembered
+	// past the replay window
+	if env.Timestamp > now.UnixNano()+int64(clockSkew) {
+		return false, ErrFuture
+	}
+	err = env.Hop()
+	if err != nil {
+		return false, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if len(env.Nonce) > 0 {
+		forget := env.Timestamp + int64(replayWindow)
+		if forget < now.UnixNano() {
+			return false, ErrReplay
+		}
+		k.pruneSeen(now.UnixNano())
+		nonce := hex.EncodeToString(env.Nonce)
+		if _, ok := k.seen[nonce]; ok {
+			return false, ErrReplay
+		}
+		k.seen[nonce] = forget
+	}
+
+	if env.CorrelationID != "" {
+		if ch, ok := k.pending[env.CorrelationID]; ok {
+			delete(k.pending, env.CorrelationID)
+			ch <- msg
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Request registers msg as an outstanding request and returns a
+// channel that will receive the reply carrying the same correlation
+// ID.  msg must have an envelope with a correlation ID; NewEnvelope
+// makes one.  Call cancel if the reply is no longer wanted.
+func (k *Kernel) Request(msg *Message) (reply <-chan *Message, cancel func(), err error) {
+	if msg.Envelope == nil || msg.Envelope.CorrelationID == "" {
+		return nil, nil, ErrNoCorrelationID
+	}
+	corr := msg.Envelope.CorrelationID
+	ch := make(chan *Message, 1)
+	k.mu.Lock()
+	k.pending[corr] = ch
+	k.mu.Unlock()
+	cancel = func() {
+		k.mu.Lock()
+		if k.pending[corr] == ch {
+			delete(k.pending, corr)
+		}
+		k.mu.Unlock()
+	}
+	return ch, cancel, nil
+}
+
+// replyPortQueue is how many replies an open reply port holds before
+// more are refused.
+const replyPortQueue = 16
+
+// OpenReplyPort opens the reply port name, and returns the channel
+// that receives the replies to requests naming it in their
+// envelope's ReplyTo; see Reply.  Call closePort when no more
+// replies are wanted, which also closes the channel.
+func (k *Kernel) OpenReplyPort(name string) (replies <-chan *Message, closePort func(), err error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.replyTo[name]; ok {
+		return nil, nil, ErrReplyPortInUse
+	}
+	ch := make(chan *Message, replyPortQueue)
+	k.replyTo[name] = ch
+	closePort = func() {
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		if k.replyTo[name] == ch {
+			delete(k.replyTo, name)
+			close(ch)
+		}
+	}
+	return ch, closePort, nil
+}
+
+// Reply sends reply, the answer to req, to the reply port req's
+// envelope names in ReplyTo, and returns true.  If req names no
+// port, Reply returns false, and the reply should go back the way
+// req came.  A port that isn't open or is full is an error.
+func (k *Kernel) Reply(req, reply *Message) (routed bool, err error) {
+	if req.Envelope == nil || req.Envelope.ReplyTo == "" {
+		return false, nil
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	ch, ok := k.replyTo[req.Envelope.ReplyTo]
+	if !ok {
+		return false, fmt.Errorf("%w: %q", ErrNoReplyPort, req.Envelope.ReplyTo)
+	}
+	select {
+	case ch <- reply:
+		return true, nil
+	default:
+		return false, fmt.Errorf("%w: %q", ErrReplyPortFull, req.Envelope.ReplyTo)
+	}
+}
+
+// pruneSeen forgets nonces that are past the replay window, at most
+// once a second.  k.mu must be held.
+func (k *Kernel) pruneSeen(now int64) {
+	if now-k.lastPrune < int64(time.Second) {
+		return
+	}
+	k.lastPrune = now
+	for nonce, forget := range k.seen {
+		if forget < now {
+			delete(k.seen, nonce)
+		}
 	}
-	return current
 }
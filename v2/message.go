@@ -2,7 +2,7 @@ package grid_cli
 
 import (
 	"bytes"
-	"crypto/sha256"
+	"strconv"
 	"strings"
 
 	"github.com/multiformats/go-multibase"
@@ -11,39 +11,54 @@ import (
 )
 
 type Message struct {
-	Promise *multihash.DecodedMultihash
-	Parms   []string // Promise Parameters
-	Payload string
+	Promise   *multihash.DecodedMultihash
+	Parms     []interface{} // Promise Parameters; see parm.go
+	Payload   string
+	Signature *Signature // nil if the message is unsigned
+	Envelope  *Envelope  // optional delivery fields; see envelope.go
+	// PayloadRef replaces Payload when the payload is chunked; see
+	// chunk.go
+	PayloadRef *PayloadRef
+	// Encryption is set while the payload, and maybe the
+	// parameters, are sealed; see crypt.go
+	Encryption *Encryption
 }
 
 // Message marshalling and unmarshalling follows the Go
 // marshal/unmarshal pattern.  A message is a promise hash followed by
-// zero or more parameters, space separated.  The optional payload is
-// separated by a double newline.
+// zero or more parameters, space separated.  Optional header fields
+// follow on their own lines, each a field name followed by its
+// values:
+//
+//	sig     the signer's multikey and the signature, both multibase
+//	        encoded
+//	env     the envelope; see envelope.go
+//	chunks  the root hash and size of a chunked payload; see chunk.go
+//	enc     how the payload is sealed; see crypt.go
+//
+// The optional payload is separated by a double newline.  See
+// binary.go for the alternative length-prefixed binary encoding;
+// Unmarshal accepts either.
 
-// NewPromise creates a new promise multihash from the given text and algorithm.
+// NewPromise creates a new promise multihash from the given text and
+// algorithm.  The algorithm is looked up by name in the hash
+// registry; see hash.go.
 func NewPromise(promiseTxt string, algoName string) (mHash *multihash.DecodedMultihash, err error) {
 	defer Return(&err)
 	// convert promiseTxt to a multihash
-	switch algoName {
-	case "sha256":
-		// get the sha256 hash of the promiseTxt
-		digest := sha256.Sum256([]byte(promiseTxt))
-		// create a multihash from the digest
-		m, err := multihash.Encode(digest[:], multihash.SHA2_256)
-		Ck(err)
-		// convert the multihash to a DecodedMultihash
-		mHash, err = multihash.Decode(m)
-		Ck(err)
-	default:
-		Assert(false, "unsupported algorithm")
-	}
+	code, err := HashCode(algoName)
+	Ck(err)
+	m, err := Sum(code, []byte(promiseTxt))
+	Ck(err)
+	// convert the multihash to a DecodedMultihash
+	mHash, err = multihash.Decode(m)
+	Ck(err)
 	return mHash, nil
 }
 
 // NewMessage creates a new message with the given promise,
 // parameters, and payload.
-func NewMessage(promiseStr, algoName string, parms []string, payload string) (msg *Message, err error) {
+func NewMessage(promiseStr, algoName string, parms []interface{}, payload string) (msg *Message, err error) {
 	defer Return(&err)
 
 	mHash, err := NewPromise(promiseStr, algoName)
@@ -58,7 +73,19 @@ func NewMessage(promiseStr, algoName string, parms []string, payload string) (ms
 	return msg, nil
 }
 
-// Marshal a message to a byte slice
+// decodeBytes decodes a multibase token holding bytes.  It accepts
+// "z", which is what multibase.Encode writes for no bytes, though
+// multibase.Decode refuses it.
+func decodeBytes(token string) (buf []byte, err error) {
+	if token == "z" {
+		return []byte{}, nil
+	}
+	_, buf, err = multibase.Decode(token)
+	return buf, err
+}
+
+// Marshal a message to a byte slice.  Marshal always produces the
+// canonical text encoding described at Canonicalize.
 func Marshal(msg *Message) (buf []byte, err error) {
 	defer Return(&err)
 
@@ -70,8 +97,34 @@ func Marshal(msg *Message) (buf []byte, err error) {
 	promiseStr, err := multibase.Encode(multibase.Base58BTC, m)
 	Ck(err)
 
-	parms := strings.Join(msg.Parms, " ")
-	header := Spf("%s %s", promiseStr, parms)
+	parms, err := encodeParmsText(msg.Parms)
+	Ck(err)
+	header := promiseStr
+	if len(parms) > 0 {
+		header = Spf("%s %s", header, parms)
+	}
+	if msg.Signature != nil {
+		key, err := multibase.Encode(multibase.Base58BTC, msg.Signature.PublicKey)
+		Ck(err)
+		sig, err := multibase.Encode(multibase.Base58BTC, msg.Signature.Sig)
+		Ck(err)
+		header = Spf("%s\nsig %s %s", header, key, sig)
+	}
+	if msg.Envelope != nil {
+		env, err := envelopeText(msg.Envelope)
+		Ck(err)
+		header = Spf("%s\nenv %s", header, env)
+	}
+	if msg.PayloadRef != nil {
+		root, err := multibase.Encode(multibase.Base58BTC, msg.PayloadRef.Root)
+		Ck(err)
+		header = Spf("%s\nchunks %s %d", header, root, msg.PayloadRef.Size)
+	}
+	if msg.Encryption != nil {
+		enc, err := encryptionText(msg.Encryption)
+		Ck(err)
+		header = Spf("%s\nenc %s", header, enc)
+	}
 	txt := header
 	if len(msg.Payload) > 0 {
 		txt = Spf("%s\n\n%s", txt, msg.Payload)
@@ -81,27 +134,180 @@ func Marshal(msg *Message) (buf []byte, err error) {
 	return buf, nil
 }
 
+// Unmarshal a message from a byte slice in either the text or the
+// binary encoding.  If the message is signed, the signature must
+// match the message content; use Verify to check who signed it.
 func Unmarshal(data []byte, m *Message) (err error) {
+	if len(data) > 0 && data[0] == BinaryMarker {
+		err = unmarshalBinary(data, m)
+	} else {
+		err = unmarshalText(data, m)
+	}
+	if err != nil {
+		return err
+	}
+	if m.Signed() {
+		return checkSignature(m)
+	}
+	return nil
+}
+
+// unmarshalText decodes a text-encoded message.
+func unmarshalText(data []byte, m *Message) (err error) {
 	defer Return(&err)
 	// Split the data into the header and payload
 	parts := bytes.SplitN(data, []byte("\n\n"), 2)
 	// payload is optional
+	m.Payload = ""
 	if len(parts) == 2 {
 		m.Payload = string(parts[1])
 	}
+	// The first header line is the promise and parameters; any
+	// further lines are header fields
+	lines := strings.Split(string(parts[0]), "\n")
 	// Split the header into the promise and parameters
-	header := strings.Fields(string(parts[0]))
+	header, err := splitTokens(lines[0])
+	Ck(err)
 	// promise is required
 	Assert(len(header) > 0, "invalid message header; missing promise hash")
 	promiseBuf := header[0]
 	// parameters are optional
-	if len(header) > 1 {
-		m.Parms = strings.Fields(string(header[1]))
+	m.Parms = nil
+	for _, token := range header[1:] {
+		parm, err := DecodeParm(token)
+		Ck(err)
+		m.Parms = append(m.Parms, parm)
 	}
 	// decode the promise hash using multibase and multihash
 	_, buf, err := multibase.Decode(promiseBuf)
 	Ck(err)
 	m.Promise, err = multihash.Decode(buf)
 	Ck(err)
+	m.Signature = nil
+	m.Envelope = nil
+	m.PayloadRef = nil
+	m.Encryption = nil
+	seen := make(map[string]bool)
+	for _, line := range lines[1:] {
+		field := strings.Fields(line)
+		if len(field) == 0 {
+			continue
+		}
+		Assert(!seen[field[0]], "duplicate header field %q", field[0])
+		seen[field[0]] = true
+		switch field[0] {
+		case "sig":
+			Assert(len(field) == 3, "invalid sig header field")
+			sig := &Signature{}
+			sig.PublicKey, err = decodeBytes(field[1])
+			Ck(err)
+			sig.Sig, err = decodeBytes(field[2])
+			Ck(err)
+			m.Signature = sig
+		case "env":
+			m.Envelope, err = parseEnvelopeText(field[1:])
+			Ck(err)
+		case "chunks":
+			Assert(len(field) == 3, "invalid chunks header field")
+			root, err := parseHash(field[1])
+			Ck(err)
+			size, err := strconv.ParseInt(field[2], 10, 64)
+			Ck(err)
+			m.PayloadRef = &PayloadRef{Root: root, Size: size}
+		case "enc":
+			m.Encryption, err = parseEncryptionText(field[1:])
+			Ck(err)
+		default:
+			Assert(false, "unknown header field %q", field[0])
+		}
+	}
 	return nil
 }
+
+// Canonicalize returns the canonical form of a text or binary
+// message, in the same encoding it came in.  Every logical message
+// has exactly one canonical form in each encoding, so canonical
+// messages can be hashed and signed.  In the text encoding:
+//
+//   - the promise is base58btc multibase
+//   - the promise and each parameter are separated by single spaces,
+//     with no trailing space; each parameter uses the shortest token
+//     parm.go allows, so strings are bare where they can be
+//   - header fields follow in the order sig, env, chunks, enc, one
+//     per line, their values separated by single spaces
+//   - a non-empty payload follows a blank line; an empty payload
+//     leaves no blank line
+//
+// In the binary encoding every varint is minimal and every optional
+// section that is present has its flag set.  Marshal and
+// MarshalBinary always produce canonical output, so for a canonical
+// input Marshal(Unmarshal(x)) is byte-identical to x.  The corpus
+// under testdata/corpus holds canonical, non-canonical and invalid
+// examples for testing other implementations against.
+func Canonicalize(data []byte) (canon []byte, err error) {
+	defer Return(&err)
+	var msg Message
+	err = Unmarshal(data, &msg)
+	Ck(err)
+	if len(data) > 0 && data[0] == BinaryMarker {
+		return MarshalBinary(&msg)
+	}
+	return Marshal(&msg)
+}
+
+// IsCanonical reports whether data is a message in canonical form.
+func IsCanonical(data []byte) bool {
+	canon, err := Canonicalize(data)
+	return err == nil && bytes.Equal(canon, data)
+}
+
+// Pretty formats a message for people to read.  If catalog is not
+// nil, it is used to show the text of the promise alongside its
+// hash.
+func Pretty(msg *Message, catalog *PromiseCatalog) (txt string, err error) {
+	defer Return(&err)
+	m, err := multihash.Encode(msg.Promise.Digest, msg.Promise.Code)
+	Ck(err)
+	promiseStr, err := multibase.Encode(multibase.Base58BTC, m)
+	Ck(err)
+	promiseTxt := "(unknown promise)"
+	if catalog != nil {
+		t, err := catalog.Show(m)
+		if err == nil {
+			promiseTxt = Spf("%q", t)
+		}
+	}
+	parms, err := encodeParmsText(msg.Parms)
+	Ck(err)
+	signer := "unsigned"
+	if msg.Signed() {
+		signer, err = multibase.Encode(multibase.Base58BTC, msg.Signature.PublicKey)
+		Ck(err)
+	}
+
+	var b strings.Builder
+	b.WriteString(Spf("promise: %s %s\n", promiseStr, promiseTxt))
+	b.WriteString(Spf("parms:   %s\n", parms))
+	b.WriteString(Spf("signer:  %s\n", signer))
+	if msg.Encryption != nil {
+		sender, err := multibase.Encode(multibase.Base58BTC, msg.Encryption.Sender)
+		Ck(err)
+		b.WriteString(Spf("sealed:  by %s to %d recipients\n", sender, len(msg.Encryption.Recipients)))
+	}
+	if msg.Envelope != nil {
+		env, err := envelopeText(msg.Envelope)
+		Ck(err)
+		b.WriteString(Spf("env:     %s\n", env))
+	}
+	if msg.PayloadRef != nil {
+		root, err := multibase.Encode(multibase.Base58BTC, msg.PayloadRef.Root)
+		Ck(err)
+		b.WriteString(Spf("payload: %d bytes in chunks under %s\n", msg.PayloadRef.Size, root))
+	} else {
+		b.WriteString(Spf("payload: %d bytes\n", len(msg.Payload)))
+	}
+	if len(msg.Payload) > 0 {
+		b.WriteString(Spf("\n%s", msg.Payload))
+	}
+	return b.String(), nil
+}
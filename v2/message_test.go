@@ -1,11 +1,14 @@
 package grid_cli
 
 import (
+	"bytes"
 	"io/ioutil"
 	"os"
+	"reflect"
 	"testing"
 
 	"github.com/davecgh/go-spew/spew"
+	"github.com/multiformats/go-multihash"
 	. "github.com/stevegt/goadapt"
 )
 
@@ -22,7 +25,7 @@ func TestMarshalMessage(t *testing.T) {
 	promise, err := NewPromise("I will say hello", "sha256")
 	msg := Message{
 		Promise: promise,
-		Parms:   []string{"hello"},
+		Parms:   []interface{}{"hello"},
 		Payload: "world",
 	}
 
@@ -56,3 +59,71 @@ func TestUnMarshalMessage(t *testing.T) {
 
 	Tassert(t, msg.Payload == "world\n", "Expected string %q but got %q", "world", msg.Payload)
 }
+
+// TestBinaryRoundTrip tests the binary encoding with parameters and
+// payloads that the text encoding can't carry.
+func TestBinaryRoundTrip(t *testing.T) {
+	promise, err := NewPromise("I will say hello", "sha256")
+	Tassert(t, err == nil, "Failed to create promise: %v", err)
+	msg := Message{
+		Promise: promise,
+		Parms:   []interface{}{"hello world", "line\none", ""},
+		Payload: "\x00\x01\n\nbinary\xff",
+	}
+
+	data, err := MarshalBinary(&msg)
+	Tassert(t, err == nil, "Failed to marshal message: %v", err)
+	Tassert(t, data[0] == BinaryMarker, "Expected binary marker but got %#x", data[0])
+
+	var got Message
+	err = Unmarshal(data, &got)
+	Tassert(t, err == nil, "Failed to unmarshal message: %v", err)
+	Tassert(t, got.Promise.Code == promise.Code, "Expected code %d but got %d", promise.Code, got.Promise.Code)
+	Tassert(t, string(got.Promise.Digest) == string(promise.Digest), "Promise digest mismatch")
+	Tassert(t, len(got.Parms) == len(msg.Parms), "Expected %d parms but got %d", len(msg.Parms), len(got.Parms))
+	for i := range msg.Parms {
+		Tassert(t, got.Parms[i] == msg.Parms[i], "Expected parm %q but got %q", msg.Parms[i], got.Parms[i])
+	}
+	Tassert(t, got.Payload == msg.Payload, "Expected payload %q but got %q", msg.Payload, got.Payload)
+
+	// truncated messages must fail
+	err = Unmarshal(data[:len(data)-1], &got)
+	Tassert(t, err != nil, "Expected error for truncated message")
+}
+
+// TestTypedParms tests that typed and escaped parameters round-trip
+// losslessly through both encodings
+func TestTypedParms(t *testing.T) {
+	promise, err := NewPromise("I will say hello", "sha256")
+	Tassert(t, err == nil, "Failed to create promise: %v", err)
+	ref, err := Sum(multihash.SHA2_256, []byte("some content"))
+	Tassert(t, err == nil, "Failed to hash: %v", err)
+	msg := Message{
+		Promise: promise,
+		Parms: []interface{}{
+			"hello", "hello world", "line\none", "", `"quoted"`, "#1", "@x", `back\slash`,
+			int64(-42), int64(0), []byte{0, 1, 2, 0xff}, []byte{}, ref,
+		},
+		Payload: "world",
+	}
+
+	for _, marshal := range []func(*Message) ([]byte, error){Marshal, MarshalBinary} {
+		data, err := marshal(&msg)
+		Tassert(t, err == nil, "Failed to marshal message: %v", err)
+		var got Message
+		err = Unmarshal(data, &got)
+		Tassert(t, err == nil, "Failed to unmarshal %q: %v", data, err)
+		Tassert(t, reflect.DeepEqual(got.Parms, msg.Parms), "Expected parms %#v but got %#v", msg.Parms, got.Parms)
+		Tassert(t, got.Payload == msg.Payload, "Expected payload %q but got %q", msg.Payload, got.Payload)
+	}
+
+	// the kernel and cache can take parameters directly, and keep
+	// the string "1" apart from the integer 1
+	Tassert(t, parmKey("1") != parmKey(int64(1)), "Expected distinct keys for \"1\" and 1")
+	Tassert(t, parmKey(1) == parmKey(int64(1)), "Expected int and int64 keys to match")
+	k1, err := CacheKey(nil, nil, "1")
+	Tassert(t, err == nil, "Failed to construct cache key: %v", err)
+	k2, err := CacheKey(nil, nil, int64(1))
+	Tassert(t, err == nil, "Failed to construct cache key: %v", err)
+	Tassert(t, !bytes.Equal(k1, k2), "Expected distinct cache keys but got %q", k1)
+}
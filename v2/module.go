@@ -1,10 +1,24 @@
 package grid_cli
 
 import (
+	"bytes"
 	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/multiformats/go-multihash"
+	"github.com/spf13/afero"
+	. "github.com/stevegt/goadapt"
 )
 
 // Module is an interface for grid-cli modules.
@@ -13,35 +27,501 @@ type Module interface {
 	HandleMessage(ctx context.Context, parms ...interface{}) ([]byte, error)
 }
 
-// LocalCacheModule implements a module that interacts with a local cache.
+// LocalCacheModule is a module that answers messages from
+// completions cached on a filesystem.  It takes a message's path as
+// the cache key: the promise hash, the hash of the module that
+// computed the completion, and that module's arguments.  Put writes
+// completions back.  Mounted with Kernel.MountCache, it is the
+// kernel's first-level cache.  The keys are kept in a CacheIndex
+// saved in the cache directory, and each completion in a blob named
+// by its hash, so identical completions are stored once.  Blobs are
+// checked against their hashes whenever they are read.
+//
+// Put keeps the cache within the quota set with SetQuota by evicting
+// blobs, and the keys that refer to them.  A blob is pinned, and
+// never evicted, if its hash, or the promise or module hash of a key
+// that refers to it, is in the cache's pin file.
 type LocalCacheModule struct {
+	fs       afero.Fs
 	cacheDir string
+
+	// mu is held for reading while looking up and reading entries,
+	// and for writing while changing or evicting them
+	mu    sync.RWMutex
+	quota CacheQuota
+	once  sync.Once
+	index *CacheIndex
+	used  map[string]*blobUse // by blob file name
+	err   error               // from loading the index
+}
+
+// blobUse records the use of a blob, for eviction.
+type blobUse struct {
+	last atomic.Int64 // UnixNano
+	uses atomic.Int64
+}
+
+const (
+	// cacheIndexFile holds the saved index, relative to the cache
+	// directory.
+	cacheIndexFile = "index"
+	// cacheBlobDir holds the blobs, relative to the cache directory.
+	cacheBlobDir = "blobs"
+	// cachePinFile is the pin file, relative to the cache directory.
+	cachePinFile = "pins"
+)
+
+// NewLocalCacheModule returns a cache module keeping its completions
+// under cacheDir on fs.
+func NewLocalCacheModule(fs afero.Fs, cacheDir string) *LocalCacheModule {
+	return &LocalCacheModule{fs: fs, cacheDir: cacheDir}
+}
+
+// Index returns the cache's index, loading it on first use.
+func (c *LocalCacheModule) Index() (*CacheIndex, error) {
+	c.once.Do(func() {
+		c.index, c.err = LoadCacheIndex(c.fs, filepath.Join(c.cacheDir, cacheIndexFile))
+		c.used = make(map[string]*blobUse)
+		if c.err != nil {
+			return
+		}
+		// blobs were last used when written or read, as far as a
+		// new process can tell; use counts start over
+		for _, e := range c.index.Completions(nil) {
+			name := c.blobName(e.Ref)
+			if _, ok := c.used[name]; ok {
+				continue
+			}
+			use := &blobUse{}
+			if info, err := c.fs.Stat(c.blobPath(e.Ref)); err == nil {
+				use.last.Store(info.ModTime().UnixNano())
+			}
+			c.used[name] = use
+		}
+	})
+	return c.index, c.err
+}
+
+// SetQuota sets the quota Put keeps the cache within.
+func (c *LocalCacheModule) SetQuota(q CacheQuota) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.quota = q
+}
+
+// Quota returns the quota set with SetQuota.
+func (c *LocalCacheModule) Quota() CacheQuota {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.quota
+}
+
+// PinFile returns the path of the cache's pin file, as read by
+// LoadPins.
+func (c *LocalCacheModule) PinFile() string {
+	return filepath.Join(c.cacheDir, cachePinFile)
+}
+
+// key returns the cache key for parms.
+func (c *LocalCacheModule) key(parms []interface{}) (key []byte, err error) {
+	if len(parms) < 2 {
+		return nil, fmt.Errorf("cache key needs a promise hash and a module hash")
+	}
+	promise, ok := parms[0].(multihash.Multihash)
+	if !ok {
+		return nil, fmt.Errorf("cache key has no promise hash")
+	}
+	module, ok := parms[1].(multihash.Multihash)
+	if !ok {
+		return nil, fmt.Errorf("cache key has no module hash")
+	}
+	return CacheKey(promise, module, parms[2:]...)
+}
+
+// lookup returns the blob reference for parms, or ErrCacheMiss.  The
+// caller holds c.mu.
+func (c *LocalCacheModule) lookup(parms []interface{}) (ref []byte, err error) {
+	key, err := c.key(parms)
+	if err != nil {
+		return nil, err
+	}
+	index, err := c.Index()
+	if err != nil {
+		return nil, err
+	}
+	ref, ok := index.Get(key)
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+	return ref, nil
+}
+
+// blobName returns the file name of the blob with hash ref.
+func (c *LocalCacheModule) blobName(ref []byte) string {
+	return hex.EncodeToString(ref)
+}
+
+// blobDir returns the directory holding the blobs.
+func (c *LocalCacheModule) blobDir() string {
+	return filepath.Join(c.cacheDir, cacheBlobDir)
+}
+
+// blobPath returns the file for the blob with hash ref.
+func (c *LocalCacheModule) blobPath(ref []byte) string {
+	return filepath.Join(c.blobDir(), c.blobName(ref))
+}
+
+// Accept accepts the message if a completion for its path is
+// cached, and otherwise returns ErrCacheMiss, so that the message
+// goes to the module that would compute it.  The completion is only
+// checked against its hash when HandleMessage reads it.
+func (c *LocalCacheModule) Accept(ctx context.Context, parms ...interface{}) (Message, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	ref, err := c.lookup(parms)
+	if err != nil {
+		return Message{}, err
+	}
+	_, err = c.fs.Stat(c.blobPath(ref))
+	if os.IsNotExist(err) {
+		return Message{}, ErrCacheMiss
+	}
+	return Message{}, err
+}
+
+// HandleMessage returns the cached completion for the message's
+// path, checked against its hash, and records its use.  A corrupt
+// blob is quarantined and its keys dropped, and is a miss like a
+// missing one.
+func (c *LocalCacheModule) HandleMessage(ctx context.Context, parms ...interface{}) (data []byte, err error) {
+	c.mu.RLock()
+	ref, err := c.lookup(parms)
+	if err == nil {
+		data, err = ReadCacheFile(c.fs, c.blobDir(), c.blobName(ref))
+	}
+	if err == nil {
+		now := time.Now()
+		if u, ok := c.used[c.blobName(ref)]; ok {
+			u.last.Store(now.UnixNano())
+			u.uses.Add(1)
+		}
+		// so that the next process knows too
+		c.fs.Chtimes(c.blobPath(ref), now, now)
+	}
+	c.mu.RUnlock()
+	switch {
+	case os.IsNotExist(err):
+		return nil, ErrCacheMiss
+	case errors.Is(err, ErrCorrupt):
+		qerr := c.quarantine(ref)
+		if qerr != nil {
+			return nil, qerr
+		}
+		return nil, fmt.Errorf("%w: %v", ErrCacheMiss, err)
+	}
+	return data, err
+}
+
+// quarantine moves the blob with hash ref to the quarantine
+// directory, unless it has been replaced by an intact one, and drops
+// the keys that refer to it.
+func (c *LocalCacheModule) quarantine(ref []byte) (err error) {
+	defer Return(&err)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	name := c.blobName(ref)
+	_, err = ReadCacheFile(c.fs, c.blobDir(), name)
+	if err == nil {
+		return nil
+	}
+	_, err = Quarantine(c.fs, c.blobDir(), name)
+	Ck(err)
+	delete(c.used, name)
+	for _, e := range c.index.Completions(nil) {
+		if bytes.Equal(e.Ref, ref) {
+			c.index.Delete(e.Key)
+		}
+	}
+	err = c.index.Save(c.fs, filepath.Join(c.cacheDir, cacheIndexFile))
+	Ck(err)
+	return nil
+}
+
+// Verify checks every blob against its hash, and every key for a
+// blob, and returns how many blobs it checked and the problems it
+// found.  If repair is set, corrupt blobs are quarantined, and keys
+// without a blob dropped.
+func (c *LocalCacheModule) Verify(repair bool) (checked int, problems []CacheProblem, err error) {
+	defer Return(&err)
+	index, err := c.Index()
+	Ck(err)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	checked, problems, err = verifyDir(c.fs, c.blobDir(), repair)
+	Ck(err)
+	fn := filepath.Join(c.cacheDir, cacheIndexFile)
+	dropped := false
+	for _, e := range index.Completions(nil) {
+		_, err := c.fs.Stat(c.blobPath(e.Ref))
+		if err == nil {
+			continue
+		}
+		p := CacheProblem{Path: fn, Err: fmt.Errorf("key %x has no blob %s", e.Key, c.blobName(e.Ref))}
+		if repair {
+			index.Delete(e.Key)
+			dropped = true
+			p.Repaired = true
+		}
+		problems = append(problems, p)
+	}
+	if dropped {
+		err = index.Save(c.fs, fn)
+		Ck(err)
+	}
+	return checked, problems, nil
+}
+
+// Put caches completion for the path in parms: the promise hash,
+// the module hash and the arguments, and then evicts what is over
+// the quota.  The blob is written before the index, and both are
+// replaced atomically, so readers see the old completion or the new
+// one.
+func (c *LocalCacheModule) Put(completion []byte, parms ...interface{}) (err error) {
+	defer Return(&err)
+	key, err := c.key(parms)
+	Ck(err)
+	index, err := c.Index()
+	Ck(err)
+	ref, err := Sum(multihash.SHA2_256, completion)
+	Ck(err)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	name := c.blobName(ref)
+	_, err = ReadCacheFile(c.fs, c.blobDir(), name)
+	if err != nil {
+		// missing, or corrupt and not yet noticed
+		err = writeFileAtomic(c.fs, c.blobPath(ref), completion, 0644)
+		Ck(err)
+	}
+	if _, ok := c.used[name]; !ok {
+		c.used[name] = &blobUse{}
+	}
+	c.used[name].last.Store(time.Now().UnixNano())
+	old, replaced := index.Get(key)
+	index.Put(key, ref)
+	if replaced && !bytes.Equal(old, ref) {
+		err = c.release(old)
+		Ck(err)
+	}
+	_, err = c.evict()
+	Ck(err)
+	err = index.Save(c.fs, filepath.Join(c.cacheDir, cacheIndexFile))
+	Ck(err)
+	return nil
+}
+
+// Evict removes blobs and their keys until the cache is within its
+// quota, and returns what it removed.
+func (c *LocalCacheModule) Evict() (victims []CacheItem, err error) {
+	defer Return(&err)
+	index, err := c.Index()
+	Ck(err)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	victims, err = c.evict()
+	Ck(err)
+	if len(victims) > 0 {
+		err = index.Save(c.fs, filepath.Join(c.cacheDir, cacheIndexFile))
+		Ck(err)
+	}
+	return victims, nil
+}
+
+// evict removes what is over the quota from the index and the blob
+// directory, without saving the index.  The caller holds c.mu for
+// writing.
+func (c *LocalCacheModule) evict() (victims []CacheItem, err error) {
+	defer Return(&err)
+	items, keys, err := c.items()
+	Ck(err)
+	victims = c.quota.Victims(items)
+	for _, item := range victims {
+		for _, key := range keys[item.Name] {
+			c.index.Delete(key)
+		}
+		err = c.removeBlob(item.Name)
+		Ck(err)
+	}
+	return victims, nil
+}
+
+// release removes the blob with hash ref if no key refers to it.
+// The caller holds c.mu for writing.
+func (c *LocalCacheModule) release(ref []byte) (err error) {
+	for _, e := range c.index.Completions(nil) {
+		if bytes.Equal(e.Ref, ref) {
+			return nil
+		}
+	}
+	return c.removeBlob(c.blobName(ref))
 }
 
-func NewLocalCacheModule(cacheDir string) *LocalCacheModule {
-	return &LocalCacheModule{cacheDir: cacheDir}
+// removeBlob removes the blob file name.  The caller holds c.mu for
+// writing.
+func (c *LocalCacheModule) removeBlob(name string) (err error) {
+	delete(c.used, name)
+	err = c.fs.Remove(filepath.Join(c.blobDir(), name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
 }
 
-func constructCacheKey(promiseHash, moduleHash []byte, args ...interface{}) string {
-	var keyBuilder strings.Builder
+// Items returns the cache's blobs as cache items, named by their
+// file names.
+func (c *LocalCacheModule) Items() (items []CacheItem, err error) {
+	_, err = c.Index()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	items, _, err = c.items()
+	return items, err
+}
 
-	keyBuilder.WriteString(fmt.Sprintf("%x", promiseHash))
-	keyBuilder.WriteString("/")
-	keyBuilder.WriteString(fmt.Sprintf("%x", moduleHash))
+// Usage sums up the cache's items.
+func (c *LocalCacheModule) Usage() (u CacheUsage, err error) {
+	items, err := c.Items()
+	return Usage(items), err
+}
 
-	for _, arg := range args {
-		var encodedArg string
-		switch v := arg.(type) {
-		case string:
-			encodedArg = url.QueryEscape(v)
-		case []byte:
-			encodedArg = url.QueryEscape(string(v))
-		default:
-			// Handle unsupported argument types
+// items returns the cache's blobs, and the keys that refer to each.
+// The caller holds c.mu and has loaded the index.
+func (c *LocalCacheModule) items() (items []CacheItem, keys map[string][][]byte, err error) {
+	defer Return(&err)
+	pins, err := LoadPins(c.fs, c.PinFile())
+	Ck(err)
+	pinned := make(map[string]bool)
+	for _, pin := range pins {
+		pinned[string(pin)] = true
+	}
+	keys = make(map[string][][]byte)
+	byName := make(map[string]*CacheItem)
+	var names []string
+	for _, e := range c.index.Completions(nil) {
+		name := c.blobName(e.Ref)
+		item, ok := byName[name]
+		if !ok {
+			item = &CacheItem{Name: name, Pinned: pinned[string(e.Ref)]}
+			info, err := c.fs.Stat(c.blobPath(e.Ref))
+			if err == nil {
+				item.Size = info.Size()
+			}
+			if use, ok := c.used[name]; ok {
+				item.LastUsed = time.Unix(0, use.last.Load())
+				item.Uses = use.uses.Load()
+			}
+			byName[name] = item
+			names = append(names, name)
+		}
+		item.Entries++
+		keys[name] = append(keys[name], e.Key)
+		n, promise, err := multihash.MHFromBytes(e.Key)
+		if err == nil {
+			_, module, err := multihash.MHFromBytes(e.Key[n:])
+			item.Pinned = item.Pinned || pinned[string(promise)] || (err == nil && pinned[string(module)])
 		}
-		keyBuilder.WriteString("/")
-		keyBuilder.WriteString(encodedArg)
 	}
+	for _, name := range names {
+		items = append(items, *byName[name])
+	}
+	return items, keys, nil
+}
 
-	return keyBuilder.String()
+// Lookup matches the whole path if its completion is cached, so the
+// cache can be mounted.  Paths that aren't cache keys don't match.
+func (c *LocalCacheModule) Lookup(ctx context.Context, path []interface{}) ([]Match, error) {
+	key, err := c.key(path)
+	if err != nil {
+		return nil, nil
+	}
+	index, err := c.Index()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := index.Get(key); !ok {
+		return nil, nil
+	}
+	// a corrupt completion fails in HandleMessage, and the message
+	// then goes on to the module that would compute it
+	return []Match{{Module: c, Depth: len(path), Policy: cachePolicy}}, nil
+}
+
+// cachePolicy is the policy of the cache's matches.
+var cachePolicy = &Policy{Mode: PolicyFallback}
+
+// encodeKeyArg encodes one cache key argument as a segment.  Strings
+// and byte slices are query-escaped, as they always have been, so the
+// same bytes give the same segment either way.
+// Other arguments get a segment starting with ':', which escaping
+// never emits, followed by
+//
+//	%23{decimal}   any integer type, as "#{decimal}" escaped
+//	%40{base58}    a multihash, as its "@z..." token escaped
+//	f{float}       a float, in strconv's shortest 'g' form
+//	T or F         a bool
+//	({elem},...)   a slice or array, each element encoded the same
+//	               way and followed by ','
+//
+// Each segment decodes to one value, so different arguments can't
+// share a key.  Other types are an error.
+func encodeKeyArg(arg interface{}) (encodedArg string, err error) {
+	switch v := arg.(type) {
+	case string:
+		return url.QueryEscape(v), nil
+	case []byte:
+		return url.QueryEscape(string(v)), nil
+	case multihash.Multihash:
+		token, err := EncodeParm(v)
+		if err != nil {
+			return "", err
+		}
+		return ":" + url.QueryEscape(token), nil
+	case nil:
+		return "", fmt.Errorf("unsupported type <nil>")
+	}
+	rv := reflect.ValueOf(arg)
+	switch rv.Kind() {
+	case reflect.String:
+		return url.QueryEscape(rv.String()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return ":%23" + strconv.FormatInt(rv.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return ":%23" + strconv.FormatUint(rv.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return ":f" + strconv.FormatFloat(rv.Float(), 'g', -1, 64), nil
+	case reflect.Bool:
+		if rv.Bool() {
+			return ":T", nil
+		}
+		return ":F", nil
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() == reflect.Uint8 {
+			return url.QueryEscape(string(rv.Bytes())), nil
+		}
+		var b strings.Builder
+		b.WriteString(":(")
+		for i := 0; i < rv.Len(); i++ {
+			elem, err := encodeKeyArg(rv.Index(i).Interface())
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(elem)
+			b.WriteString(",")
+		}
+		b.WriteString(")")
+		return b.String(), nil
+	}
+	return "", fmt.Errorf("unsupported type %T", arg)
 }
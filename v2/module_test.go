@@ -0,0 +1,224 @@
+package grid_cli
+
+import (
+	"context"
+	"errors"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/multiformats/go-multihash"
+	"github.com/spf13/afero"
+	. "github.com/stevegt/goadapt"
+)
+
+// fakeModule is the module the tests bind and register.  It answers
+// with its name, or with its name and the message payload if payload
+// is set, after delay; or it declines or fails if told to.  Its
+// manifest names it, so fakes with the same name have the same hash.
+// Fakes with the same settings are equal, and being stateless are
+// safe for concurrent use; give one a rec to record its calls, or
+// bind a pointer to one to change its settings later.
+type fakeModule struct {
+	name    string
+	payload bool
+	decline bool
+	err     error
+	delay   time.Duration
+	rec     *fakeRecord
+}
+
+// fakeRecord is what a fakeModule has been called with.
+type fakeRecord struct {
+	mu       sync.Mutex
+	calls    int
+	parms    []interface{}
+	captures []interface{}
+	ports    []*ModulePorts
+}
+
+func (m fakeModule) Accept(ctx context.Context, parms ...interface{}) (Message, error) {
+	if m.decline {
+		return Message{}, errors.New(m.name + " declines")
+	}
+	return Message{}, nil
+}
+
+func (m fakeModule) HandleMessage(ctx context.Context, parms ...interface{}) ([]byte, error) {
+	if m.rec != nil {
+		m.rec.mu.Lock()
+		m.rec.calls++
+		m.rec.parms = parms
+		m.rec.captures = Captures(ctx)
+		m.rec.mu.Unlock()
+	}
+	if m.delay > 0 {
+		select {
+		case <-time.After(m.delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if m.err != nil {
+		return nil, m.err
+	}
+	if !m.payload {
+		return []byte(m.name), nil
+	}
+	msg, ok := MessageFromContext(ctx)
+	if !ok {
+		return nil, errors.New("no message in context")
+	}
+	return []byte(m.name + ":" + msg.Payload), nil
+}
+
+func (m fakeModule) Manifest() ([]byte, error) {
+	return []byte("manifest for " + m.name), nil
+}
+
+func (m fakeModule) SetPorts(ports *ModulePorts) {
+	if m.rec != nil {
+		m.rec.mu.Lock()
+		m.rec.ports = append(m.rec.ports, ports)
+		m.rec.mu.Unlock()
+	}
+}
+
+// TestLocalCacheModule tests caching completions and serving them
+// as the kernel's first-level cache.
+func TestLocalCacheModule(t *testing.T) {
+	ctx := context.Background()
+	fs := afero.NewMemMapFs()
+	cache := NewLocalCacheModule(fs, "/grid/cache")
+	promise, err := Sum(multihash.SHA2_256, []byte("I will say hello"))
+	Tassert(t, err == nil, "Failed to hash: %v", err)
+	module, err := Sum(multihash.SHA2_256, []byte("hello module"))
+	Tassert(t, err == nil, "Failed to hash: %v", err)
+	key := []interface{}{promise, module, "hello"}
+
+	_, err = cache.Accept(ctx, key...)
+	Tassert(t, errors.Is(err, ErrCacheMiss), "Expected ErrCacheMiss but got %v", err)
+	_, err = cache.HandleMessage(ctx, key...)
+	Tassert(t, errors.Is(err, ErrCacheMiss), "Expected ErrCacheMiss but got %v", err)
+	err = cache.Put([]byte("world"), key...)
+	Tassert(t, err == nil, "Failed to put: %v", err)
+	_, err = cache.Accept(ctx, key...)
+	Tassert(t, err == nil, "Expected a hit but got %v", err)
+	out, err := cache.HandleMessage(ctx, key...)
+	Tassert(t, err == nil && string(out) == "world", "Unexpected completion %q: %v", out, err)
+
+	// a key and its extensions are cached apart
+	longer := append(append([]interface{}{}, key...), "again")
+	_, err = cache.Accept(ctx, longer...)
+	Tassert(t, errors.Is(err, ErrCacheMiss), "Expected ErrCacheMiss but got %v", err)
+	err = cache.Put([]byte("world again"), longer...)
+	Tassert(t, err == nil, "Failed to put: %v", err)
+	out, err = cache.HandleMessage(ctx, key...)
+	Tassert(t, err == nil && string(out) == "world", "Unexpected completion %q: %v", out, err)
+	err = cache.Put([]byte("world, again"), longer...)
+	Tassert(t, err == nil, "Failed to put: %v", err)
+	out, err = cache.HandleMessage(ctx, longer...)
+	Tassert(t, err == nil && string(out) == "world, again", "Unexpected completion %q: %v", out, err)
+
+	// arguments can't climb out of the cache or vanish
+	for _, args := range [][]interface{}{{".."}, {"..", ".."}, {"."}, {""}, {"", "hello"}} {
+		k := append([]interface{}{promise, module}, args...)
+		_, err = cache.Accept(ctx, k...)
+		Tassert(t, errors.Is(err, ErrCacheMiss), "Expected ErrCacheMiss for %q but got %v", args, err)
+		err = cache.Put([]byte("x"), k...)
+		Tassert(t, err == nil, "Failed to put %q: %v", args, err)
+	}
+	err = afero.Walk(fs, "/", func(path string, info os.FileInfo, err error) error {
+		Tassert(t, info.IsDir() || strings.HasPrefix(path, "/grid/cache/"), "Unexpected file %s", path)
+		return err
+	})
+	Tassert(t, err == nil, "Failed to walk: %v", err)
+	out, err = cache.HandleMessage(ctx, key...)
+	Tassert(t, err == nil && string(out) == "world", "Unexpected completion %q: %v", out, err)
+
+	// the index persists, and equal completions share a blob
+	reloaded := NewLocalCacheModule(fs, "/grid/cache")
+	out, err = reloaded.HandleMessage(ctx, longer...)
+	Tassert(t, err == nil && string(out) == "world, again", "Unexpected completion %q: %v", out, err)
+	index, err := reloaded.Index()
+	Tassert(t, err == nil && index.Len() == 7, "Expected 7 keys but got %v: %v", index, err)
+	blobs, err := afero.ReadDir(fs, "/grid/cache/blobs")
+	Tassert(t, err == nil && len(blobs) == 3, "Expected 3 blobs but got %d: %v", len(blobs), err)
+
+	_, err = cache.Accept(ctx, promise)
+	Tassert(t, err != nil && !errors.Is(err, ErrCacheMiss), "Expected an invalid key error but got %v", err)
+	_, err = cache.Accept(ctx, promise, "not a hash")
+	Tassert(t, err != nil && !errors.Is(err, ErrCacheMiss), "Expected an invalid key error but got %v", err)
+
+	// as the first-level cache, a hit keeps the message from the
+	// module that would compute it
+	k := NewKernel()
+	computer := fakeModule{name: "computed", rec: &fakeRecord{}}
+	err = k.bindSyscall(computer, promise, module, Rest())
+	Tassert(t, err == nil, "Failed to bind: %v", err)
+	k.MountCache(cache)
+	msg := &Message{Promise: mustDecode(t, promise), Parms: []interface{}{module, "hello"}}
+	out, err = k.Dispatch(ctx, msg)
+	Tassert(t, err == nil && string(out) == "world", "Unexpected output %q: %v", out, err)
+	Tassert(t, computer.rec.calls == 0, "Expected the cached completion")
+	msg.Parms = []interface{}{module, "goodbye"}
+	out, err = k.Dispatch(ctx, msg)
+	Tassert(t, err == nil && string(out) == "computed", "Unexpected output %q: %v", out, err)
+	Tassert(t, computer.rec.calls == 1, "Expected a call on a miss")
+	k.MountCache(nil)
+	msg.Parms = []interface{}{module, "hello"}
+	out, err = k.Dispatch(ctx, msg)
+	Tassert(t, err == nil && string(out) == "computed", "Unexpected output %q: %v", out, err)
+}
+
+// mustDecode decodes a multihash for a message's promise.
+func mustDecode(t *testing.T, mh multihash.Multihash) *multihash.DecodedMultihash {
+	dmh, err := multihash.Decode(mh)
+	Tassert(t, err == nil, "Failed to decode multihash: %v", err)
+	return dmh
+}
+
+// TestCacheKeys tests that cache keys are typed and injective.
+func TestCacheKeys(t *testing.T) {
+	mh, err := Sum(multihash.SHA2_256, []byte("hello"))
+	Tassert(t, err == nil, "Failed to hash: %v", err)
+
+	// string, []byte, integer and multihash keys are as they were
+	for _, c := range []struct {
+		arg  interface{}
+		want string
+	}{
+		{"hello world/x", "hello+world%2Fx"},
+		{[]byte("hello world/x"), "hello+world%2Fx"},
+		{int64(-1), ":%23-1"},
+		{1, ":%231"},
+		{mh, ":%40" + parmKey(mh)[1:]},
+	} {
+		seg, err := encodeKeyArg(c.arg)
+		Tassert(t, err == nil, "Failed to encode %#v: %v", c.arg, err)
+		Tassert(t, seg == c.want, "Expected %q for %#v but got %q", c.want, c.arg, seg)
+	}
+
+	args := [][]interface{}{
+		{}, {""}, {"", ""}, {"1"}, {1}, {2}, {uint64(1 << 63)}, {1.0}, {1.5}, {0.0}, {math.Copysign(0, -1)}, {float32(1.5) + 1},
+		{true}, {false}, {"T"}, {":T"}, {[]interface{}{}}, {[]interface{}{""}}, {[]string{"a", "b"}},
+		{"a", "b"}, {[]interface{}{"a", []string{"b"}}}, {[]interface{}{[]string{"a"}, "b"}},
+		{[]int{1, 2}}, {[]int{12}}, {"a,b"}, {[]string{"a,b"}}, {mh}, {[]interface{}{mh}},
+	}
+	seen := make(map[string][]interface{})
+	for _, a := range args {
+		key, err := CacheKey(nil, nil, a...)
+		Tassert(t, err == nil, "Failed to construct key for %#v: %v", a, err)
+		other, dup := seen[string(key)]
+		Tassert(t, !dup, "Args %#v and %#v share key %q", a, other, key)
+		seen[string(key)] = a
+	}
+
+	for _, bad := range []interface{}{nil, map[string]int{}, struct{}{}, []interface{}{1, nil}} {
+		_, err := CacheKey(nil, nil, bad)
+		Tassert(t, err != nil, "Expected an error for %#v", bad)
+	}
+}
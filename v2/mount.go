@@ -0,0 +1,129 @@
+package grid_cli
+
+import (
+	"context"
+	"errors"
+)
+
+// A mount grafts another syscall tree onto a node of the kernel's
+// tree, as described in doc/325-mount.md.  When a lookup reaches
+// the mount point and runs out of deeper local matches -- a sequence
+// fault -- it continues into the mounted tree with the path elements
+// that remain.  The mounted tree can be another kernel, including
+// one loaded from a saved tree with NewKernelFs, or anything else
+// that implements Mount, such as a proxy for a peer's tree.  There
+// is no global mount table; each mount point only knows its own
+// tree.
+
+// Mount is a syscall tree that can be mounted.
+type Mount interface {
+	// Lookup matches path, the path elements remaining at the mount
+	// point, against the tree, and returns the matching modules in
+	// the order they should be offered a message.  It may return
+	// matches along with an error if part of the tree could not be
+	// searched.  The context carries the message being dispatched;
+	// see MessageFromContext.
+	Lookup(ctx context.Context, path []interface{}) ([]Match, error)
+}
+
+// Match is a module found by a Lookup.
+type Match struct {
+	Module Module
+	// Captures holds what the segments on the way to the module
+	// captured.
+	Captures []interface{}
+	// Depth is how many of the path elements the match covers.
+	Depth int
+	// Policy is the policy of the node the module is bound to.
+	// Dispatch applies it to the consecutive matches that share it.
+	Policy *Policy
+}
+
+// MountFunc adapts a function to the Mount interface.
+type MountFunc func(ctx context.Context, path []interface{}) ([]Match, error)
+
+// Lookup calls f.
+func (f MountFunc) Lookup(ctx context.Context, path []interface{}) ([]Match, error) {
+	return f(ctx, path)
+}
+
+// maxMountDepth limits how many mounts one lookup may pass through,
+// so that trees mounted in a loop can't recurse forever.
+const maxMountDepth = 16
+
+var (
+	// ErrMountDepth is returned by a lookup that passes through
+	// more than maxMountDepth mounts.
+	ErrMountDepth = errors.New("too many nested mounts")
+	// ErrNotMounted is returned by Unmount for a path with nothing
+	// mounted on it.
+	ErrNotMounted = errors.New("nothing mounted at path")
+)
+
+// mountDepthKey is the context key for the number of mounts a
+// lookup has passed through.
+type mountDepthKey struct{}
+
+// Lookup matches path against the kernel's syscall tree, so that a
+// kernel can be mounted in another kernel's tree.
+func (k *Kernel) Lookup(ctx context.Context, path []interface{}) (matches []Match, err error) {
+	depth, _ := ctx.Value(mountDepthKey{}).(int)
+	if depth >= maxMountDepth {
+		return nil, ErrMountDepth
+	}
+	m := &matcher{ctx: context.WithValue(ctx, mountDepthKey{}, depth+1)}
+	k.matchPath(m, path)
+	for _, cand := range m.cands {
+		for _, module := range cand.modules {
+			matches = append(matches, Match{
+				Module:   module,
+				Captures: cand.captures,
+				Depth:    cand.depth,
+				Policy:   cand.policy,
+			})
+		}
+	}
+	return matches, errors.Join(m.errs...)
+}
+
+// Mount grafts tree onto the syscall tree at path, replacing any
+// mount already there.  The path may contain Segments.  Mounts are
+// not saved by SaveTree.
+func (k *Kernel) Mount(path []interface{}, tree Mount) error {
+	return k.updateTree(path, func(node *SyscallNode) {
+		node.Mount = tree
+	})
+}
+
+// cacheMount holds the kernel's first-level cache.
+type cacheMount struct {
+	tree Mount
+}
+
+// MountCache makes tree the kernel's first-level cache: every lookup
+// offers a message to the modules tree matches before any in the
+// syscall tree, so a cached completion is used without calling the
+// modules that would compute it.  nil removes the cache.
+func (k *Kernel) MountCache(tree Mount) {
+	if tree == nil {
+		k.cache.Store(nil)
+		return
+	}
+	k.cache.Store(&cacheMount{tree: tree})
+}
+
+// Unmount removes the tree mounted at path.
+func (k *Kernel) Unmount(path []interface{}) (err error) {
+	found := false
+	err = k.updateTree(path, func(node *SyscallNode) {
+		found = node.Mount != nil
+		node.Mount = nil
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrNotMounted
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package grid_cli
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/multiformats/go-multihash"
+	"github.com/spf13/afero"
+	. "github.com/stevegt/goadapt"
+)
+
+// TestMount tests continuing a lookup into mounted trees.
+func TestMount(t *testing.T) {
+	msg, err := NewMessage("I will serve files", "sha256", nil, "")
+	Tassert(t, err == nil, "Failed to create message: %v", err)
+	path, err := messagePath(msg)
+	Tassert(t, err == nil, "Failed to get path: %v", err)
+	promise := path[0].(multihash.Multihash)
+	ctx := context.Background()
+	dispatch := func(k *Kernel, parms ...interface{}) (string, error) {
+		msg.Parms = parms
+		out, err := k.Dispatch(ctx, msg)
+		return string(out), err
+	}
+
+	// the child tree is saved and reloaded, as a mounted tree might be
+	fs := afero.NewMemMapFs()
+	child, err := NewKernelFs(fs, "/child")
+	Tassert(t, err == nil, "Failed to create kernel: %v", err)
+	reader := fakeModule{name: "child reader", rec: &fakeRecord{}}
+	child.modules["@zreader"] = reader
+	child.bindSyscall(reader, "read", AnyString())
+	err = child.SaveTree()
+	Tassert(t, err == nil, "Failed to save tree: %v", err)
+	child, err = NewKernelFs(fs, "/child")
+	Tassert(t, err == nil, "Failed to create kernel: %v", err)
+	child.modules["@zreader"] = reader
+	err = child.LoadTree()
+	Tassert(t, err == nil, "Failed to load tree: %v", err)
+
+	k := NewKernel()
+	err = k.Mount([]interface{}{promise, "fs"}, child)
+	Tassert(t, err == nil, "Failed to mount: %v", err)
+
+	// the lookup continues into the mounted tree with the rest of
+	// the path
+	out, err := dispatch(k, "fs", "read", "notes.txt")
+	Tassert(t, err == nil, "Dispatch failed: %v", err)
+	Tassert(t, out == "child reader", "Expected child reader but got %q", out)
+	Tassert(t, reflect.DeepEqual(reader.rec.captures, []interface{}{"notes.txt"}), "Unexpected captures %#v", reader.rec.captures)
+
+	// deeper local matches come first, and the mount point's own
+	// modules last
+	local := fakeModule{name: "local", rec: &fakeRecord{}}
+	k.bindSyscall(local, promise, "fs", "read", "README")
+	top := fakeModule{name: "top", rec: &fakeRecord{}}
+	k.bindSyscall(top, promise, "fs")
+	out, err = dispatch(k, "fs", "read", "README")
+	Tassert(t, err == nil && out == "local", "Expected local but got %q, %v", out, err)
+	out, err = dispatch(k, "fs", "write", "README")
+	Tassert(t, err == nil && out == "top", "Expected top but got %q, %v", out, err)
+
+	// a failing mount is skipped, and its error reported
+	broken := errors.New("peer unreachable")
+	err = k.Mount([]interface{}{promise, "peer"}, MountFunc(func(ctx context.Context, path []interface{}) ([]Match, error) {
+		_, ok := MessageFromContext(ctx)
+		Tassert(t, ok, "Expected the message in the context")
+		return nil, broken
+	}))
+	Tassert(t, err == nil, "Failed to mount: %v", err)
+	_, err = dispatch(k, "peer", "x")
+	var nh *NoHandlerError
+	Tassert(t, errors.As(err, &nh), "Expected *NoHandlerError but got %v", err)
+	Tassert(t, len(nh.Declined) == 1 && nh.Declined[0] == broken, "Expected the mount error but got %v", nh.Declined)
+
+	// mounts in a loop stop at the depth limit
+	loop := NewKernel()
+	err = loop.Mount(nil, loop)
+	Tassert(t, err == nil, "Failed to mount: %v", err)
+	_, err = loop.Lookup(ctx, []interface{}{"x"})
+	Tassert(t, errors.Is(err, ErrMountDepth), "Expected ErrMountDepth but got %v", err)
+
+	// unmounting
+	err = k.Unmount([]interface{}{promise, "fs"})
+	Tassert(t, err == nil, "Failed to unmount: %v", err)
+	err = k.Unmount([]interface{}{promise, "fs"})
+	Tassert(t, errors.Is(err, ErrNotMounted), "Expected ErrNotMounted but got %v", err)
+	out, err = dispatch(k, "fs", "read", "notes.txt")
+	Tassert(t, err == nil && out == "top", "Expected top but got %q, %v", out, err)
+	err = k.Unmount([]interface{}{promise, "peer"})
+	Tassert(t, err == nil, "Failed to unmount: %v", err)
+	Tassert(t, len(k.findBestMatch(promise).Children) == 1, "Expected the peer node to be pruned")
+}
@@ -0,0 +1,264 @@
+package grid_cli
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/multiformats/go-multibase"
+	"github.com/multiformats/go-multihash"
+	. "github.com/stevegt/goadapt"
+)
+
+// Message parameters are typed.  Each parameter is one of:
+//
+//	string               text
+//	int64                a signed integer; other Go integer types are
+//	                     accepted and converted
+//	[]byte               opaque bytes
+//	multihash.Multihash  a reference to other content
+//
+// In the text encoding each parameter is one space-free token:
+//
+//	hello                a bare string
+//	"hello world\n"      a quoted string, using Go escapes
+//	#-42                 an integer
+//	&zJxF...             bytes, multibase encoded
+//	@zQmdd...            a multihash reference, multibase encoded
+//
+// A string is written bare unless it is empty, starts with one of the
+// sigils above or with '!', which marks path segments, or contains
+// whitespace, control characters, backslashes or invalid UTF-8; then
+// it is quoted.  Bare strings keep
+// older text messages such as testdata/hello.msg readable.
+//
+// In the binary encoding each parameter is a kind byte followed by a
+// length-prefixed value, or a zigzag varint for integers.
+
+// parameter kinds in the binary encoding
+const (
+	parmString byte = iota
+	parmInt
+	parmBytes
+	parmRef
+)
+
+// NormalizeParm converts p to one of the parameter types listed
+// above, or returns an error if it can't.
+func NormalizeParm(p interface{}) (out interface{}, err error) {
+	switch v := p.(type) {
+	case string, int64, []byte, multihash.Multihash:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case int8:
+		return int64(v), nil
+	case int16:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case uint8:
+		return int64(v), nil
+	case uint16:
+		return int64(v), nil
+	case uint32:
+		return int64(v), nil
+	case uint:
+		if uint64(v) > math.MaxInt64 {
+			break
+		}
+		return int64(v), nil
+	case uint64:
+		if v > math.MaxInt64 {
+			break
+		}
+		return int64(v), nil
+	}
+	return nil, fmt.Errorf("unsupported parameter type %T", p)
+}
+
+// EncodeParm returns the text token for a parameter.
+func EncodeParm(p interface{}) (token string, err error) {
+	defer Return(&err)
+	p, err = NormalizeParm(p)
+	Ck(err)
+	switch v := p.(type) {
+	case string:
+		if isBare(v) {
+			return v, nil
+		}
+		return strconv.Quote(v), nil
+	case int64:
+		return "#" + strconv.FormatInt(v, 10), nil
+	case []byte:
+		enc, err := multibase.Encode(multibase.Base58BTC, v)
+		Ck(err)
+		return "&" + enc, nil
+	case multihash.Multihash:
+		enc, err := multibase.Encode(multibase.Base58BTC, v)
+		Ck(err)
+		return "@" + enc, nil
+	}
+	panic("unreachable")
+}
+
+// DecodeParm parses a single text token.
+func DecodeParm(token string) (p interface{}, err error) {
+	defer Return(&err)
+	Assert(len(token) > 0, "empty parameter token")
+	switch token[0] {
+	case '"':
+		s, err := strconv.Unquote(token)
+		Ck(err)
+		return s, nil
+	case '#':
+		n, err := strconv.ParseInt(token[1:], 10, 64)
+		Ck(err)
+		return n, nil
+	case '&':
+		buf, err := decodeBytes(token[1:])
+		Ck(err)
+		return buf, nil
+	case '@':
+		_, buf, err := multibase.Decode(token[1:])
+		Ck(err)
+		mh, err := multihash.Cast(buf)
+		Ck(err)
+		return mh, nil
+	}
+	Assert(isBare(token), "invalid bare parameter %q", token)
+	return token, nil
+}
+
+// isBare reports whether s can be written without quotes.
+func isBare(s string) bool {
+	if len(s) == 0 || strings.ContainsRune(`"#&@!`, rune(s[0])) {
+		return false
+	}
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if r == '\\' || unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeParmsText encodes parameters as space-separated tokens.
+func encodeParmsText(parms []interface{}) (txt string, err error) {
+	tokens := make([]string, len(parms))
+	for i, p := range parms {
+		tokens[i], err = EncodeParm(p)
+		if err != nil {
+			return "", err
+		}
+	}
+	return strings.Join(tokens, " "), nil
+}
+
+// splitTokens splits a header line on spaces, keeping quoted
+// strings, which may contain escaped quotes, intact.
+func splitTokens(line string) (tokens []string, err error) {
+	i := 0
+	for i < len(line) {
+		if line[i] == ' ' || line[i] == '\t' {
+			i++
+			continue
+		}
+		start := i
+		if line[i] == '"' {
+			i++
+			for i < len(line) && line[i] != '"' {
+				if line[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= len(line) {
+				return nil, fmt.Errorf("unterminated quoted parameter: %s", line[start:])
+			}
+			i++
+			if i < len(line) && line[i] != ' ' && line[i] != '\t' {
+				return nil, fmt.Errorf("missing space after quoted parameter: %s", line[start:])
+			}
+		} else {
+			for i < len(line) && line[i] != ' ' && line[i] != '\t' {
+				i++
+			}
+		}
+		tokens = append(tokens, line[start:i])
+	}
+	return tokens, nil
+}
+
+// writeParm appends the binary encoding of a parameter to b.
+func writeParm(b *bytes.Buffer, p interface{}) (err error) {
+	p, err = NormalizeParm(p)
+	if err != nil {
+		return err
+	}
+	switch v := p.(type) {
+	case string:
+		b.WriteByte(parmString)
+		writeBytes(b, []byte(v))
+	case int64:
+		b.WriteByte(parmInt)
+		b.Write(binary.AppendVarint(nil, v))
+	case []byte:
+		b.WriteByte(parmBytes)
+		writeBytes(b, v)
+	case multihash.Multihash:
+		b.WriteByte(parmRef)
+		writeBytes(b, v)
+	}
+	return nil
+}
+
+// readParm reads one binary-encoded parameter.
+func readParm(r byteReader, max uint64) (p interface{}, err error) {
+	defer Return(&err)
+	kind, err := r.ReadByte()
+	Ck(err)
+	switch kind {
+	case parmString:
+		buf, err := readBytes(r, max)
+		Ck(err)
+		return string(buf), nil
+	case parmInt:
+		n, err := readVarint(r)
+		Ck(err)
+		return n, nil
+	case parmBytes:
+		buf, err := readBytes(r, max)
+		Ck(err)
+		return buf, nil
+	case parmRef:
+		buf, err := readBytes(r, max)
+		Ck(err)
+		mh, err := multihash.Cast(buf)
+		Ck(err)
+		return mh, nil
+	}
+	Assert(false, "unknown parameter kind %#x", kind)
+	return
+}
+
+// parmKey returns the key a parameter is stored under in a lookup
+// table.  Keys for different parameters never collide, so the string
+// "1" and the integer 1 are different keys.  Values that aren't
+// parameters fall back to their type and %v formatting; the space in
+// the fallback keeps it from colliding with any token.
+func parmKey(p interface{}) string {
+	token, err := EncodeParm(p)
+	if err != nil {
+		return fmt.Sprintf("!%T %v", p, p)
+	}
+	return token
+}
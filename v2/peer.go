@@ -0,0 +1,185 @@
+package grid_cli
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/multiformats/go-multihash"
+	"github.com/spf13/afero"
+	. "github.com/stevegt/goadapt"
+)
+
+// Grid nodes fetch content from each other by hash over a WebSocket,
+// as the v1 server does.  A query is a JSON object holding the hex of
+// the content's multihash and the promise the asker makes about its
+// use, which also says what kind of content is wanted.  The answer is
+// the raw content, or an empty frame if the peer doesn't have it.
+
+const (
+	// PromiseTextPromise is the promise made when fetching the text
+	// of a promise.
+	PromiseTextPromise = "I promise to use this promise text responsibly."
+	// BlockPromise is the promise made when fetching a block of a
+	// chunked payload.
+	BlockPromise = "I promise to use this block responsibly."
+	// PayloadRefPromise is the promise made when asking for content
+	// as a chunked payload.  The answer is a PayloadRef in text form,
+	// and the blocks it refers to are then fetched one at a time.
+	PayloadRefPromise = "I promise to fetch this content one block at a time."
+)
+
+// DefaultPeerTimeout bounds a query whose context has no deadline.
+const DefaultPeerTimeout = 10 * time.Second
+
+// ErrPeerMiss is returned when a peer doesn't have the content asked
+// for.
+var ErrPeerMiss = errors.New("peer doesn't have the content")
+
+// WebSocketPeer is a peer reached at a WebSocket address, such as
+// ws://example.com:8080/ws.  It connects on first use, and its
+// queries take turns on the one connection.
+type WebSocketPeer struct {
+	Address string
+
+	mu   sync.Mutex
+	conn *websocket.Conn
+}
+
+// NewWebSocketPeer returns a peer at address.
+func NewWebSocketPeer(address string) *WebSocketPeer {
+	return &WebSocketPeer{Address: address}
+}
+
+// Query asks the peer for the content with hash mh, making promise,
+// and returns it once it is checked against mh.
+func (p *WebSocketPeer) Query(ctx context.Context, mh multihash.Multihash, promise string) (data []byte, err error) {
+	data, err = p.ask(ctx, mh, promise)
+	if err != nil {
+		return nil, err
+	}
+	err = VerifyHash(mh, data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// ask sends a query and returns the answer unchecked.
+func (p *WebSocketPeer) ask(ctx context.Context, mh multihash.Multihash, promise string) (data []byte, err error) {
+	defer Return(&err)
+	query, err := json.Marshal(map[string]string{"hash": hex.EncodeToString(mh), "promise": promise})
+	Ck(err)
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(DefaultPeerTimeout)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		p.conn, _, err = websocket.DefaultDialer.DialContext(ctx, p.Address, nil)
+		Ck(err)
+	}
+	p.conn.SetWriteDeadline(deadline)
+	p.conn.SetReadDeadline(deadline)
+	err = p.conn.WriteMessage(websocket.TextMessage, query)
+	if err == nil {
+		_, data, err = p.conn.ReadMessage()
+	}
+	if err != nil {
+		// a late answer would be taken for the next query's
+		p.conn.Close()
+		p.conn = nil
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, ErrPeerMiss
+	}
+	return data, nil
+}
+
+// FetchPromise asks the peer for the text of the promise with hash
+// mh, making it a PromiseSource.
+func (p *WebSocketPeer) FetchPromise(mh multihash.Multihash) (txt string, err error) {
+	data, err := p.Query(context.Background(), mh, PromiseTextPromise)
+	if errors.Is(err, ErrPeerMiss) {
+		return "", ErrPromiseNotFound
+	}
+	return string(data), err
+}
+
+// FetchBlock asks the peer for the block with hash mh, making it a
+// BlockFetcher.
+func (p *WebSocketPeer) FetchBlock(ctx context.Context, mh multihash.Multihash) (data []byte, err error) {
+	data, err = p.Query(ctx, mh, BlockPromise)
+	if errors.Is(err, ErrPeerMiss) {
+		return nil, ErrBlockNotFound
+	}
+	return data, err
+}
+
+// FetchChunked asks the peer for the content with hash mh as a
+// chunked payload, and copies it to w as it reads it from the peer
+// one block at a time, keeping the blocks in store.  The content is
+// hashed on the way and checked against mh at the end, so memory use
+// doesn't grow with its size; w has had all of it by then, so it
+// should be somewhere the content can be thrown away from if the
+// check fails.  The returned ref lets the content be served on
+// without splitting it again.
+func (p *WebSocketPeer) FetchChunked(ctx context.Context, mh multihash.Multihash, store BlockStore, w io.Writer) (ref *PayloadRef, err error) {
+	defer Return(&err)
+	v, err := NewHashVerifier(mh)
+	Ck(err)
+	answer, err := p.ask(ctx, mh, PayloadRefPromise)
+	Ck(err)
+	ref = &PayloadRef{}
+	err = ref.UnmarshalText(answer)
+	Ck(err)
+	_, err = io.Copy(io.MultiWriter(w, v), NewPayloadReader(ctx, ref, store, p))
+	Ck(err)
+	err = v.Verify()
+	Ck(err)
+	return ref, nil
+}
+
+// Close closes the connection to the peer, if there is one.
+func (p *WebSocketPeer) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		return nil
+	}
+	err := p.conn.Close()
+	p.conn = nil
+	return err
+}
+
+// LoadPeers reads a peer list, one WebSocket address per line, as
+// kept in the grid directory for v1.  A missing file lists no peers.
+func LoadPeers(fs afero.Fs, fn string) (peers []*WebSocketPeer, err error) {
+	data, err := afero.ReadFile(fs, fn)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		address := strings.TrimSpace(scanner.Text())
+		if address != "" {
+			peers = append(peers, NewWebSocketPeer(address))
+		}
+	}
+	return peers, scanner.Err()
+}
@@ -0,0 +1,172 @@
+package grid_cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/multiformats/go-multibase"
+	"github.com/spf13/afero"
+	. "github.com/stevegt/goadapt"
+)
+
+// contentServer answers content queries from a map of hex hashes to
+// content, as the v1 server does, and records the promises made.
+type contentServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	content  map[string][]byte
+	promises []string
+}
+
+func newContentServer() *contentServer {
+	s := &contentServer{content: make(map[string][]byte)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var query map[string]string
+			json.Unmarshal(data, &query)
+			s.mu.Lock()
+			s.promises = append(s.promises, query["promise"])
+			answer := s.content[query["hash"]]
+			s.mu.Unlock()
+			conn.WriteMessage(websocket.BinaryMessage, answer)
+		}
+	}))
+	return s
+}
+
+// made returns the promises made in the queries so far.
+func (s *contentServer) made() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.promises...)
+}
+
+// address returns the server's WebSocket address.
+func (s *contentServer) address() string {
+	return "ws" + strings.TrimPrefix(s.URL, "http")
+}
+
+// TestWebSocketPeer tests querying a peer for content and promise
+// text.
+func TestWebSocketPeer(t *testing.T) {
+	ctx := context.Background()
+	server := newContentServer()
+	defer server.Close()
+	hello := mustSum(t, "I will say hello")
+	server.content[hex.EncodeToString(hello)] = []byte("I will say hello")
+	lie := mustSum(t, "I will lie")
+	server.content[hex.EncodeToString(lie)] = []byte("I will say hello")
+	peer := NewWebSocketPeer(server.address())
+	defer peer.Close()
+
+	txt, err := peer.FetchPromise(hello)
+	Tassert(t, err == nil && txt == "I will say hello", "Unexpected promise %q: %v", txt, err)
+	Tassert(t, server.made()[0] == PromiseTextPromise, "Unexpected promises made %q", server.made())
+	_, err = peer.FetchPromise(mustSum(t, "I will say goodbye"))
+	Tassert(t, errors.Is(err, ErrPromiseNotFound), "Expected ErrPromiseNotFound but got %v", err)
+	_, err = peer.Query(ctx, lie, PromiseTextPromise)
+	Tassert(t, err != nil && !errors.Is(err, ErrPeerMiss), "Expected a hash mismatch but got %v", err)
+	data, err := peer.Query(ctx, hello, PromiseTextPromise)
+	Tassert(t, err == nil && string(data) == "I will say hello", "Unexpected content %q: %v", data, err)
+
+	_, err = NewWebSocketPeer("ws://127.0.0.1:1/ws").FetchPromise(hello)
+	Tassert(t, err != nil, "Expected an error from an unreachable peer")
+}
+
+// TestCliPromisePeers tests that promise show asks the peers in the
+// peer list, and replaces a corrupt local entry.
+func TestCliPromisePeers(t *testing.T) {
+	var out bytes.Buffer
+	fs := afero.NewMemMapFs()
+	c := &cli{fs: fs, dir: "/home/.grid", out: &out}
+	server := newContentServer()
+	defer server.Close()
+	mh := mustSum(t, "I will say hello")
+	server.content[hex.EncodeToString(mh)] = []byte("I will say hello")
+	err := afero.WriteFile(fs, "/home/.grid/peers", []byte("ws://127.0.0.1:1/ws\n"+server.address()+"\n"), 0644)
+	Tassert(t, err == nil, "Failed to write peers: %v", err)
+	hashStr, err := multibase.Encode(multibase.Base58BTC, mh)
+	Tassert(t, err == nil, "Failed to encode: %v", err)
+
+	err = c.run([]string{"promise", "show", hashStr})
+	Tassert(t, err == nil && out.String() == "I will say hello\n", "Unexpected output %q: %v", out.String(), err)
+	fn := "/home/.grid/promises/" + hashStr
+	err = afero.WriteFile(fs, fn, []byte("I will say goodbye"), 0644)
+	Tassert(t, err == nil, "Failed to write: %v", err)
+	out.Reset()
+	err = c.run([]string{"promise", "show", hashStr})
+	Tassert(t, err == nil && out.String() == "I will say hello\n", "Unexpected output %q: %v", out.String(), err)
+	data, err := afero.ReadFile(fs, fn)
+	Tassert(t, err == nil && string(data) == "I will say hello", "Expected the entry replaced but got %q: %v", data, err)
+}
+
+// TestFetchChunked tests fetching content from a peer one block at a
+// time.
+func TestFetchChunked(t *testing.T) {
+	ctx := context.Background()
+	server := newContentServer()
+	defer server.Close()
+	fs := afero.NewMemMapFs()
+	blocks := NewFsBlockStore(fs, "/peer/blocks")
+	payload := bytes.Repeat([]byte("module "), ChunkSize/2)
+	ref, err := writePayload(blocks, bytes.NewReader(payload), 2)
+	Tassert(t, err == nil, "Failed to write payload: %v", err)
+	infos, err := afero.ReadDir(fs, "/peer/blocks")
+	Tassert(t, err == nil && len(infos) > 3, "Expected a tree of blocks: %v", err)
+	for _, info := range infos {
+		data, err := afero.ReadFile(fs, "/peer/blocks/"+info.Name())
+		Tassert(t, err == nil, "Failed to read block: %v", err)
+		server.content[info.Name()] = data
+		Tassert(t, len(data) <= ChunkSize+1, "Unexpected block size %d", len(data))
+	}
+	text, err := ref.MarshalText()
+	Tassert(t, err == nil, "Failed to marshal ref: %v", err)
+	var got PayloadRef
+	err = got.UnmarshalText(text)
+	Tassert(t, err == nil && bytes.Equal(got.Root, ref.Root) && got.Size == ref.Size, "Unexpected ref %v: %v", got, err)
+	module := mustSum(t, string(payload))
+	server.content[hex.EncodeToString(module)] = text
+	lie := mustSum(t, "another module")
+	server.content[hex.EncodeToString(lie)] = text
+	peer := NewWebSocketPeer(server.address())
+	defer peer.Close()
+
+	store := NewFsBlockStore(fs, "/local/blocks")
+	var buf bytes.Buffer
+	fetched, err := peer.FetchChunked(ctx, module, store, &buf)
+	Tassert(t, err == nil && bytes.Equal(buf.Bytes(), payload), "Unexpected content of %d bytes: %v", buf.Len(), err)
+	Tassert(t, reflect.DeepEqual(fetched, ref), "Expected ref %v but got %v", ref, fetched)
+	Tassert(t, store.HasPayload(ctx, ref), "Expected the blocks kept")
+	err = fs.Remove("/local/blocks/" + hex.EncodeToString(ref.Root))
+	Tassert(t, err == nil, "Failed to remove block: %v", err)
+	Tassert(t, !store.HasPayload(ctx, ref), "Expected a missing block noticed")
+	for _, promise := range server.made()[1:] {
+		Tassert(t, promise == BlockPromise, "Unexpected promise made %q", promise)
+	}
+	_, err = peer.FetchChunked(ctx, lie, store, io.Discard)
+	Tassert(t, err != nil, "Expected an error for content that doesn't match its hash")
+	_, err = peer.FetchBlock(ctx, mustSum(t, "no such block"))
+	Tassert(t, errors.Is(err, ErrBlockNotFound), "Expected ErrBlockNotFound but got %v", err)
+	_, err = peer.FetchChunked(ctx, mustSum(t, "no such module"), store, io.Discard)
+	Tassert(t, errors.Is(err, ErrPeerMiss), "Expected ErrPeerMiss but got %v", err)
+}
@@ -0,0 +1,221 @@
+package grid_cli
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/spf13/afero"
+	. "github.com/stevegt/goadapt"
+)
+
+// treeFile holds the saved syscall tree, relative to the grid
+// directory.
+const treeFile = "syscalls.json"
+
+// treeVersion is the version of the saved syscall tree format.
+// LoadTree refuses files with any other version.
+const treeVersion = 1
+
+// The syscall tree is saved as a list of bindings, each a path of
+// parameter tokens or segment keys, and the key of the module bound
+// there, which is the token for its hash:
+//
+//	{"version":1,"bindings":[{"path":["@zQm...","hello"],"module":"@zQm..."}]}
+//
+// Nodes with a policy other than the default also get an entry in
+// "policies", giving the path, the mode's name and the quorum.  Only
+// modules registered with the kernel can be saved.  A binding
+// loaded for a module that isn't registered is kept, unbound, and
+// saved again with the rest of the tree.
+
+type treeBinding struct {
+	Path   []string `json:"path"`
+	Module string   `json:"module"`
+}
+
+type treePolicy struct {
+	Path   []string `json:"path"`
+	Mode   string   `json:"mode"`
+	Quorum int      `json:"quorum,omitempty"`
+}
+
+type savedTree struct {
+	Version  int           `json:"version"`
+	Bindings []treeBinding `json:"bindings"`
+	Policies []treePolicy  `json:"policies,omitempty"`
+}
+
+// NewKernelFs returns a kernel that keeps its state in dir on fs,
+// with the syscall tree saved there by SaveTree reloaded.
+func NewKernelFs(fs afero.Fs, dir string) (k *Kernel, err error) {
+	k = NewKernel()
+	k.fs = fs
+	k.dir = dir
+	err = k.LoadTree()
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// SaveTree saves the syscall tree to the kernel's grid directory.
+// The file is replaced atomically, so a crash leaves either the old
+// tree or the new one.
+func (k *Kernel) SaveTree() (err error) {
+	defer Return(&err)
+	k.treeMu.Lock()
+	defer k.treeMu.Unlock()
+
+	saved := savedTree{Version: treeVersion, Bindings: []treeBinding{}}
+	var visit func(node *SyscallNode, path []string)
+	visit = func(node *SyscallNode, path []string) {
+		if node.Policy != nil {
+			saved.Policies = append(saved.Policies, treePolicy{
+				Path:   append([]string{}, path...),
+				Mode:   node.Policy.Mode.String(),
+				Quorum: node.Policy.Quorum,
+			})
+		}
+		for _, module := range node.Modules {
+			key, ok := k.moduleKeyLocked(module)
+			if !ok {
+				continue
+			}
+			saved.Bindings = append(saved.Bindings, treeBinding{
+				Path:   append([]string{}, path...),
+				Module: key,
+			})
+		}
+		children := make([]string, 0, len(node.Children))
+		for key := range node.Children {
+			_, err := parsePathKey(key)
+			Ck(err, "can't save syscall path element %q", key)
+			children = append(children, key)
+		}
+		sort.Strings(children)
+		for _, key := range children {
+			visit(node.Children[key], append(path, key))
+		}
+	}
+	visit(k.root.Load(), nil)
+
+	buf, err := json.MarshalIndent(saved, "", "  ")
+	Ck(err)
+	err = writeFileAtomic(k.fs, filepath.Join(k.dir, treeFile), buf, 0644)
+	Ck(err)
+	return nil
+}
+
+// LoadTree replaces the syscall tree with the one saved in the
+// kernel's grid directory.  A missing file loads an empty tree.
+func (k *Kernel) LoadTree() (err error) {
+	defer Return(&err)
+	fn := filepath.Join(k.dir, treeFile)
+	buf, err := afero.ReadFile(k.fs, fn)
+	if os.IsNotExist(err) {
+		buf, err = []byte(`{"version":1}`), nil
+	}
+	Ck(err)
+	var saved savedTree
+	err = json.Unmarshal(buf, &saved)
+	Ck(err, "%s", fn)
+	Assert(saved.Version == treeVersion, "%s: unsupported syscall tree version %d", fn, saved.Version)
+
+	k.treeMu.Lock()
+	defer k.treeMu.Unlock()
+	root := newSyscallNode()
+	for _, b := range saved.Bindings {
+		for _, key := range b.Path {
+			_, err := parsePathKey(key)
+			Ck(err, "%s", fn)
+		}
+		module, ok := k.modules[b.Module]
+		if !ok {
+			module = unloadedModule{key: b.Module}
+		}
+		node := makePath(root, b.Path)
+		node.Modules = append(node.Modules, module)
+	}
+	for _, p := range saved.Policies {
+		for _, key := range p.Path {
+			_, err := parsePathKey(key)
+			Ck(err, "%s", fn)
+		}
+		mode, err := ParsePolicyMode(p.Mode)
+		Ck(err, "%s", fn)
+		node := makePath(root, p.Path)
+		node.Policy = &Policy{Mode: mode, Quorum: p.Quorum}
+	}
+	k.root.Store(root)
+	return nil
+}
+
+// moduleKey returns the key m is registered under, or, for a
+// placeholder, the key of the module it stands in for.
+func (k *Kernel) moduleKey(m Module) (key string, ok bool) {
+	k.treeMu.Lock()
+	defer k.treeMu.Unlock()
+	return k.moduleKeyLocked(m)
+}
+
+// moduleKeyLocked is moduleKey for callers holding k.treeMu.
+func (k *Kernel) moduleKeyLocked(m Module) (key string, ok bool) {
+	if u, isUnloaded := m.(unloadedModule); isUnloaded {
+		return u.key, true
+	}
+	for key, registered := range k.modules {
+		if sameModule(registered, m) {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// makePath returns the node at the end of keys under root, creating
+// any missing nodes.  It is only for trees that aren't published
+// yet.
+func makePath(root *SyscallNode, keys []string) (node *SyscallNode) {
+	node = root
+	for _, key := range keys {
+		child, exists := node.Children[key]
+		if !exists {
+			child = newSyscallNode()
+			node.setChild(key, child)
+		}
+		node = child
+	}
+	return node
+}
+
+// writeFileAtomic writes data to a temporary file next to fn and
+// renames it into place.
+func writeFileAtomic(fs afero.Fs, fn string, data []byte, perm os.FileMode) (err error) {
+	dir := filepath.Dir(fn)
+	err = fs.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := afero.TempFile(fs, dir, filepath.Base(fn)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = fs.Chmod(tmp.Name(), perm)
+	}
+	if err == nil {
+		err = fs.Rename(tmp.Name(), fn)
+	}
+	if err != nil {
+		fs.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,74 @@
+package grid_cli
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spf13/afero"
+	. "github.com/stevegt/goadapt"
+)
+
+// TestTreeRoundTrip tests saving and reloading the syscall tree.
+func TestTreeRoundTrip(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	msg, err := NewMessage("I will say hello", "sha256", []interface{}{"hello", int64(2)}, "")
+	Tassert(t, err == nil, "Failed to create message: %v", err)
+	path, err := messagePath(msg)
+	Tassert(t, err == nil, "Failed to get path: %v", err)
+
+	register := func(k *Kernel) {
+		k.modules["@zmodA"] = fakeModule{name: "a"}
+		k.modules["@zmodB"] = fakeModule{name: "b"}
+	}
+	k, err := NewKernelFs(fs, "/grid")
+	Tassert(t, err == nil, "Failed to create kernel: %v", err)
+	register(k)
+	k.bindSyscall(fakeModule{name: "a"}, path...)
+	k.bindSyscall(fakeModule{name: "b"}, path[:2]...)
+	k.bindSyscall(fakeModule{name: "unregistered"}, path[:1]...)
+	err = k.SaveTree()
+	Tassert(t, err == nil, "Failed to save tree: %v", err)
+
+	// no temporary files are left behind
+	names, err := afero.ReadDir(fs, "/grid")
+	Tassert(t, err == nil, "Failed to read dir: %v", err)
+	Tassert(t, len(names) == 1 && names[0].Name() == treeFile, "Unexpected files %v", names)
+
+	// a kernel without module a keeps its binding for later
+	k2 := NewKernel()
+	k2.fs, k2.dir = fs, "/grid"
+	k2.modules["@zmodB"] = fakeModule{name: "b"}
+	err = k2.LoadTree()
+	Tassert(t, err == nil, "Failed to load tree: %v", err)
+	out, err := k2.Dispatch(context.Background(), msg)
+	Tassert(t, err == nil, "Dispatch failed: %v", err)
+	Tassert(t, string(out) == "b", "Expected b but got %q", out)
+	err = k2.SaveTree()
+	Tassert(t, err == nil, "Failed to save tree: %v", err)
+
+	k3 := NewKernel()
+	k3.fs, k3.dir = fs, "/grid"
+	register(k3)
+	err = k3.LoadTree()
+	Tassert(t, err == nil, "Failed to load tree: %v", err)
+	out, err = k3.Dispatch(context.Background(), msg)
+	Tassert(t, err == nil, "Dispatch failed: %v", err)
+	Tassert(t, string(out) == "a", "Expected a but got %q", out)
+	node := k3.findBestMatch(path[:2]...)
+	Tassert(t, len(node.Modules) == 1 && node.Modules[0] == fakeModule{name: "b"}, "Expected b but got %v", node.Modules)
+	node = k3.findBestMatch(path[:1]...)
+	Tassert(t, len(node.Modules) == 0, "Expected no modules but got %v", node.Modules)
+
+	// bad files are refused
+	for _, data := range []string{`{"version":2}`, `{"version":1`, `{"version":1,"bindings":[{"path":["hel lo"],"module":"x"}]}`} {
+		err = afero.WriteFile(fs, "/grid/"+treeFile, []byte(data), 0644)
+		Tassert(t, err == nil, "Failed to write tree: %v", err)
+		_, err = NewKernelFs(fs, "/grid")
+		Tassert(t, err != nil, "Expected an error loading %s", data)
+	}
+
+	// a missing file is an empty tree
+	k, err = NewKernelFs(afero.NewMemMapFs(), "/grid")
+	Tassert(t, err == nil, "Failed to create kernel: %v", err)
+	Tassert(t, len(k.root.Load().Children) == 0, "Expected an empty tree")
+}
@@ -0,0 +1,297 @@
+package grid_cli
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/multiformats/go-multihash"
+)
+
+// PolicyMode says how the modules bound to one syscall node share a
+// message.
+type PolicyMode int
+
+const (
+	// PolicyFirst offers the message to each module in turn, and
+	// the first that accepts it handles it.  This is the default.
+	PolicyFirst PolicyMode = iota
+	// PolicyFallback is PolicyFirst, except that if the handling
+	// module fails, the message goes on to the next module that
+	// accepts it, and then on to the parent nodes.
+	PolicyFallback
+	// PolicyBroadcast hands the message to every module that accepts
+	// it, at once, and merges the outputs of those that succeed.
+	PolicyBroadcast
+	// PolicyRace hands the message to every module that accepts it,
+	// at once, and takes the first output to come back; the others
+	// are cancelled.
+	PolicyRace
+	// PolicyQuorum hands the message to every module that accepts
+	// it, at once, and takes the first output that enough of them
+	// agree on byte for byte; the others are cancelled.
+	PolicyQuorum
+)
+
+var policyNames = []string{"first", "fallback", "broadcast", "race", "quorum"}
+
+func (mode PolicyMode) String() string {
+	if mode < 0 || int(mode) >= len(policyNames) {
+		return fmt.Sprintf("PolicyMode(%d)", int(mode))
+	}
+	return policyNames[mode]
+}
+
+// ParsePolicyMode returns the mode with the given name.
+func ParsePolicyMode(name string) (mode PolicyMode, err error) {
+	for i, n := range policyNames {
+		if n == name {
+			return PolicyMode(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown policy %q", name)
+}
+
+// Policy is the handler selection policy for a syscall node.
+type Policy struct {
+	Mode PolicyMode
+	// Quorum is how many modules must agree under PolicyQuorum;
+	// zero means a majority of those that accept the message.
+	Quorum int
+	// Merge combines the outputs under PolicyBroadcast, given in
+	// module order; nil concatenates them.  Merge is not saved by
+	// SaveTree.
+	Merge func(outs [][]byte) ([]byte, error)
+}
+
+// ErrNoQuorum is returned under PolicyQuorum when too few modules
+// agree.
+var ErrNoQuorum = errors.New("no quorum")
+
+// errAbandoned is recorded for a module whose answer was no longer
+// needed when it came back.
+var errAbandoned = errors.New("abandoned; another answer was taken")
+
+// Outcome is what one module did with a message.
+type Outcome struct {
+	Module Module
+	// Hash is the module's hash, or nil if it isn't registered.
+	Hash multihash.Multihash
+	// Accepted is whether the module's Accept returned no error.
+	Accepted bool
+	// Out and Err are what HandleMessage returned, or, for a
+	// module that declined, the error from Accept.
+	Out     []byte
+	Err     error
+	Elapsed time.Duration
+	// Fulfilled is set if Out went into the result.
+	Fulfilled bool
+}
+
+// Result is the outcome of a dispatch.
+type Result struct {
+	// Out is the merged output.
+	Out []byte
+	// Mode is the policy of the node that handled the message.
+	Mode PolicyMode
+	// Outcomes has one entry per module offered the message, in the
+	// order they were offered it.
+	Outcomes []Outcome
+}
+
+// Fulfilled returns the outcomes of the modules whose output went
+// into the result.
+func (r *Result) Fulfilled() (outcomes []Outcome) {
+	for _, o := range r.Outcomes {
+		if o.Fulfilled {
+			outcomes = append(outcomes, o)
+		}
+	}
+	return outcomes
+}
+
+// SetPolicy sets the policy of the node at path; nil restores the
+// default.  The path may contain Segments.
+func (k *Kernel) SetPolicy(path []interface{}, policy *Policy) error {
+	if policy != nil && (policy.Mode < PolicyFirst || policy.Mode > PolicyQuorum) {
+		return fmt.Errorf("unknown policy %v", policy.Mode)
+	}
+	return k.updateTree(path, func(node *SyscallNode) {
+		node.Policy = policy
+	})
+}
+
+// moduleHash returns the hash m is registered under, or, for a
+// placeholder, the hash of the module it stands in for.  It returns
+// nil for any other module.
+func (k *Kernel) moduleHash(m Module) multihash.Multihash {
+	key, ok := k.moduleKey(m)
+	if !ok {
+		return nil
+	}
+	p, err := DecodeParm(key)
+	if err != nil {
+		return nil
+	}
+	mh, _ := p.(multihash.Multihash)
+	return mh
+}
+
+// handle offers the message to the modules of one candidate under
+// its policy, recording their outcomes in res.  It returns done once
+// the message has been handled, successfully or not, and false if
+// Dispatch should go on to the next candidate.
+func (k *Kernel) handle(ctx context.Context, cand candidate, path []interface{}, res *Result) (done bool, err error) {
+	policy := cand.policy
+	if policy == nil {
+		policy = &Policy{Mode: PolicyFirst}
+	}
+	res.Mode = policy.Mode
+
+	var accepted []int // indexes into res.Outcomes
+	for _, module := range cand.modules {
+		_, err := module.Accept(ctx, path...)
+		res.Outcomes = append(res.Outcomes, Outcome{
+			Module:   module,
+			Hash:     k.moduleHash(module),
+			Accepted: err == nil,
+			Err:      err,
+		})
+		if err != nil {
+			continue
+		}
+		o := &res.Outcomes[len(res.Outcomes)-1]
+		switch policy.Mode {
+		case PolicyFirst, PolicyFallback:
+			call(ctx, o, path)
+			if o.Err == nil || policy.Mode == PolicyFirst {
+				o.Fulfilled = o.Err == nil
+				res.Out = o.Out
+				return true, o.Err
+			}
+		default:
+			accepted = append(accepted, len(res.Outcomes)-1)
+		}
+	}
+	if len(accepted) == 0 {
+		return false, nil
+	}
+
+	switch policy.Mode {
+	case PolicyBroadcast:
+		gather(ctx, res, accepted, path, nil)
+		var outs [][]byte
+		var errs []error
+		for _, i := range accepted {
+			o := &res.Outcomes[i]
+			if o.Err != nil {
+				errs = append(errs, o.Err)
+				continue
+			}
+			o.Fulfilled = true
+			outs = append(outs, o.Out)
+		}
+		if len(outs) == 0 {
+			return true, errors.Join(errs...)
+		}
+		if policy.Merge == nil {
+			res.Out = bytes.Join(outs, nil)
+			return true, nil
+		}
+		res.Out, err = policy.Merge(outs)
+		return true, err
+	case PolicyRace:
+		var errs []error
+		won := false
+		gather(ctx, res, accepted, path, func(i int) bool {
+			o := &res.Outcomes[i]
+			if o.Err != nil {
+				errs = append(errs, o.Err)
+				return false
+			}
+			o.Fulfilled = true
+			res.Out = o.Out
+			won = true
+			return true
+		})
+		if !won {
+			return true, errors.Join(errs...)
+		}
+		return true, nil
+	case PolicyQuorum:
+		need := policy.Quorum
+		if need <= 0 {
+			need = len(accepted)/2 + 1
+		}
+		votes := make(map[string][]int)
+		won := false
+		gather(ctx, res, accepted, path, func(i int) bool {
+			o := &res.Outcomes[i]
+			if o.Err != nil {
+				return false
+			}
+			key := string(o.Out)
+			votes[key] = append(votes[key], i)
+			if len(votes[key]) < need {
+				return false
+			}
+			for _, j := range votes[key] {
+				res.Outcomes[j].Fulfilled = true
+			}
+			res.Out = o.Out
+			won = true
+			return true
+		})
+		if !won {
+			return true, fmt.Errorf("%w: %d of %d modules needed to agree", ErrNoQuorum, need, len(accepted))
+		}
+		return true, nil
+	}
+	return true, fmt.Errorf("unknown policy %v", policy.Mode)
+}
+
+// call hands the message to the module of o and records the result.
+func call(ctx context.Context, o *Outcome, path []interface{}) {
+	start := time.Now()
+	o.Out, o.Err = o.Module.HandleMessage(ctx, path...)
+	o.Elapsed = time.Since(start)
+}
+
+// gather hands the message to the modules of the given outcomes at
+// once.  As each answer comes back it is recorded and passed to
+// enough, if not nil; once enough returns true the remaining modules
+// are cancelled and recorded as abandoned, without waiting for them.
+func gather(ctx context.Context, res *Result, indexes []int, path []interface{}, enough func(i int) bool) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type answer struct {
+		i int
+		o Outcome
+	}
+	answers := make(chan answer, len(indexes))
+	for _, i := range indexes {
+		// each goroutine works on its own copy, so abandoned
+		// modules can't race with the caller
+		go func(i int, o Outcome) {
+			call(ctx, &o, path)
+			answers <- answer{i, o}
+		}(i, res.Outcomes[i])
+	}
+	pending := make(map[int]bool)
+	for _, i := range indexes {
+		pending[i] = true
+	}
+	for range indexes {
+		a := <-answers
+		res.Outcomes[a.i] = a.o
+		delete(pending, a.i)
+		if enough != nil && enough(a.i) {
+			break
+		}
+	}
+	for i := range pending {
+		res.Outcomes[i].Err = errAbandoned
+	}
+}
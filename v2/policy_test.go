@@ -0,0 +1,125 @@
+package grid_cli
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/multiformats/go-multihash"
+	"github.com/spf13/afero"
+	. "github.com/stevegt/goadapt"
+)
+
+// TestPolicies tests each handler selection policy.
+func TestPolicies(t *testing.T) {
+	msg, err := NewMessage("I will answer", "sha256", []interface{}{"q"}, "")
+	Tassert(t, err == nil, "Failed to create message: %v", err)
+	path, err := messagePath(msg)
+	Tassert(t, err == nil, "Failed to get path: %v", err)
+	promise := path[0].(multihash.Multihash)
+	failed := errors.New("failed")
+
+	setup := func(policy *Policy, modules ...Module) *Kernel {
+		k := NewKernel()
+		k.bindSyscall(fakeModule{name: "parent"}, promise)
+		for _, m := range modules {
+			k.bindSyscall(m, path...)
+		}
+		err := k.SetPolicy(path, policy)
+		Tassert(t, err == nil, "Failed to set policy: %v", err)
+		return k
+	}
+	fulfilled := func(res *Result) (outs []string) {
+		for _, o := range res.Fulfilled() {
+			outs = append(outs, string(o.Out))
+		}
+		return outs
+	}
+	ctx := context.Background()
+	declines := fakeModule{name: "declines", decline: true}
+	fails := fakeModule{name: "fails", err: failed}
+
+	// first: the first module to accept handles the message, even if
+	// it fails
+	k := setup(nil, declines, fails, fakeModule{name: "ok"})
+	res, err := k.DispatchResult(ctx, msg)
+	Tassert(t, err == failed, "Expected failed but got %v", err)
+	Tassert(t, len(res.Outcomes) == 2, "Expected 2 outcomes but got %d", len(res.Outcomes))
+	Tassert(t, !res.Outcomes[0].Accepted && res.Outcomes[1].Accepted, "Unexpected outcomes %v", res.Outcomes)
+	Tassert(t, len(res.Fulfilled()) == 0, "Expected nothing fulfilled")
+
+	// fallback: failures go on to the next module, then the parent
+	k = setup(&Policy{Mode: PolicyFallback}, declines, fails, fakeModule{name: "ok"})
+	res, err = k.DispatchResult(ctx, msg)
+	Tassert(t, err == nil && string(res.Out) == "ok", "Expected ok but got %q, %v", res.Out, err)
+	Tassert(t, res.Mode == PolicyFallback, "Expected fallback but got %v", res.Mode)
+	Tassert(t, len(res.Outcomes) == 3, "Expected 3 outcomes but got %d", len(res.Outcomes))
+	Tassert(t, res.Outcomes[2].Fulfilled, "Expected the last module to fulfil")
+	k = setup(&Policy{Mode: PolicyFallback}, fails, fails)
+	out, err := k.Dispatch(ctx, msg)
+	Tassert(t, err == nil && string(out) == "parent", "Expected parent but got %q, %v", out, err)
+
+	// broadcast: every output is merged
+	k = setup(&Policy{Mode: PolicyBroadcast}, fakeModule{name: "a", delay: 20 * time.Millisecond}, fails, fakeModule{name: "b"}, declines)
+	res, err = k.DispatchResult(ctx, msg)
+	Tassert(t, err == nil && string(res.Out) == "ab", "Expected ab but got %q, %v", res.Out, err)
+	Tassert(t, len(res.Outcomes) == 4, "Expected 4 outcomes but got %d", len(res.Outcomes))
+	Tassert(t, res.Outcomes[1].Err == failed, "Expected the failure recorded but got %v", res.Outcomes[1].Err)
+	k = setup(&Policy{Mode: PolicyBroadcast, Merge: func(outs [][]byte) ([]byte, error) {
+		return bytes.Join(outs, []byte(",")), nil
+	}}, fakeModule{name: "a"}, fakeModule{name: "b"})
+	out, err = k.Dispatch(ctx, msg)
+	Tassert(t, err == nil && string(out) == "a,b", "Expected a,b but got %q, %v", out, err)
+	k = setup(&Policy{Mode: PolicyBroadcast}, fails, fails)
+	_, err = k.Dispatch(ctx, msg)
+	Tassert(t, errors.Is(err, failed), "Expected failed but got %v", err)
+
+	// race: the fastest answer wins and the rest are abandoned
+	slow := fakeModule{name: "slow", delay: 10 * time.Second}
+	k = setup(&Policy{Mode: PolicyRace}, slow, fails, fakeModule{name: "fast", delay: 10 * time.Millisecond})
+	start := time.Now()
+	res, err = k.DispatchResult(ctx, msg)
+	Tassert(t, err == nil && string(res.Out) == "fast", "Expected fast but got %q, %v", res.Out, err)
+	Tassert(t, time.Since(start) < 5*time.Second, "Waited for the slow module")
+	Tassert(t, res.Outcomes[0].Err == errAbandoned, "Expected slow to be abandoned but got %v", res.Outcomes[0].Err)
+	Tassert(t, res.Outcomes[1].Err == failed, "Expected the failure recorded but got %v", res.Outcomes[1].Err)
+	Tassert(t, res.Outcomes[2].Fulfilled && res.Outcomes[2].Elapsed > 0, "Expected fast to fulfil")
+
+	// quorum: the first output enough modules agree on wins
+	k = setup(&Policy{Mode: PolicyQuorum}, fakeModule{name: "x"}, fakeModule{name: "y"}, fakeModule{name: "x", delay: 10 * time.Millisecond})
+	res, err = k.DispatchResult(ctx, msg)
+	Tassert(t, err == nil && string(res.Out) == "x", "Expected x but got %q, %v", res.Out, err)
+	Tassert(t, len(fulfilled(res)) == 2, "Expected 2 agreeing modules but got %v", fulfilled(res))
+	k = setup(&Policy{Mode: PolicyQuorum}, fakeModule{name: "x"}, fakeModule{name: "y"}, fails)
+	_, err = k.Dispatch(ctx, msg)
+	Tassert(t, errors.Is(err, ErrNoQuorum), "Expected ErrNoQuorum but got %v", err)
+	k = setup(&Policy{Mode: PolicyQuorum, Quorum: 3}, fakeModule{name: "x"}, fakeModule{name: "x"}, fakeModule{name: "x"})
+	res, err = k.DispatchResult(ctx, msg)
+	Tassert(t, err == nil && len(fulfilled(res)) == 3, "Expected 3 agreeing modules but got %v, %v", fulfilled(res), err)
+
+	// outcomes name registered modules by hash
+	k = setup(nil)
+	mh, err := k.RegisterModule(fakeModule{name: "m"})
+	Tassert(t, err == nil, "Failed to register module: %v", err)
+	err = k.Bind(path, mh)
+	Tassert(t, err == nil, "Failed to bind: %v", err)
+	res, err = k.DispatchResult(ctx, msg)
+	Tassert(t, err == nil && len(res.Fulfilled()) == 1, "Dispatch failed: %v", err)
+	Tassert(t, string(res.Fulfilled()[0].Hash) == string(mh), "Expected the module hash")
+
+	// policies are saved with the tree
+	err = k.SetPolicy(path, &Policy{Mode: PolicyQuorum, Quorum: 2})
+	Tassert(t, err == nil, "Failed to set policy: %v", err)
+	k.fs, k.dir = afero.NewMemMapFs(), "/grid"
+	err = k.SaveTree()
+	Tassert(t, err == nil, "Failed to save tree: %v", err)
+	k2, err := NewKernelFs(k.fs, "/grid")
+	Tassert(t, err == nil, "Failed to load tree: %v", err)
+	node := k2.findBestMatch(path...)
+	Tassert(t, node.Policy != nil && node.Policy.Mode == PolicyQuorum && node.Policy.Quorum == 2, "Expected the policy but got %v", node.Policy)
+
+	err = k.SetPolicy(path, &Policy{Mode: 99})
+	Tassert(t, err != nil, "Expected an error for an unknown policy")
+}
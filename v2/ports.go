@@ -0,0 +1,532 @@
+package grid_cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/multiformats/go-multihash"
+)
+
+// Ports are message queues in the style of Mach, as described in
+// doc/321-mach.md and doc/322-ports.md.  A port is reached only
+// through rights, held in a port space and named there by a
+// PortName; each module has its own space, and so does the kernel.
+// A send right lets its holder queue messages on the port.  The
+// receive right lets its holder take them off the queue, and makes
+// it the port's owner: only it can destroy the port.  There is one
+// receive right per port.  A space names all its send rights to a
+// port with one name, and counts them: each send right it gets adds a
+// reference, and each it deallocates or moves away drops one.  Rights
+// move between spaces only inside messages, so a
+// module can talk only to the ports it has been given.
+//
+// Every module registered with the kernel gets three standard ports,
+// as described in doc/323-syscalls.md: stdin, on which the module
+// receives what the kernel sends it, and stdout and stderr, on which
+// the kernel receives what the module sends.
+
+// PortName names a right in a port space.  Names are only meaningful
+// in their own space; the same port usually has different names in
+// different spaces.  Zero is never a valid name.
+type PortName uint64
+
+// Right is a set of rights to a port.
+type Right int
+
+const (
+	// RightSend lets the holder send messages to the port.
+	RightSend Right = 1 << iota
+	// RightReceive lets the holder receive messages from the port
+	// and destroy it.
+	RightReceive
+)
+
+func (r Right) String() string {
+	switch r {
+	case 0:
+		return "none"
+	case RightSend:
+		return "send"
+	case RightReceive:
+		return "receive"
+	case RightSend | RightReceive:
+		return "send+receive"
+	}
+	return fmt.Sprintf("Right(%d)", int(r))
+}
+
+// Disposition says how a right is transferred in a message.
+type Disposition int
+
+const (
+	// CopySend gives a copy of the sender's send right.
+	CopySend Disposition = iota
+	// MoveSend gives the sender's send right away.
+	MoveSend
+	// MakeSend gives a send right made from the sender's receive
+	// right, which it keeps.
+	MakeSend
+	// MoveReceive gives the sender's receive right away, and with
+	// it the ownership of the port.
+	MoveReceive
+)
+
+// Transfer is a right to be carried by a message.
+type Transfer struct {
+	Name        PortName
+	Disposition Disposition
+}
+
+// DefaultQueueLimit is the number of messages a port queues when
+// Allocate is given no limit.
+const DefaultQueueLimit = 16
+
+var (
+	// ErrInvalidName is returned for a name that doesn't hold the
+	// right an operation needs.
+	ErrInvalidName = errors.New("invalid port name or missing right")
+	// ErrDeadPort is returned for a port that has been destroyed.
+	ErrDeadPort = errors.New("port destroyed")
+)
+
+// Received is a message taken off a port.
+type Received struct {
+	Msg *Message
+	// Rights names the rights the message carried, in the order they
+	// were transferred, as they are now named in the receiver's space.
+	Rights []PortName
+	// Carried is the right carried under each of Rights: RightSend
+	// or RightReceive.
+	Carried []Right
+}
+
+// port is a bounded message queue.
+type port struct {
+	mu    sync.Mutex
+	queue []delivery
+	limit int
+	dead  bool
+	// changed is closed and replaced whenever the queue changes or
+	// the port dies, waking anyone waiting on it
+	changed chan struct{}
+}
+
+// delivery is a queued message.
+type delivery struct {
+	msg    *Message
+	rights []carried
+}
+
+// carried is a right in flight.
+type carried struct {
+	port  *port
+	right Right
+}
+
+// signal wakes the waiters.  The caller holds p.mu.
+func (p *port) signal() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// put queues d, waiting for room if the queue is full.
+func (p *port) put(ctx context.Context, d delivery) error {
+	for {
+		p.mu.Lock()
+		if p.dead {
+			p.mu.Unlock()
+			return ErrDeadPort
+		}
+		if len(p.queue) < p.limit {
+			p.queue = append(p.queue, d)
+			p.signal()
+			p.mu.Unlock()
+			return nil
+		}
+		wait := p.changed
+		p.mu.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// get takes the first message off the queue, waiting for one if the
+// queue is empty.
+func (p *port) get(ctx context.Context) (d delivery, err error) {
+	for {
+		p.mu.Lock()
+		if p.dead {
+			p.mu.Unlock()
+			return delivery{}, ErrDeadPort
+		}
+		if len(p.queue) > 0 {
+			d = p.queue[0]
+			p.queue = p.queue[1:]
+			p.signal()
+			p.mu.Unlock()
+			return d, nil
+		}
+		wait := p.changed
+		p.mu.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return delivery{}, ctx.Err()
+		}
+	}
+}
+
+// destroy kills the port and drops its queue.  Ports whose receive
+// rights were queued can never be received from, so they are
+// destroyed too.
+func (p *port) destroy() {
+	p.mu.Lock()
+	if p.dead {
+		p.mu.Unlock()
+		return
+	}
+	p.dead = true
+	queue := p.queue
+	p.queue = nil
+	p.signal()
+	p.mu.Unlock()
+	for _, d := range queue {
+		destroyCarried(d.rights)
+	}
+}
+
+// destroyCarried destroys the ports whose receive rights are in
+// rights, which will never be delivered.
+func destroyCarried(rights []carried) {
+	for _, c := range rights {
+		if c.right&RightReceive != 0 {
+			c.port.destroy()
+		}
+	}
+}
+
+// PortSpace holds rights to ports.
+type PortSpace struct {
+	mu      sync.Mutex
+	last    PortName
+	entries map[PortName]*portEntry
+	names   map[*port]PortName
+}
+
+// portEntry is the rights a space holds to one port.
+type portEntry struct {
+	port   *port
+	rights Right
+	// sends counts the references to the send right
+	sends int
+}
+
+// NewPortSpace returns an empty port space.
+func NewPortSpace() *PortSpace {
+	return &PortSpace{
+		entries: make(map[PortName]*portEntry),
+		names:   make(map[*port]PortName),
+	}
+}
+
+// Allocate creates a port that queues up to limit messages, or
+// DefaultQueueLimit if limit is not positive, and returns the name
+// of the send and receive rights the space gets for it.
+func (s *PortSpace) Allocate(limit int) (name PortName) {
+	if limit <= 0 {
+		limit = DefaultQueueLimit
+	}
+	p := &port{limit: limit, changed: make(chan struct{})}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.insert(p, RightSend|RightReceive)
+}
+
+// insert adds rights to p, under the name the space already has for
+// p, if any.  A send right adds a reference.  The caller holds s.mu.
+func (s *PortSpace) insert(p *port, rights Right) (name PortName) {
+	name, ok := s.names[p]
+	if !ok {
+		s.last++
+		name = s.last
+		s.entries[name] = &portEntry{port: p}
+		s.names[p] = name
+	}
+	e := s.entries[name]
+	e.rights |= rights
+	if rights&RightSend != 0 {
+		e.sends++
+	}
+	return name
+}
+
+// remove drops the receive right, or one reference to the send
+// right, from the entry for name, and the entry once it holds no
+// rights.  The caller holds s.mu.
+func (s *PortSpace) remove(name PortName, right Right) {
+	e := s.entries[name]
+	if right == RightSend {
+		e.sends--
+		if e.sends > 0 {
+			return
+		}
+	}
+	e.rights &^= right
+	if e.rights == 0 {
+		s.drop(name)
+	}
+}
+
+// drop removes the entry for name.  The caller holds s.mu.
+func (s *PortSpace) drop(name PortName) {
+	delete(s.names, s.entries[name].port)
+	delete(s.entries, name)
+}
+
+// Rights returns the rights the space holds under name.
+func (s *PortSpace) Rights(name PortName) Right {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[name]
+	if !ok {
+		return 0
+	}
+	return e.rights
+}
+
+// Destroy destroys the port named by name, which must hold its
+// receive right, and drops the space's rights to it.  Messages still
+// queued on it are dropped, and senders get ErrDeadPort from then on.
+func (s *PortSpace) Destroy(name PortName) error {
+	s.mu.Lock()
+	e, ok := s.entries[name]
+	if !ok || e.rights&RightReceive == 0 {
+		s.mu.Unlock()
+		return ErrInvalidName
+	}
+	s.drop(name)
+	s.mu.Unlock()
+	e.port.destroy()
+	return nil
+}
+
+// Deallocate drops a reference to the send right named by name.
+func (s *PortSpace) Deallocate(name PortName) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[name]
+	if !ok || e.rights&RightSend == 0 {
+		return ErrInvalidName
+	}
+	s.remove(name, RightSend)
+	return nil
+}
+
+// Close destroys the ports the space holds receive rights for and
+// drops all its other rights.
+func (s *PortSpace) Close() {
+	s.mu.Lock()
+	entries := s.entries
+	s.entries = make(map[PortName]*portEntry)
+	s.names = make(map[*port]PortName)
+	s.mu.Unlock()
+	for _, e := range entries {
+		if e.rights&RightReceive != 0 {
+			e.port.destroy()
+		}
+	}
+}
+
+// Send queues msg on the port named by dest, which must hold a send
+// right, carrying the rights in transfers.  It waits while the queue
+// is full.  If the message can't be queued, the space keeps any
+// rights it was moving.
+func (s *PortSpace) Send(ctx context.Context, dest PortName, msg *Message, transfers ...Transfer) (err error) {
+	s.mu.Lock()
+	e, ok := s.entries[dest]
+	if !ok || e.rights&RightSend == 0 {
+		s.mu.Unlock()
+		return ErrInvalidName
+	}
+	rights, err := s.take(e.port, transfers)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	err = e.port.put(ctx, delivery{msg: msg, rights: rights})
+	if err != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for i, t := range transfers {
+			if t.Disposition == MoveSend || t.Disposition == MoveReceive {
+				s.insert(rights[i].port, rights[i].right)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// take checks and removes the rights in transfers for a message to
+// dest.  The caller holds s.mu.
+func (s *PortSpace) take(dest *port, transfers []Transfer) (rights []carried, err error) {
+	need := map[Disposition]Right{
+		CopySend:    RightSend,
+		MoveSend:    RightSend,
+		MakeSend:    RightReceive,
+		MoveReceive: RightReceive,
+	}
+	// what each name has left once the transfers before are taken,
+	// so a message can't move more rights than the space holds
+	left := make(map[PortName]*portEntry)
+	for _, t := range transfers {
+		right, known := need[t.Disposition]
+		if !known {
+			return nil, fmt.Errorf("unknown disposition %d", t.Disposition)
+		}
+		l, ok := left[t.Name]
+		if !ok {
+			e, ok := s.entries[t.Name]
+			if !ok {
+				return nil, fmt.Errorf("%w: %d", ErrInvalidName, t.Name)
+			}
+			l = &portEntry{port: e.port, rights: e.rights, sends: e.sends}
+			left[t.Name] = l
+		}
+		if l.rights&right == 0 {
+			return nil, fmt.Errorf("%w: %d", ErrInvalidName, t.Name)
+		}
+		switch t.Disposition {
+		case MoveSend:
+			l.sends--
+			if l.sends == 0 {
+				l.rights &^= RightSend
+			}
+		case MoveReceive:
+			if l.port == dest {
+				return nil, fmt.Errorf("can't send a port's receive right to itself")
+			}
+			l.rights &^= RightReceive
+		}
+	}
+	for _, t := range transfers {
+		p := left[t.Name].port
+		switch t.Disposition {
+		case CopySend, MakeSend:
+			rights = append(rights, carried{p, RightSend})
+		case MoveSend:
+			rights = append(rights, carried{p, RightSend})
+			s.remove(t.Name, RightSend)
+		case MoveReceive:
+			rights = append(rights, carried{p, RightReceive})
+			s.remove(t.Name, RightReceive)
+		}
+	}
+	return rights, nil
+}
+
+// Receive takes the next message off the port named by name, which
+// must hold its receive right, waiting for one if the queue is
+// empty.  The rights the message carries are added to the space.
+func (s *PortSpace) Receive(ctx context.Context, name PortName) (rcvd *Received, err error) {
+	s.mu.Lock()
+	e, ok := s.entries[name]
+	if !ok || e.rights&RightReceive == 0 {
+		s.mu.Unlock()
+		return nil, ErrInvalidName
+	}
+	p := e.port
+	s.mu.Unlock()
+	d, err := p.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rcvd = &Received{Msg: d.msg}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range d.rights {
+		rcvd.Rights = append(rcvd.Rights, s.insert(c.port, c.right))
+		rcvd.Carried = append(rcvd.Carried, c.right)
+	}
+	return rcvd, nil
+}
+
+// give moves or copies the right named by name straight into another
+// space, as if it had been sent and received in a message, and
+// returns its name there.
+func (s *PortSpace) give(name PortName, disposition Disposition, to *PortSpace) (toName PortName, err error) {
+	s.mu.Lock()
+	rights, err := s.take(nil, []Transfer{{name, disposition}})
+	s.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	to.mu.Lock()
+	defer to.mu.Unlock()
+	return to.insert(rights[0].port, rights[0].right), nil
+}
+
+// ModulePorts are a module's standard ports, named in its own port
+// space.
+type ModulePorts struct {
+	Space *PortSpace
+	// Stdin is the receive right for what the kernel sends the
+	// module.
+	Stdin PortName
+	// Stdout and Stderr are send rights for the module's output and
+	// for its errors and logs.
+	Stdout PortName
+	Stderr PortName
+}
+
+// PortUser is implemented by modules that want their standard ports.
+// RegisterModule calls SetPorts when it first registers the module.
+type PortUser interface {
+	SetPorts(ports *ModulePorts)
+}
+
+// stdPorts are a module's standard ports, with the names the kernel
+// has for its ends of them.
+type stdPorts struct {
+	module                *ModulePorts
+	stdin, stdout, stderr PortName
+}
+
+// newStdPorts allocates a module's standard ports.
+func (k *Kernel) newStdPorts() (std *stdPorts, err error) {
+	space := NewPortSpace()
+	std = &stdPorts{module: &ModulePorts{Space: space}}
+	std.module.Stdin = space.Allocate(0)
+	std.stdin, err = space.give(std.module.Stdin, MoveSend, k.space)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range []struct{ kernel, module *PortName }{
+		{&std.stdout, &std.module.Stdout},
+		{&std.stderr, &std.module.Stderr},
+	} {
+		*p.kernel = k.space.Allocate(0)
+		*p.module, err = k.space.give(*p.kernel, MoveSend, space)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return std, nil
+}
+
+// ModulePorts returns the standard ports of the registered module
+// with hash mh.
+func (k *Kernel) ModulePorts(mh multihash.Multihash) (ports *ModulePorts, err error) {
+	k.treeMu.Lock()
+	defer k.treeMu.Unlock()
+	std, ok := k.ports[parmKey(mh)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrModuleNotFound, parmKey(mh))
+	}
+	return std.module, nil
+}
@@ -0,0 +1,187 @@
+package grid_cli
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// TestPorts tests sending, receiving and transferring rights.
+func TestPorts(t *testing.T) {
+	ctx := context.Background()
+	a := NewPortSpace()
+	b := NewPortSpace()
+	msg, err := NewMessage("I will say hello", "sha256", []interface{}{"hello"}, "")
+	Tassert(t, err == nil, "Failed to create message: %v", err)
+
+	// b owns a service port; a gets a send right to it
+	service := b.Allocate(2)
+	Tassert(t, service != 0 && b.Rights(service) == RightSend|RightReceive, "Unexpected rights %v", b.Rights(service))
+	toService, err := b.give(service, MakeSend, a)
+	Tassert(t, err == nil, "Failed to give right: %v", err)
+	Tassert(t, a.Rights(toService) == RightSend, "Unexpected rights %v", a.Rights(toService))
+
+	// a sends a request carrying a reply port
+	reply := a.Allocate(0)
+	err = a.Send(ctx, toService, msg, Transfer{reply, MakeSend})
+	Tassert(t, err == nil, "Failed to send: %v", err)
+	err = a.Send(ctx, toService+100, msg)
+	Tassert(t, errors.Is(err, ErrInvalidName), "Expected ErrInvalidName but got %v", err)
+	_, err = a.Receive(ctx, toService)
+	Tassert(t, errors.Is(err, ErrInvalidName), "Expected ErrInvalidName but got %v", err)
+	rcvd, err := b.Receive(ctx, service)
+	Tassert(t, err == nil, "Failed to receive: %v", err)
+	Tassert(t, rcvd.Msg == msg && len(rcvd.Rights) == 1, "Unexpected message %#v", rcvd)
+	toReply := rcvd.Rights[0]
+	Tassert(t, b.Rights(toReply) == RightSend, "Unexpected rights %v", b.Rights(toReply))
+
+	// b answers, and moves its send right away with the answer
+	err = b.Send(ctx, toReply, msg, Transfer{toReply, MoveSend})
+	Tassert(t, err == nil, "Failed to send: %v", err)
+	Tassert(t, b.Rights(toReply) == 0, "Expected the send right to be gone")
+	rcvd, err = a.Receive(ctx, reply)
+	Tassert(t, err == nil, "Failed to receive: %v", err)
+	// the same port keeps its name in a space
+	Tassert(t, len(rcvd.Rights) == 1 && rcvd.Rights[0] == reply, "Unexpected rights %v", rcvd.Rights)
+	// and the send right it got back is a second reference
+	Tassert(t, rcvd.Carried[0] == RightSend, "Unexpected carried rights %v", rcvd.Carried)
+	err = a.Deallocate(reply)
+	Tassert(t, err == nil, "Failed to deallocate: %v", err)
+	Tassert(t, a.Rights(reply) == RightSend|RightReceive, "Expected one reference left but got %v", a.Rights(reply))
+
+	// the queue is bounded
+	for i := 0; i < 2; i++ {
+		err = a.Send(ctx, toService, msg)
+		Tassert(t, err == nil, "Failed to send: %v", err)
+	}
+	tctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	err = a.Send(tctx, toService, msg, Transfer{reply, MoveReceive})
+	cancel()
+	Tassert(t, errors.Is(err, context.DeadlineExceeded), "Expected a timeout but got %v", err)
+	Tassert(t, a.Rights(reply) == RightSend|RightReceive, "Expected the receive right back but got %v", a.Rights(reply))
+	done := make(chan error)
+	go func() {
+		done <- a.Send(ctx, toService, msg)
+	}()
+	_, err = b.Receive(ctx, service)
+	Tassert(t, err == nil, "Failed to receive: %v", err)
+	err = <-done
+	Tassert(t, err == nil, "Failed to send once there was room: %v", err)
+
+	// a port whose receive right is queued on a destroyed port dies
+	// with it
+	_, err = b.Receive(ctx, service)
+	Tassert(t, err == nil, "Failed to receive: %v", err)
+	err = a.Send(ctx, toService, msg, Transfer{reply, MoveReceive})
+	Tassert(t, err == nil, "Failed to send: %v", err)
+	Tassert(t, a.Rights(reply) == RightSend, "Expected only a send right but got %v", a.Rights(reply))
+	err = a.Destroy(toService)
+	Tassert(t, errors.Is(err, ErrInvalidName), "Expected ErrInvalidName but got %v", err)
+	err = b.Destroy(service)
+	Tassert(t, err == nil, "Failed to destroy: %v", err)
+	err = a.Send(ctx, toService, msg)
+	Tassert(t, errors.Is(err, ErrDeadPort), "Expected ErrDeadPort but got %v", err)
+	err = a.Send(ctx, reply, msg)
+	Tassert(t, errors.Is(err, ErrDeadPort), "Expected ErrDeadPort but got %v", err)
+
+	// a receiver waiting on a port sees it destroyed
+	p := b.Allocate(0)
+	go func() {
+		_, err := b.Receive(ctx, p)
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	b.Close()
+	err = <-done
+	Tassert(t, errors.Is(err, ErrDeadPort), "Expected ErrDeadPort but got %v", err)
+	Tassert(t, b.Rights(p) == 0, "Expected no rights after Close")
+
+	err = a.Deallocate(toService)
+	Tassert(t, err == nil, "Failed to deallocate: %v", err)
+	err = a.Deallocate(toService)
+	Tassert(t, errors.Is(err, ErrInvalidName), "Expected ErrInvalidName but got %v", err)
+	err = a.Send(ctx, reply, msg, Transfer{reply + 100, CopySend})
+	Tassert(t, errors.Is(err, ErrInvalidName), "Expected ErrInvalidName but got %v", err)
+	own := a.Allocate(0)
+	err = a.Send(ctx, own, msg, Transfer{own, MoveReceive})
+	Tassert(t, err != nil, "Expected an error sending a receive right to its own port")
+}
+
+// TestPortsOverdraw tests that one message can't move more rights
+// than the space holds.
+func TestPortsOverdraw(t *testing.T) {
+	ctx := context.Background()
+	a := NewPortSpace()
+	msg, err := NewMessage("I will say hello", "sha256", []interface{}{"hello"}, "")
+	Tassert(t, err == nil, "Failed to create message: %v", err)
+	dest := a.Allocate(1)
+	b := NewPortSpace()
+	p := b.Allocate(0)
+	toP, err := b.give(p, MakeSend, a)
+	Tassert(t, err == nil, "Failed to give right: %v", err)
+
+	// one send reference can't be moved twice
+	err = a.Send(ctx, dest, msg, Transfer{toP, MoveSend}, Transfer{toP, MoveSend})
+	Tassert(t, errors.Is(err, ErrInvalidName), "Expected ErrInvalidName but got %v", err)
+	Tassert(t, a.Rights(toP) == RightSend, "Expected the send right kept but got %v", a.Rights(toP))
+	err = a.Send(ctx, dest, msg, Transfer{toP, MoveSend}, Transfer{toP, CopySend})
+	Tassert(t, errors.Is(err, ErrInvalidName), "Expected ErrInvalidName but got %v", err)
+
+	// but two references can
+	_, err = b.give(p, MakeSend, a)
+	Tassert(t, err == nil, "Failed to give right: %v", err)
+	err = a.Send(ctx, dest, msg, Transfer{toP, MoveSend}, Transfer{toP, MoveSend})
+	Tassert(t, err == nil, "Failed to send: %v", err)
+	Tassert(t, a.Rights(toP) == 0, "Expected the send rights gone but got %v", a.Rights(toP))
+	rcvd, err := a.Receive(ctx, dest)
+	Tassert(t, err == nil && len(rcvd.Rights) == 2, "Unexpected message %#v: %v", rcvd, err)
+
+	// a receive right can only be moved once
+	own := a.Allocate(0)
+	err = a.Send(ctx, dest, msg, Transfer{own, MoveReceive}, Transfer{own, MoveReceive})
+	Tassert(t, errors.Is(err, ErrInvalidName), "Expected ErrInvalidName but got %v", err)
+	Tassert(t, a.Rights(own) == RightSend|RightReceive, "Expected the rights kept but got %v", a.Rights(own))
+	err = a.Send(ctx, dest, msg, Transfer{own, MoveReceive}, Transfer{own, MakeSend})
+	Tassert(t, errors.Is(err, ErrInvalidName), "Expected ErrInvalidName but got %v", err)
+}
+
+// TestModulePorts tests the standard ports of registered modules.
+func TestModulePorts(t *testing.T) {
+	ctx := context.Background()
+	k := NewKernel()
+	m := fakeModule{name: "ports", rec: &fakeRecord{}}
+	mh, err := k.RegisterModule(m)
+	Tassert(t, err == nil, "Failed to register module: %v", err)
+	_, err = k.RegisterModule(m)
+	Tassert(t, err == nil, "Failed to register module again: %v", err)
+	Tassert(t, len(m.rec.ports) == 1, "Expected SetPorts once but got %d calls", len(m.rec.ports))
+	ports, err := k.ModulePorts(mh)
+	Tassert(t, err == nil, "Failed to get ports: %v", err)
+	Tassert(t, ports == m.rec.ports[0], "Expected the ports given to the module")
+	Tassert(t, ports.Space.Rights(ports.Stdin) == RightReceive, "Unexpected stdin rights %v", ports.Space.Rights(ports.Stdin))
+	Tassert(t, ports.Space.Rights(ports.Stdout) == RightSend, "Unexpected stdout rights %v", ports.Space.Rights(ports.Stdout))
+	Tassert(t, ports.Space.Rights(ports.Stderr) == RightSend, "Unexpected stderr rights %v", ports.Space.Rights(ports.Stderr))
+
+	msg, err := NewMessage("I will say hello", "sha256", []interface{}{"hello"}, "")
+	Tassert(t, err == nil, "Failed to create message: %v", err)
+	std := k.ports[parmKey(mh)]
+	err = k.space.Send(ctx, std.stdin, msg)
+	Tassert(t, err == nil, "Failed to send to stdin: %v", err)
+	rcvd, err := ports.Space.Receive(ctx, ports.Stdin)
+	Tassert(t, err == nil && rcvd.Msg == msg, "Failed to receive on stdin: %v", err)
+	for _, out := range []struct{ module, kernel PortName }{
+		{ports.Stdout, std.stdout},
+		{ports.Stderr, std.stderr},
+	} {
+		err = ports.Space.Send(ctx, out.module, msg)
+		Tassert(t, err == nil, "Failed to send: %v", err)
+		rcvd, err = k.space.Receive(ctx, out.kernel)
+		Tassert(t, err == nil && rcvd.Msg == msg, "Failed to receive: %v", err)
+	}
+
+	_, err = k.ModulePorts(k.Modules()[0][:2])
+	Tassert(t, errors.Is(err, ErrModuleNotFound), "Expected ErrModuleNotFound but got %v", err)
+}
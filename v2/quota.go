@@ -0,0 +1,300 @@
+package grid_cli
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/multiformats/go-multibase"
+	"github.com/multiformats/go-multihash"
+	"github.com/spf13/afero"
+	. "github.com/stevegt/goadapt"
+)
+
+// Caches are kept within a CacheQuota by evicting their least
+// recently or least frequently used items.  An item is what a cache
+// stores and removes as a unit, such as a module file or a blob, and
+// may serve several entries.  Pinned items are never evicted, so a
+// cache can stay over its quota if too much of it is pinned.
+
+// EvictionPolicy says which items a cache evicts first.
+type EvictionPolicy int
+
+const (
+	// EvictLRU evicts the least recently used items first.
+	EvictLRU EvictionPolicy = iota
+	// EvictLFU evicts the least frequently used items first, and the
+	// least recently used among equally used ones.
+	EvictLFU
+)
+
+func (p EvictionPolicy) String() string {
+	switch p {
+	case EvictLRU:
+		return "lru"
+	case EvictLFU:
+		return "lfu"
+	}
+	return fmt.Sprintf("EvictionPolicy(%d)", int(p))
+}
+
+// ParseEvictionPolicy parses the name of an eviction policy.
+func ParseEvictionPolicy(s string) (EvictionPolicy, error) {
+	switch strings.ToLower(s) {
+	case "lru":
+		return EvictLRU, nil
+	case "lfu":
+		return EvictLFU, nil
+	}
+	return 0, fmt.Errorf("unknown eviction policy %q", s)
+}
+
+// CacheQuota limits the size of a cache.  A zero limit is no limit.
+type CacheQuota struct {
+	MaxBytes   int64
+	MaxEntries int
+	Policy     EvictionPolicy
+}
+
+// The config file keys read by ParseCacheQuota.
+const (
+	configMaxBytes   = "cache_max_bytes"
+	configMaxEntries = "cache_max_entries"
+	configEviction   = "cache_eviction"
+)
+
+// ParseCacheQuota reads a quota from the key=value lines of a grid
+// config file, such as
+//
+//	cache_max_bytes=1000000000
+//	cache_max_entries=10000
+//	cache_eviction=lfu
+//
+// Other lines are ignored, and missing keys leave no limit and the
+// LRU policy.
+func ParseCacheQuota(config []byte) (q CacheQuota, err error) {
+	defer Return(&err)
+	scanner := bufio.NewScanner(bytes.NewReader(config))
+	for scanner.Scan() {
+		key, val, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case configMaxBytes:
+			q.MaxBytes, err = strconv.ParseInt(val, 10, 64)
+			Ck(err, "%s", key)
+			Assert(q.MaxBytes >= 0, "negative %s", key)
+		case configMaxEntries:
+			q.MaxEntries, err = strconv.Atoi(val)
+			Ck(err, "%s", key)
+			Assert(q.MaxEntries >= 0, "negative %s", key)
+		case configEviction:
+			q.Policy, err = ParseEvictionPolicy(val)
+			Ck(err)
+		}
+	}
+	return q, scanner.Err()
+}
+
+// LoadCacheQuota reads a quota from the config file fn with
+// ParseCacheQuota.  A missing file sets no limits.
+func LoadCacheQuota(fs afero.Fs, fn string) (q CacheQuota, err error) {
+	config, err := afero.ReadFile(fs, fn)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return q, err
+	}
+	return ParseCacheQuota(config)
+}
+
+// CacheItem is an item of a cache, as seen by Victims.
+type CacheItem struct {
+	// Name identifies the item to the cache.
+	Name string
+	Size int64
+	// Entries is how many cache entries the item serves.
+	Entries  int
+	LastUsed time.Time
+	// Uses is how often the item has been read.
+	Uses   int64
+	Pinned bool
+}
+
+// CacheUsage sums up a cache's items.
+type CacheUsage struct {
+	Entries int
+	Bytes   int64
+	Items   int
+	// Pinned is how many of the items are pinned.
+	Pinned int
+}
+
+// Usage sums up items.
+func Usage(items []CacheItem) (u CacheUsage) {
+	for _, item := range items {
+		u.Entries += item.Entries
+		u.Bytes += item.Size
+		u.Items++
+		if item.Pinned {
+			u.Pinned++
+		}
+	}
+	return u
+}
+
+// Over reports whether u exceeds the quota.
+func (q CacheQuota) Over(u CacheUsage) bool {
+	return (q.MaxBytes > 0 && u.Bytes > q.MaxBytes) ||
+		(q.MaxEntries > 0 && u.Entries > q.MaxEntries)
+}
+
+// Victims returns the items to evict to bring the cache within the
+// quota, in the order the policy evicts them.
+func (q CacheQuota) Victims(items []CacheItem) (victims []CacheItem) {
+	u := Usage(items)
+	if !q.Over(u) {
+		return nil
+	}
+	var candidates []CacheItem
+	for _, item := range items {
+		if !item.Pinned {
+			candidates = append(candidates, item)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if q.Policy == EvictLFU && a.Uses != b.Uses {
+			return a.Uses < b.Uses
+		}
+		if !a.LastUsed.Equal(b.LastUsed) {
+			return a.LastUsed.Before(b.LastUsed)
+		}
+		return a.Name < b.Name
+	})
+	for _, item := range candidates {
+		if !q.Over(u) {
+			break
+		}
+		victims = append(victims, item)
+		u.Entries -= item.Entries
+		u.Bytes -= item.Size
+	}
+	return victims
+}
+
+// BlockDir is the subdirectory of a v1 cache directory that holds
+// the blocks of payloads split for peers; see FsBlockStore.
+const BlockDir = "blocks"
+
+// CacheFileItems returns the files directly in dir that are named by
+// the hex of a multihash, as grid v1 caches modules and data, each
+// serving one entry, followed by the blocks in dir's BlockDir, named
+// by their path relative to dir.  A file is pinned if its hash is in
+// the pin file pinFile.
+func CacheFileItems(fs afero.Fs, dir, pinFile string) (items []CacheItem, err error) {
+	defer Return(&err)
+	pins, err := LoadPins(fs, pinFile)
+	Ck(err)
+	pinned := make(map[string]bool)
+	for _, pin := range pins {
+		pinned[hex.EncodeToString(pin)] = true
+	}
+	for _, sub := range []string{"", BlockDir} {
+		infos, err := afero.ReadDir(fs, filepath.Join(dir, sub))
+		if os.IsNotExist(err) {
+			continue
+		}
+		Ck(err)
+		for _, info := range infos {
+			if info.IsDir() || !IsHashName(info.Name()) {
+				continue
+			}
+			items = append(items, CacheItem{
+				Name:     filepath.Join(sub, info.Name()),
+				Size:     info.Size(),
+				Entries:  1,
+				LastUsed: info.ModTime(),
+				Pinned:   pinned[info.Name()],
+			})
+		}
+	}
+	return items, nil
+}
+
+// LoadPins reads a pin file: one multibase-encoded multihash per
+// line.  A missing file has no pins.
+func LoadPins(fs afero.Fs, fn string) (pins []multihash.Multihash, err error) {
+	defer Return(&err)
+	data, err := afero.ReadFile(fs, fn)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	Ck(err)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		_, buf, err := multibase.Decode(line)
+		Ck(err, "%s", fn)
+		mh, err := multihash.Cast(buf)
+		Ck(err, "%s", fn)
+		pins = append(pins, mh)
+	}
+	return pins, nil
+}
+
+// SavePins writes a pin file read by LoadPins, replacing it
+// atomically.
+func SavePins(fs afero.Fs, fn string, pins []multihash.Multihash) (err error) {
+	defer Return(&err)
+	var b strings.Builder
+	for _, mh := range pins {
+		txt, err := multibase.Encode(multibase.Base58BTC, mh)
+		Ck(err)
+		b.WriteString(txt + "\n")
+	}
+	return writeFileAtomic(fs, fn, []byte(b.String()), 0644)
+}
+
+// PinHash adds mh to the pin file fn, and reports whether it was
+// already there.
+func PinHash(fs afero.Fs, fn string, mh multihash.Multihash) (pinned bool, err error) {
+	defer Return(&err)
+	pins, err := LoadPins(fs, fn)
+	Ck(err)
+	for _, pin := range pins {
+		if bytes.Equal(pin, mh) {
+			return true, nil
+		}
+	}
+	err = SavePins(fs, fn, append(pins, mh))
+	Ck(err)
+	return false, nil
+}
+
+// UnpinHash removes mh from the pin file fn, and reports whether it
+// was there.
+func UnpinHash(fs afero.Fs, fn string, mh multihash.Multihash) (found bool, err error) {
+	defer Return(&err)
+	pins, err := LoadPins(fs, fn)
+	Ck(err)
+	for i, pin := range pins {
+		if bytes.Equal(pin, mh) {
+			err = SavePins(fs, fn, append(pins[:i:i], pins[i+1:]...))
+			Ck(err)
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,247 @@
+package grid_cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/multiformats/go-multibase"
+	"github.com/multiformats/go-multihash"
+	"github.com/spf13/afero"
+	. "github.com/stevegt/goadapt"
+)
+
+// TestCacheQuota tests parsing quotas and choosing what to evict.
+func TestCacheQuota(t *testing.T) {
+	q, err := ParseCacheQuota([]byte("symbol_table_hash=abc\ncache_max_bytes=100\n cache_max_entries=3\ncache_eviction=LFU\n"))
+	Tassert(t, err == nil, "Failed to parse quota: %v", err)
+	Tassert(t, q == CacheQuota{MaxBytes: 100, MaxEntries: 3, Policy: EvictLFU}, "Unexpected quota %#v", q)
+	q, err = ParseCacheQuota(nil)
+	Tassert(t, err == nil && q == CacheQuota{}, "Expected no quota but got %#v: %v", q, err)
+	for _, bad := range []string{"cache_max_bytes=lots", "cache_max_entries=-1", "cache_eviction=fifo"} {
+		_, err = ParseCacheQuota([]byte(bad))
+		Tassert(t, err != nil, "Expected an error for %q", bad)
+	}
+
+	t0 := time.Unix(1000, 0)
+	items := []CacheItem{
+		{Name: "old", Size: 40, Entries: 1, LastUsed: t0, Uses: 5},
+		{Name: "pinned", Size: 40, Entries: 1, LastUsed: t0.Add(-time.Hour), Pinned: true},
+		{Name: "new", Size: 40, Entries: 2, LastUsed: t0.Add(2 * time.Second), Uses: 1},
+		{Name: "mid", Size: 40, Entries: 1, LastUsed: t0.Add(time.Second), Uses: 9},
+	}
+	u := Usage(items)
+	Tassert(t, u == CacheUsage{Entries: 5, Bytes: 160, Items: 4, Pinned: 1}, "Unexpected usage %#v", u)
+	names := func(victims []CacheItem) string {
+		var ns []string
+		for _, v := range victims {
+			ns = append(ns, v.Name)
+		}
+		return strings.Join(ns, " ")
+	}
+	for _, c := range []struct {
+		q    CacheQuota
+		want string
+	}{
+		{CacheQuota{}, ""},
+		{CacheQuota{MaxBytes: 160}, ""},
+		{CacheQuota{MaxBytes: 100}, "old mid"},
+		{CacheQuota{MaxBytes: 100, Policy: EvictLFU}, "new old"},
+		{CacheQuota{MaxEntries: 4}, "old"},
+		{CacheQuota{MaxEntries: 3, Policy: EvictLFU}, "new"},
+		{CacheQuota{MaxBytes: 1}, "old mid new"},
+	} {
+		got := names(c.q.Victims(items))
+		Tassert(t, got == c.want, "Expected victims %q for %#v but got %q", c.want, c.q, got)
+	}
+
+	fs := afero.NewMemMapFs()
+	pins, err := LoadPins(fs, "/pins")
+	Tassert(t, err == nil && pins == nil, "Expected no pins: %v", err)
+	a, err := Sum(multihash.SHA2_256, []byte("a"))
+	Tassert(t, err == nil, "Failed to hash: %v", err)
+	b, err := Sum(multihash.SHA2_256, []byte("b"))
+	Tassert(t, err == nil, "Failed to hash: %v", err)
+	for _, mh := range []multihash.Multihash{a, b, a} {
+		_, err = PinHash(fs, "/pins", mh)
+		Tassert(t, err == nil, "Failed to pin: %v", err)
+	}
+	pins, err = LoadPins(fs, "/pins")
+	Tassert(t, err == nil && len(pins) == 2 && bytes.Equal(pins[1], b), "Unexpected pins %v: %v", pins, err)
+	found, err := UnpinHash(fs, "/pins", a)
+	Tassert(t, err == nil && found, "Failed to unpin: %v", err)
+	found, err = UnpinHash(fs, "/pins", a)
+	Tassert(t, err == nil && !found, "Expected a to be unpinned: %v", err)
+	pins, err = LoadPins(fs, "/pins")
+	Tassert(t, err == nil && len(pins) == 1 && bytes.Equal(pins[0], b), "Unexpected pins %v: %v", pins, err)
+}
+
+// TestCacheEviction tests keeping a LocalCacheModule within its
+// quota while it is being read.
+func TestCacheEviction(t *testing.T) {
+	ctx := context.Background()
+	fs := afero.NewMemMapFs()
+	cache := NewLocalCacheModule(fs, "/grid/cache")
+	promise, err := Sum(multihash.SHA2_256, []byte("I will say hello"))
+	Tassert(t, err == nil, "Failed to hash: %v", err)
+	module, err := Sum(multihash.SHA2_256, []byte("hello module"))
+	Tassert(t, err == nil, "Failed to hash: %v", err)
+	other, err := Sum(multihash.SHA2_256, []byte("other module"))
+	Tassert(t, err == nil, "Failed to hash: %v", err)
+	key := func(mh multihash.Multihash, arg string) []interface{} {
+		return []interface{}{promise, mh, arg}
+	}
+	cached := func(k []interface{}) bool {
+		_, err := cache.Accept(ctx, k...)
+		return err == nil
+	}
+
+	cache.SetQuota(CacheQuota{MaxEntries: 3})
+	for _, arg := range []string{"a", "b", "c"} {
+		err = cache.Put([]byte("completion "+arg), key(module, arg)...)
+		Tassert(t, err == nil, "Failed to put: %v", err)
+	}
+	// reading a makes b the least recently used
+	_, err = cache.HandleMessage(ctx, key(module, "a")...)
+	Tassert(t, err == nil, "Failed to read: %v", err)
+	err = cache.Put([]byte("completion d"), key(module, "d")...)
+	Tassert(t, err == nil, "Failed to put: %v", err)
+	Tassert(t, !cached(key(module, "b")), "Expected b to be evicted")
+	for _, arg := range []string{"a", "c", "d"} {
+		Tassert(t, cached(key(module, arg)), "Expected %s to be cached", arg)
+	}
+	_, err = fs.Stat(cache.blobPath(mustSum(t, "completion b")))
+	Tassert(t, err != nil, "Expected b's blob to be removed")
+
+	// pinning a module protects its completions, pinning a blob
+	// protects every key that refers to it
+	_, err = PinHash(fs, cache.PinFile(), module)
+	Tassert(t, err == nil, "Failed to pin: %v", err)
+	err = cache.Put([]byte("completion a"), key(other, "a")...)
+	Tassert(t, err == nil, "Failed to put: %v", err)
+	u, err := cache.Usage()
+	Tassert(t, err == nil, "Failed to get usage: %v", err)
+	Tassert(t, u == CacheUsage{Entries: 4, Bytes: 36, Items: 3, Pinned: 3}, "Unexpected usage %#v", u)
+	_, err = UnpinHash(fs, cache.PinFile(), module)
+	Tassert(t, err == nil, "Failed to unpin: %v", err)
+	_, err = PinHash(fs, cache.PinFile(), mustSum(t, "completion d"))
+	Tassert(t, err == nil, "Failed to pin: %v", err)
+	_, err = cache.HandleMessage(ctx, key(module, "c")...)
+	Tassert(t, err == nil, "Failed to read: %v", err)
+	victims, err := cache.Evict()
+	Tassert(t, err == nil, "Failed to evict: %v", err)
+	Tassert(t, len(victims) == 1 && victims[0].Entries == 2, "Unexpected victims %#v", victims)
+	Tassert(t, !cached(key(module, "a")) && !cached(key(other, "a")), "Expected both keys of a's blob to go")
+
+	// the index left by eviction persists
+	reloaded := NewLocalCacheModule(fs, "/grid/cache")
+	_, err = reloaded.Accept(ctx, key(module, "a")...)
+	Tassert(t, errors.Is(err, ErrCacheMiss), "Expected a to stay evicted but got %v", err)
+	u, err = reloaded.Usage()
+	Tassert(t, err == nil && u.Entries == 2 && u.Pinned == 1, "Unexpected usage %#v: %v", u, err)
+
+	// readers see a completion or a miss, never a broken entry
+	cache.SetQuota(CacheQuota{MaxBytes: 200, Policy: EvictLFU})
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				arg := fmt.Sprintf("%d", (i+j)%20)
+				out, err := cache.HandleMessage(ctx, key(module, arg)...)
+				if errors.Is(err, ErrCacheMiss) {
+					continue
+				}
+				if err != nil || string(out) != "completion "+arg {
+					errs <- fmt.Errorf("read %q: %q, %v", arg, out, err)
+					return
+				}
+			}
+		}(i)
+	}
+	for j := 0; j < 20; j++ {
+		arg := fmt.Sprintf("%d", j)
+		err = cache.Put([]byte("completion "+arg), key(module, arg)...)
+		Tassert(t, err == nil, "Failed to put: %v", err)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	u, err = cache.Usage()
+	Tassert(t, err == nil && u.Bytes <= 200, "Expected the cache within quota but got %#v: %v", u, err)
+}
+
+// TestCliCache tests the cache subcommand.
+func TestCliCache(t *testing.T) {
+	var out bytes.Buffer
+	fs := afero.NewMemMapFs()
+	c := &cli{fs: fs, dir: "/home/.grid", out: &out}
+	err := afero.WriteFile(fs, "/home/.grid/config", []byte("cache_max_bytes=1000\ncache_eviction=lfu\n"), 0644)
+	Tassert(t, err == nil, "Failed to write config: %v", err)
+	cache := NewLocalCacheModule(fs, "/home/.grid/cache")
+	promise := mustSum(t, "I will say hello")
+	module := mustSum(t, "hello module")
+	err = cache.Put([]byte("world"), promise, module, "hello")
+	Tassert(t, err == nil, "Failed to put: %v", err)
+
+	hashStr, err := multibase.Encode(multibase.Base58BTC, module)
+	Tassert(t, err == nil, "Failed to encode: %v", err)
+	err = c.run([]string{"cache", "pin", hashStr})
+	Tassert(t, err == nil, "Failed to pin: %v", err)
+	err = c.run([]string{"cache", "pin"})
+	Tassert(t, err == nil && out.String() == hashStr+"\n", "Unexpected pins %q: %v", out.String(), err)
+
+	out.Reset()
+	err = c.run([]string{"cache", "usage"})
+	Tassert(t, err == nil, "Failed to show usage: %v", err)
+	want := "entries: 1\nbytes:   5\nblobs:   1, 1 pinned\nfiles:   0, 0 pinned\nquota:   1000 bytes, unlimited entries, lfu eviction\n"
+	Tassert(t, out.String() == want, "Expected %q but got %q", want, out.String())
+
+	// v1's files count too, and share the pins
+	v1file := "/home/.grid/cache/" + hex.EncodeToString(module)
+	err = afero.WriteFile(fs, v1file, []byte("hello module"), 0755)
+	Tassert(t, err == nil, "Failed to write: %v", err)
+	out.Reset()
+	err = c.run([]string{"cache", "usage"})
+	Tassert(t, err == nil, "Failed to show usage: %v", err)
+	want = "entries: 2\nbytes:   17\nblobs:   1, 1 pinned\nfiles:   1, 1 pinned\nquota:   1000 bytes, unlimited entries, lfu eviction\n"
+	Tassert(t, out.String() == want, "Expected %q but got %q", want, out.String())
+
+	// so do the blocks v1 splits payloads into, enough of them to go
+	// over the quota
+	store := NewFsBlockStore(fs, "/home/.grid/cache/"+BlockDir)
+	block, err := store.PutBlock(bytes.Repeat([]byte{blockLeaf}, 1000))
+	Tassert(t, err == nil, "Failed to put block: %v", err)
+	out.Reset()
+	err = c.run([]string{"cache", "usage"})
+	Tassert(t, err == nil, "Failed to show usage: %v", err)
+	want = "entries: 3\nbytes:   1017\nblobs:   1, 1 pinned\nfiles:   2, 1 pinned\nquota:   1000 bytes, unlimited entries, lfu eviction\n"
+	Tassert(t, out.String() == want, "Expected %q but got %q", want, out.String())
+	files, err := CacheFileItems(fs, "/home/.grid/cache", cache.PinFile())
+	Tassert(t, err == nil, "Failed to list files: %v", err)
+	victims := CacheQuota{MaxBytes: 1000}.Victims(files)
+	name := BlockDir + "/" + hex.EncodeToString(block)
+	Tassert(t, len(victims) == 1 && victims[0].Name == name, "Expected the block evicted but got %v", victims)
+
+	// the cache the CLI builds keeps the quota
+	local, err := c.localCache()
+	Tassert(t, err == nil, "Failed to open cache: %v", err)
+	Tassert(t, local.Quota() == CacheQuota{MaxBytes: 1000, Policy: EvictLFU}, "Unexpected quota %#v", local.Quota())
+
+	err = c.run([]string{"cache", "unpin", hashStr})
+	Tassert(t, err == nil, "Failed to unpin: %v", err)
+	err = c.run([]string{"cache", "unpin", hashStr})
+	Tassert(t, err != nil, "Expected an error unpinning twice")
+	err = c.run([]string{"cache", "pin", "not a hash"})
+	Tassert(t, err != nil, "Expected an error for an invalid hash")
+}
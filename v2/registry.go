@@ -0,0 +1,262 @@
+package grid_cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/multiformats/go-multihash"
+	. "github.com/stevegt/goadapt"
+)
+
+// Modules are identified by the hash of their manifest, so the same
+// module gets the same hash on every node, and a saved syscall tree
+// can name the modules bound in it.  A module must be registered
+// with RegisterModule before it can be bound to a syscall path.
+
+// Manifester is implemented by modules that can be registered.  The
+// manifest is the module's code, or a description that pins it down
+// as precisely, such as the hash of its code and its configuration.
+type Manifester interface {
+	Manifest() ([]byte, error)
+}
+
+var (
+	// ErrModuleNotFound is returned for a module hash that isn't
+	// registered.
+	ErrModuleNotFound = errors.New("module not registered")
+	// ErrNotBound is returned by Unbind for a module that isn't
+	// bound to the path.
+	ErrNotBound = errors.New("module not bound to path")
+)
+
+// unloadedModule stands in for a module named by a saved binding
+// that hasn't been registered yet.  It declines every message.
+type unloadedModule struct {
+	key string
+}
+
+func (m unloadedModule) Accept(ctx context.Context, parms ...interface{}) (Message, error) {
+	return Message{}, fmt.Errorf("%w: %s", ErrModuleNotFound, m.key)
+}
+
+func (m unloadedModule) HandleMessage(ctx context.Context, parms ...interface{}) ([]byte, error) {
+	return nil, fmt.Errorf("%w: %s", ErrModuleNotFound, m.key)
+}
+
+// sameModule reports whether a and b are the same module.  Modules
+// of a type that can't be compared with == are compared by value, so
+// that comparing them doesn't panic.
+func sameModule(a, b Module) bool {
+	ta := reflect.TypeOf(a)
+	if ta != reflect.TypeOf(b) {
+		return false
+	}
+	if ta == nil || ta.Comparable() {
+		return a == b
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// Binding is a module bound to a syscall path.
+type Binding struct {
+	Path   []interface{}
+	Module multihash.Multihash
+}
+
+// RegisterModule makes m known to the kernel and returns its hash,
+// the sha2-256 hash of its manifest.  m must implement Manifester.
+// The first time m is registered it is given its standard ports; see
+// ports.go.  Saved bindings for m that were waiting for it to be
+// registered are bound to it.  Registering a module again is
+// harmless, but registering a different module with the same hash is
+// an error.
+func (k *Kernel) RegisterModule(m Module) (mh multihash.Multihash, err error) {
+	defer Return(&err)
+	mf, ok := m.(Manifester)
+	Assert(ok, "module %T has no manifest", m)
+	manifest, err := mf.Manifest()
+	Ck(err)
+	mh, err = Sum(multihash.SHA2_256, manifest)
+	Ck(err)
+	key := parmKey(mh)
+
+	k.treeMu.Lock()
+	old, exists := k.modules[key]
+	if exists && !sameModule(old, m) {
+		k.treeMu.Unlock()
+		return nil, fmt.Errorf("a different module is registered as %s", key)
+	}
+	var std *stdPorts
+	if !exists {
+		std, err = k.newStdPorts()
+		if err != nil {
+			k.treeMu.Unlock()
+			return nil, err
+		}
+		k.ports[key] = std
+	}
+	k.modules[key] = m
+	k.treeMu.Unlock()
+	if pu, ok := m.(PortUser); ok && std != nil {
+		pu.SetPorts(std.module)
+	}
+
+	// swap m in for the placeholders of saved bindings
+	placeholder := unloadedModule{key: key}
+	var waiting [][]string
+	var visit func(node *SyscallNode, keys []string)
+	visit = func(node *SyscallNode, keys []string) {
+		for _, bound := range node.Modules {
+			if bound == Module(placeholder) {
+				waiting = append(waiting, append([]string{}, keys...))
+				break
+			}
+		}
+		for key, child := range node.Children {
+			visit(child, append(keys, key))
+		}
+	}
+	visit(k.root.Load(), nil)
+	for _, keys := range waiting {
+		path, err := parsePath(keys)
+		Ck(err)
+		err = k.updateTree(path, func(node *SyscallNode) {
+			for i, bound := range node.Modules {
+				if bound == Module(placeholder) {
+					node.Modules[i] = m
+				}
+			}
+		})
+		Ck(err)
+	}
+	return mh, nil
+}
+
+// Bind binds the registered module with hash mh to path.  The path
+// is made of parameters and Segments, and usually starts with a
+// promise hash; see Dispatch.  Binding a module to a path it is
+// already bound to does nothing.
+func (k *Kernel) Bind(path []interface{}, mh multihash.Multihash) (err error) {
+	defer Return(&err)
+	m, err := k.module(mh)
+	Ck(err)
+	for _, p := range path {
+		if _, ok := p.(Segment); ok {
+			continue
+		}
+		_, err := NormalizeParm(p)
+		Ck(err)
+	}
+	err = k.updateTree(path, func(node *SyscallNode) {
+		for _, bound := range node.Modules {
+			if sameModule(bound, m) {
+				return
+			}
+		}
+		node.Modules = append(node.Modules, m)
+	})
+	Ck(err)
+	return nil
+}
+
+// Unbind removes the registered module with hash mh from path.
+func (k *Kernel) Unbind(path []interface{}, mh multihash.Multihash) (err error) {
+	defer Return(&err)
+	m, err := k.module(mh)
+	Ck(err)
+	if !k.unbindSyscall(m, path...) {
+		return ErrNotBound
+	}
+	return nil
+}
+
+// Modules returns the hashes of the registered modules, sorted.
+func (k *Kernel) Modules() (hashes []multihash.Multihash) {
+	k.treeMu.Lock()
+	defer k.treeMu.Unlock()
+	keys := make([]string, 0, len(k.modules))
+	for key := range k.modules {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		p, err := DecodeParm(key)
+		if err != nil {
+			continue
+		}
+		hashes = append(hashes, p.(multihash.Multihash))
+	}
+	return hashes
+}
+
+// Bindings returns every binding in the syscall tree of a module
+// that is registered, or that is named by a saved binding, in path
+// order.
+func (k *Kernel) Bindings() (bindings []Binding) {
+	var visit func(node *SyscallNode, path []interface{})
+	visit = func(node *SyscallNode, path []interface{}) {
+		for _, m := range node.Modules {
+			if mh := k.moduleHash(m); mh != nil {
+				bindings = append(bindings, Binding{
+					Path:   append([]interface{}{}, path...),
+					Module: mh,
+				})
+			}
+		}
+		keys := make([]string, 0, len(node.Children))
+		for key := range node.Children {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			p, err := parsePathKey(key)
+			if err != nil {
+				continue
+			}
+			visit(node.Children[key], append(path, p))
+		}
+	}
+	visit(k.root.Load(), nil)
+	return bindings
+}
+
+// ModulePaths returns the paths the registered module with hash mh
+// is bound to.
+func (k *Kernel) ModulePaths(mh multihash.Multihash) (paths [][]interface{}, err error) {
+	_, err = k.module(mh)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range k.Bindings() {
+		if string(b.Module) == string(mh) {
+			paths = append(paths, b.Path)
+		}
+	}
+	return paths, nil
+}
+
+// module returns the registered module with hash mh.
+func (k *Kernel) module(mh multihash.Multihash) (m Module, err error) {
+	k.treeMu.Lock()
+	defer k.treeMu.Unlock()
+	m, ok := k.modules[parmKey(mh)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrModuleNotFound, parmKey(mh))
+	}
+	return m, nil
+}
+
+// parsePath turns saved tree keys back into a path.
+func parsePath(keys []string) (path []interface{}, err error) {
+	for _, key := range keys {
+		p, err := parsePathKey(key)
+		if err != nil {
+			return nil, err
+		}
+		path = append(path, p)
+	}
+	return path, nil
+}
@@ -0,0 +1,109 @@
+package grid_cli
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/multiformats/go-multihash"
+	"github.com/spf13/afero"
+	. "github.com/stevegt/goadapt"
+)
+
+// TestRegistry tests registering modules and binding them to paths.
+func TestRegistry(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	k, err := NewKernelFs(fs, "/grid")
+	Tassert(t, err == nil, "Failed to create kernel: %v", err)
+	msg, err := NewMessage("I will say hello", "sha256", []interface{}{"hello"}, "")
+	Tassert(t, err == nil, "Failed to create message: %v", err)
+	path, err := messagePath(msg)
+	Tassert(t, err == nil, "Failed to get path: %v", err)
+
+	_, err = k.RegisterModule(struct{ Module }{fakeModule{name: "no manifest"}})
+	Tassert(t, err != nil, "Expected an error registering a module without a manifest")
+
+	a, err := k.RegisterModule(fakeModule{name: "a"})
+	Tassert(t, err == nil, "Failed to register module: %v", err)
+	want, err := Sum(multihash.SHA2_256, []byte("manifest for a"))
+	Tassert(t, err == nil, "Failed to hash manifest: %v", err)
+	Tassert(t, string(a) == string(want), "Expected the manifest hash")
+	again, err := k.RegisterModule(fakeModule{name: "a"})
+	Tassert(t, err == nil && string(again) == string(a), "Failed to register module again: %v", err)
+	b, err := k.RegisterModule(fakeModule{name: "b"})
+	Tassert(t, err == nil, "Failed to register module: %v", err)
+	Tassert(t, len(k.Modules()) == 2, "Expected 2 modules but got %d", len(k.Modules()))
+
+	// binding needs a registered module
+	other, err := Sum(multihash.SHA2_256, []byte("other"))
+	Tassert(t, err == nil, "Failed to hash: %v", err)
+	err = k.Bind(path, other)
+	Tassert(t, errors.Is(err, ErrModuleNotFound), "Expected ErrModuleNotFound but got %v", err)
+	err = k.Bind([]interface{}{path[0], 1.5}, a)
+	Tassert(t, err != nil, "Expected an error binding to an invalid path")
+
+	err = k.Bind(path, a)
+	Tassert(t, err == nil, "Failed to bind: %v", err)
+	err = k.Bind(path, a)
+	Tassert(t, err == nil, "Failed to bind again: %v", err)
+	err = k.Bind([]interface{}{path[0], Wildcard()}, b)
+	Tassert(t, err == nil, "Failed to bind: %v", err)
+	err = k.Bind(path[:1], b)
+	Tassert(t, err == nil, "Failed to bind: %v", err)
+
+	out, err := k.Dispatch(context.Background(), msg)
+	Tassert(t, err == nil && string(out) == "a", "Expected a but got %q, %v", out, err)
+
+	bindings := k.Bindings()
+	Tassert(t, len(bindings) == 3, "Expected 3 bindings but got %v", bindings)
+	paths, err := k.ModulePaths(b)
+	Tassert(t, err == nil, "Failed to list paths: %v", err)
+	Tassert(t, reflect.DeepEqual(paths, [][]interface{}{path[:1], {path[0], Wildcard()}}), "Unexpected paths %v", paths)
+	paths, err = k.ModulePaths(a)
+	Tassert(t, err == nil, "Failed to list paths: %v", err)
+	Tassert(t, reflect.DeepEqual(paths, [][]interface{}{path}), "Unexpected paths %v", paths)
+
+	err = k.Unbind(path, a)
+	Tassert(t, err == nil, "Failed to unbind: %v", err)
+	err = k.Unbind(path, a)
+	Tassert(t, errors.Is(err, ErrNotBound), "Expected ErrNotBound but got %v", err)
+	out, err = k.Dispatch(context.Background(), msg)
+	Tassert(t, err == nil && string(out) == "b", "Expected b but got %q, %v", out, err)
+
+	// saved bindings wait for their module to be registered
+	err = k.SaveTree()
+	Tassert(t, err == nil, "Failed to save tree: %v", err)
+	k, err = NewKernelFs(fs, "/grid")
+	Tassert(t, err == nil, "Failed to create kernel: %v", err)
+	_, err = k.Dispatch(context.Background(), msg)
+	Tassert(t, errors.Is(err, ErrNoHandler), "Expected ErrNoHandler but got %v", err)
+	_, err = k.RegisterModule(fakeModule{name: "b"})
+	Tassert(t, err == nil, "Failed to register module: %v", err)
+	out, err = k.Dispatch(context.Background(), msg)
+	Tassert(t, err == nil && string(out) == "b", "Expected b but got %q, %v", out, err)
+	paths, err = k.ModulePaths(b)
+	Tassert(t, err == nil && len(paths) == 2, "Unexpected paths %v, %v", paths, err)
+
+	// modules that can't be compared with == don't panic
+	type sliceModule struct {
+		fakeModule
+		tags []string
+	}
+	s, err := k.RegisterModule(sliceModule{fakeModule{name: "s"}, []string{"t"}})
+	Tassert(t, err == nil, "Failed to register module: %v", err)
+	_, err = k.RegisterModule(sliceModule{fakeModule{name: "s"}, []string{"t"}})
+	Tassert(t, err == nil, "Failed to register module again: %v", err)
+	err = k.Bind(path, s)
+	Tassert(t, err == nil, "Failed to bind: %v", err)
+	err = k.Bind(path, s)
+	Tassert(t, err == nil, "Failed to bind again: %v", err)
+	paths, err = k.ModulePaths(s)
+	Tassert(t, err == nil && reflect.DeepEqual(paths, [][]interface{}{path}), "Unexpected paths %v, %v", paths, err)
+	out, err = k.Dispatch(context.Background(), msg)
+	Tassert(t, err == nil && string(out) == "s", "Expected s but got %q, %v", out, err)
+	err = k.Unbind(path, s)
+	Tassert(t, err == nil, "Failed to unbind: %v", err)
+	err = k.Unbind(path, s)
+	Tassert(t, errors.Is(err, ErrNotBound), "Expected ErrNotBound but got %v", err)
+}
@@ -0,0 +1,176 @@
+package grid_cli
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/multiformats/go-multihash"
+)
+
+// A syscall path is a list of segments, one per message path
+// element.  A plain value in a path is a literal, matched against the
+// parameter with the same token.  A Segment matches a set of
+// parameters instead, and captures the one it matched:
+//
+//	Wildcard()     any one parameter
+//	Rest()         all remaining parameters, none or more; must be last
+//	AnyString(), AnyInt(), AnyBytes(), AnyHash()
+//	               any one parameter of that type
+//	Regexp(expr)   any string parameter that expr matches in full
+//
+// When more than one segment matches a parameter, a literal beats a
+// regexp, which beats a type, which beats a wildcard, which beats a
+// rest segment.  Precedence is decided one segment at a time from
+// left to right, so a literal first segment beats a wildcard first
+// segment however well the rest of the path matches.
+//
+// In the tree, and in the saved tree, a segment is keyed by a string
+// starting with '!', which no parameter token does: "!*", "!**",
+// "!string", "!int", "!bytes", "!hash", or "!re " followed by the
+// expression.  A string parameter starting with '!' is quoted.
+
+// segKind is the kind of a Segment, in order of precedence.
+type segKind int
+
+const (
+	segRegexp segKind = iota
+	segType
+	segWildcard
+	segRest
+)
+
+// Segment is a syscall path element that matches more than one
+// parameter.
+type Segment struct {
+	kind segKind
+	key  string
+	// re is the anchored expression for segRegexp
+	re *regexp.Regexp
+}
+
+// Wildcard returns a segment matching any one parameter.
+func Wildcard() Segment { return Segment{kind: segWildcard, key: "!*"} }
+
+// Rest returns a segment matching all remaining parameters.  It
+// captures them as a []interface{}.
+func Rest() Segment { return Segment{kind: segRest, key: "!**"} }
+
+// AnyString returns a segment matching any string parameter.
+func AnyString() Segment { return Segment{kind: segType, key: "!string"} }
+
+// AnyInt returns a segment matching any integer parameter.
+func AnyInt() Segment { return Segment{kind: segType, key: "!int"} }
+
+// AnyBytes returns a segment matching any []byte parameter.
+func AnyBytes() Segment { return Segment{kind: segType, key: "!bytes"} }
+
+// AnyHash returns a segment matching any multihash parameter.
+func AnyHash() Segment { return Segment{kind: segType, key: "!hash"} }
+
+// Regexp returns a segment matching any string parameter that expr
+// matches in full.
+func Regexp(expr string) (seg Segment, err error) {
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return Segment{}, err
+	}
+	return Segment{kind: segRegexp, key: "!re " + expr, re: re}, nil
+}
+
+// ParseSegment parses the key of a segment, as returned by String.
+func ParseSegment(key string) (seg Segment, err error) {
+	switch key {
+	case "!*":
+		return Wildcard(), nil
+	case "!**":
+		return Rest(), nil
+	case "!string":
+		return AnyString(), nil
+	case "!int":
+		return AnyInt(), nil
+	case "!bytes":
+		return AnyBytes(), nil
+	case "!hash":
+		return AnyHash(), nil
+	}
+	if expr, ok := strings.CutPrefix(key, "!re "); ok {
+		return Regexp(expr)
+	}
+	return Segment{}, fmt.Errorf("invalid path segment %q", key)
+}
+
+// String returns the segment's key.
+func (s Segment) String() string {
+	return s.key
+}
+
+// match reports whether the segment matches parm, and returns what it
+// captures.  Rest segments are matched by matcher.match.
+func (s Segment) match(parm interface{}) (capture interface{}, ok bool) {
+	parm, err := NormalizeParm(parm)
+	if err != nil {
+		return nil, false
+	}
+	switch s.kind {
+	case segWildcard:
+		return parm, true
+	case segRegexp:
+		str, ok := parm.(string)
+		return str, ok && s.re.MatchString(str)
+	}
+	switch parm.(type) {
+	case string:
+		ok = s.key == "!string"
+	case int64:
+		ok = s.key == "!int"
+	case []byte:
+		ok = s.key == "!bytes"
+	case multihash.Multihash:
+		ok = s.key == "!hash"
+	}
+	return parm, ok
+}
+
+// pathKey returns the tree key for a path element: a segment's key,
+// or a literal's token.
+func pathKey(p interface{}) string {
+	if seg, ok := p.(Segment); ok {
+		return seg.key
+	}
+	return parmKey(p)
+}
+
+// parsePathKey turns a tree key back into a path element: a Segment
+// for a segment key, or the parameter for a token.
+func parsePathKey(key string) (p interface{}, err error) {
+	if strings.HasPrefix(key, "!") {
+		return ParseSegment(key)
+	}
+	return DecodeParm(key)
+}
+
+// sortSegments sorts segments by precedence, and then by key so the
+// order is stable.
+func sortSegments(segs []Segment) {
+	sort.Slice(segs, func(i, j int) bool {
+		if segs[i].kind != segs[j].kind {
+			return segs[i].kind < segs[j].kind
+		}
+		return segs[i].key < segs[j].key
+	})
+}
+
+// capturesKey is the context key for the values captured by the
+// segments of the matched path.
+type capturesKey struct{}
+
+// Captures returns the values that the segments of the matched
+// syscall path captured from the message being handled, in path
+// order.  Literals capture nothing.
+func Captures(ctx context.Context) []interface{} {
+	captures, _ := ctx.Value(capturesKey{}).([]interface{})
+	return captures
+}
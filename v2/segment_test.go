@@ -0,0 +1,162 @@
+package grid_cli
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/multiformats/go-multihash"
+	"github.com/spf13/afero"
+	. "github.com/stevegt/goadapt"
+)
+
+// TestSegments tests matching, precedence and captures of pattern
+// segments.
+func TestSegments(t *testing.T) {
+	msg, err := NewMessage("I will read files", "sha256", nil, "")
+	Tassert(t, err == nil, "Failed to create message: %v", err)
+	path, err := messagePath(msg)
+	Tassert(t, err == nil, "Failed to get path: %v", err)
+	promise := path[0].(multihash.Multihash)
+	digits, err := Regexp(`[0-9]+`)
+	Tassert(t, err == nil, "Failed to compile regexp: %v", err)
+
+	k := NewKernel()
+	literal := fakeModule{name: "literal", rec: &fakeRecord{}}
+	re := fakeModule{name: "regexp", rec: &fakeRecord{}}
+	str := fakeModule{name: "string", rec: &fakeRecord{}}
+	num := fakeModule{name: "int", rec: &fakeRecord{}}
+	wild := fakeModule{name: "wildcard", rec: &fakeRecord{}}
+	rest := fakeModule{name: "rest", rec: &fakeRecord{}}
+	k.bindSyscall(literal, promise, "read", "README")
+	k.bindSyscall(re, promise, "read", digits)
+	k.bindSyscall(str, promise, "read", AnyString())
+	k.bindSyscall(num, promise, "read", AnyInt())
+	k.bindSyscall(wild, promise, "read", Wildcard())
+	k.bindSyscall(rest, promise, Rest())
+	err = k.bindSyscall(rest, promise, Rest(), "x")
+	Tassert(t, err != nil, "Expected an error for a path after a rest segment")
+
+	cases := []struct {
+		parms    []interface{}
+		want     fakeModule
+		captures []interface{}
+	}{
+		{[]interface{}{"read", "README"}, literal, nil},
+		{[]interface{}{"read", "42"}, re, []interface{}{"42"}},
+		{[]interface{}{"read", "notes.txt"}, str, []interface{}{"notes.txt"}},
+		{[]interface{}{"read", int64(42)}, num, []interface{}{int64(42)}},
+		{[]interface{}{"read", []byte{1}}, wild, []interface{}{[]byte{1}}},
+		{[]interface{}{"write", "a", int64(1)}, rest, []interface{}{[]interface{}{"write", "a", int64(1)}}},
+		{[]interface{}{}, rest, []interface{}{[]interface{}{}}},
+		// longer paths are handled at their longest matching prefix
+		{[]interface{}{"read", "README", "x"}, literal, nil},
+		{[]interface{}{"read", []byte{1}, "x"}, wild, []interface{}{[]byte{1}}},
+	}
+	for _, c := range cases {
+		msg.Parms = c.parms
+		out, err := k.Dispatch(context.Background(), msg)
+		Tassert(t, err == nil, "%v: Dispatch failed: %v", c.parms, err)
+		Tassert(t, string(out) == c.want.name, "%v: Expected %s but got %s", c.parms, c.want.name, out)
+		Tassert(t, reflect.DeepEqual(c.want.rec.captures, c.captures), "%v: Expected captures %#v but got %#v", c.parms, c.captures, c.want.rec.captures)
+	}
+
+	// precedence is decided segment by segment: the literal "read"
+	// beats the wildcard even though the wildcard path is longer
+	deep := fakeModule{name: "deep", rec: &fakeRecord{}}
+	k.bindSyscall(deep, promise, Wildcard(), "README", "x")
+	msg.Parms = []interface{}{"read", "README", "x"}
+	out, err := k.Dispatch(context.Background(), msg)
+	Tassert(t, err == nil, "Dispatch failed: %v", err)
+	Tassert(t, string(out) == "literal", "Expected literal but got %s", out)
+	k.unbindSyscall(literal, promise, "read", "README")
+	out, err = k.Dispatch(context.Background(), msg)
+	Tassert(t, err == nil, "Dispatch failed: %v", err)
+	Tassert(t, string(out) == "string", "Expected string but got %s", out)
+
+	// the segment list follows the children as they come and go
+	for _, m := range []Module{re, str, num, wild} {
+		k.unbindSyscall(m, promise, "read", digits)
+		k.unbindSyscall(m, promise, "read", AnyString())
+		k.unbindSyscall(m, promise, "read", AnyInt())
+		k.unbindSyscall(m, promise, "read", Wildcard())
+	}
+	out, err = k.Dispatch(context.Background(), msg)
+	Tassert(t, err == nil, "Dispatch failed: %v", err)
+	Tassert(t, string(out) == "deep", "Expected deep but got %s", out)
+	k.unbindSyscall(rest, promise, Rest())
+	msg.Parms = []interface{}{"write"}
+	_, err = k.Dispatch(context.Background(), msg)
+	Tassert(t, errors.Is(err, ErrNoHandler), "Expected ErrNoHandler but got %v", err)
+}
+
+// TestSegmentKeys tests that segments survive saving the tree.
+func TestSegmentKeys(t *testing.T) {
+	for _, key := range []string{"!*", "!**", "!string", "!int", "!bytes", "!hash", "!re a|b"} {
+		seg, err := ParseSegment(key)
+		Tassert(t, err == nil, "Failed to parse %q: %v", key, err)
+		Tassert(t, seg.String() == key, "Expected %q but got %q", key, seg.String())
+	}
+	for _, key := range []string{"!", "!foo", "!re (", "*"} {
+		_, err := ParseSegment(key)
+		Tassert(t, err != nil, "Expected an error for %q", key)
+	}
+
+	fs := afero.NewMemMapFs()
+	k, err := NewKernelFs(fs, "/grid")
+	Tassert(t, err == nil, "Failed to create kernel: %v", err)
+	k.modules["@zmod"] = fakeModule{name: "mod"}
+	re, err := Regexp(`a|b`)
+	Tassert(t, err == nil, "Failed to compile regexp: %v", err)
+	k.bindSyscall(fakeModule{name: "mod"}, "read", re, Rest())
+	err = k.SaveTree()
+	Tassert(t, err == nil, "Failed to save tree: %v", err)
+
+	k, err = NewKernelFs(fs, "/grid")
+	Tassert(t, err == nil, "Failed to create kernel: %v", err)
+	k.modules["@zmod"] = fakeModule{name: "mod"}
+	err = k.LoadTree()
+	Tassert(t, err == nil, "Failed to load tree: %v", err)
+	matches, err := k.Lookup(context.Background(), []interface{}{"read", "b", int64(1)})
+	Tassert(t, err == nil, "Lookup failed: %v", err)
+	Tassert(t, len(matches) == 1, "Expected the module to match")
+	Tassert(t, reflect.DeepEqual(matches[0].Captures, []interface{}{"b", []interface{}{int64(1)}}), "Unexpected captures %#v", matches[0].Captures)
+}
+
+// TestLiteralBang tests that string parameters that look like
+// segment keys are literals, and only match themselves.
+func TestLiteralBang(t *testing.T) {
+	for _, s := range []string{"!*", "!int"} {
+		token, err := EncodeParm(s)
+		Tassert(t, err == nil && token == strconv.Quote(s), "Expected %s quoted but got %q: %v", s, token, err)
+		p, err := DecodeParm(token)
+		Tassert(t, err == nil && p == s, "Expected %q back but got %#v: %v", s, p, err)
+		_, err = DecodeParm(s)
+		Tassert(t, err != nil, "Expected an error decoding bare %s", s)
+	}
+
+	k := NewKernel()
+	err := k.bindSyscall(fakeModule{name: "star"}, "read", "!*")
+	Tassert(t, err == nil, "Failed to bind: %v", err)
+	err = k.bindSyscall(fakeModule{name: "int"}, "read", "!int")
+	Tassert(t, err == nil, "Failed to bind: %v", err)
+	for _, c := range []struct {
+		parm interface{}
+		want string
+	}{
+		{"!*", "star"},
+		{"!int", "int"},
+		{"anything", ""},
+		{int64(5), ""},
+	} {
+		matches, err := k.Lookup(context.Background(), []interface{}{"read", c.parm})
+		Tassert(t, err == nil, "Lookup failed: %v", err)
+		if c.want == "" {
+			Tassert(t, len(matches) == 0, "Expected %#v to match nothing but got %v", c.parm, matches)
+			continue
+		}
+		Tassert(t, len(matches) == 1 && matches[0].Module == Module(fakeModule{name: c.want}), "Expected %#v to match %s but got %v", c.parm, c.want, matches)
+	}
+}
@@ -3,21 +3,45 @@ package grid_cli
 // Simplified overview of the system design based on the discussions
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/spf13/afero"
 )
 
 func Serve() {
 	// Start the WebSocket server
-	http.HandleFunc("/ws", HandleWebSocket)
+	dir := filepath.Join(os.Getenv("HOME"), gridDir)
+	kernel, err := NewKernelFs(afero.NewOsFs(), dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	http.HandleFunc("/ws", kernel.HandleWebSocket)
 	fmt.Println("WebSocket server started on :8080")
 	http.ListenAndServe(":8080", nil)
 }
 
-func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+// replyTTL is how long the replies HandleWebSocket sends live.
+const replyTTL = time.Minute
+
+// HandleWebSocket reads messages from a WebSocket connection and
+// hands them to the kernel to dispatch, writing back what the
+// handling module returns as a reply carrying the request's
+// correlation ID; see NewReply.  Binary frames are read with a
+// Decoder and may hold several messages; a text frame holds one
+// text-encoded message.  Replies are written with an Encoder.  A
+// request naming a reply port in its envelope's ReplyTo has its
+// reply sent there instead; see Kernel.Reply.  All connections share
+// the kernel, so a reply arriving on one connection reaches a
+// request made on another.
+func (k *Kernel) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	// Upgrade the connection to a WebSocket connection
 	upgrader := websocket.Upgrader{}
 	conn, err := upgrader.Upgrade(w, r, nil)
@@ -25,13 +49,99 @@ func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		log.Println(err)
 		return
 	}
+	defer conn.Close()
 
 	// Create a new client
 	client := NewClient(conn)
-	kernel := NewKernel()
 	// kernel.AddClient(client)
-	_ = kernel // XXX
 	_ = client // XXX
+
+	for {
+		typ, frame, err := conn.NextReader()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		if typ == websocket.TextMessage {
+			msg := &Message{}
+			data, err := io.ReadAll(frame)
+			if err == nil {
+				err = Unmarshal(data, msg)
+			}
+			if err != nil {
+				log.Println("dropping invalid message:", err)
+				continue
+			}
+			err = k.serveMessage(r.Context(), conn, msg)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			continue
+		}
+		// the binary encoding is self-framing, so a frame may carry
+		// several messages back to back
+		dec := NewDecoder(frame)
+		for {
+			msg := &Message{}
+			err = dec.Decode(msg)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				log.Println("dropping invalid message:", err)
+				break
+			}
+			err = k.serveMessage(r.Context(), conn, msg)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+		}
+	}
+}
+
+// serveMessage dispatches msg, read from conn, and writes the reply
+// back to conn unless msg names a reply port.  Messages that can't
+// be handled are logged and dropped; only a failure to write to conn
+// is returned.
+func (k *Kernel) serveMessage(ctx context.Context, conn *websocket.Conn, msg *Message) (err error) {
+	replied, err := k.Receive(msg)
+	if err != nil {
+		log.Println("dropping message:", err)
+		return nil
+	}
+	if replied {
+		return nil
+	}
+	out, err := k.Dispatch(ctx, msg)
+	if err != nil {
+		log.Println("dropping message:", err)
+		return nil
+	}
+	reply, err := NewReply(msg, out, replyTTL)
+	if err != nil {
+		log.Println("dropping reply:", err)
+		return nil
+	}
+	routed, err := k.Reply(msg, reply)
+	if err != nil {
+		log.Println("dropping reply:", err)
+		return nil
+	}
+	if routed {
+		return nil
+	}
+	w, err := conn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+	err = NewEncoder(w).Encode(reply)
+	if err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
 }
 
 // NewClient creates a new client
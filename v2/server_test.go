@@ -0,0 +1,136 @@
+package grid_cli
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	. "github.com/stevegt/goadapt"
+)
+
+// TestHandleWebSocket tests that a dispatched message is answered
+// with a reply carrying its correlation ID.
+func TestHandleWebSocket(t *testing.T) {
+	k := NewKernel()
+	msg, err := NewMessage("I will say hello", "sha256", []interface{}{"hello"}, "")
+	Tassert(t, err == nil, "Failed to create message: %v", err)
+	path, err := messagePath(msg)
+	Tassert(t, err == nil, "Failed to get path: %v", err)
+	err = k.bindSyscall(fakeModule{name: "world"}, path[0])
+	Tassert(t, err == nil, "Failed to bind: %v", err)
+	msg.Envelope, err = NewEnvelope(time.Minute)
+	Tassert(t, err == nil, "Failed to create envelope: %v", err)
+
+	server := httptest.NewServer(http.HandlerFunc(k.HandleWebSocket))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	Tassert(t, err == nil, "Failed to connect: %v", err)
+	defer conn.Close()
+	data, err := MarshalBinary(msg)
+	Tassert(t, err == nil, "Failed to marshal message: %v", err)
+	err = conn.WriteMessage(websocket.BinaryMessage, data)
+	Tassert(t, err == nil, "Failed to send: %v", err)
+
+	_, data, err = conn.ReadMessage()
+	Tassert(t, err == nil, "Failed to read reply: %v", err)
+	var reply Message
+	err = Unmarshal(data, &reply)
+	Tassert(t, err == nil, "Failed to unmarshal reply: %v", err)
+	Tassert(t, reply.Payload == "world", "Unexpected payload %q", reply.Payload)
+	Tassert(t, reply.Envelope != nil && reply.Envelope.CorrelationID == msg.Envelope.CorrelationID,
+		"Expected the request's correlation ID in %#v", reply.Envelope)
+
+	// a request naming a reply port has its reply sent there, and
+	// one naming a port that isn't open has its reply dropped
+	replies, closePort, err := k.OpenReplyPort("inbox")
+	Tassert(t, err == nil, "Failed to open reply port: %v", err)
+	defer closePort()
+	send := func(replyTo string) *Message {
+		m := *msg
+		m.Envelope, err = NewEnvelope(time.Minute)
+		Tassert(t, err == nil, "Failed to create envelope: %v", err)
+		m.Envelope.ReplyTo = replyTo
+		data, err := MarshalBinary(&m)
+		Tassert(t, err == nil, "Failed to marshal message: %v", err)
+		err = conn.WriteMessage(websocket.BinaryMessage, data)
+		Tassert(t, err == nil, "Failed to send: %v", err)
+		return &m
+	}
+	routed := send("inbox")
+	send("nowhere")
+	last := send("")
+	got := <-replies
+	Tassert(t, got.Payload == "world" && got.Envelope.CorrelationID == routed.Envelope.CorrelationID,
+		"Unexpected reply %#v", got)
+	_, data, err = conn.ReadMessage()
+	Tassert(t, err == nil, "Failed to read reply: %v", err)
+	var written Message
+	err = Unmarshal(data, &written)
+	Tassert(t, err == nil, "Failed to unmarshal reply: %v", err)
+	Tassert(t, written.Envelope.CorrelationID == last.Envelope.CorrelationID,
+		"Expected only the last reply written back but got %#v", written.Envelope)
+
+	// the reply is accepted as one by the requester's kernel
+	requester := NewKernel()
+	replies, cancel, err := requester.Request(msg)
+	Tassert(t, err == nil, "Failed to request: %v", err)
+	defer cancel()
+	replied, err := requester.Receive(&reply)
+	Tassert(t, err == nil && replied, "Expected the reply routed but got %v %v", replied, err)
+	Tassert(t, <-replies == &reply, "Expected the reply message")
+}
+
+// TestHandleWebSocketFrames tests that a binary frame may carry
+// several messages, and a text frame a text-encoded one.
+func TestHandleWebSocketFrames(t *testing.T) {
+	k := NewKernel()
+	newMsg := func() *Message {
+		msg, err := NewMessage("I will say hello", "sha256", []interface{}{"hello"}, "")
+		Tassert(t, err == nil, "Failed to create message: %v", err)
+		msg.Envelope, err = NewEnvelope(time.Minute)
+		Tassert(t, err == nil, "Failed to create envelope: %v", err)
+		return msg
+	}
+	path, err := messagePath(newMsg())
+	Tassert(t, err == nil, "Failed to get path: %v", err)
+	err = k.bindSyscall(fakeModule{name: "world"}, path[0])
+	Tassert(t, err == nil, "Failed to bind: %v", err)
+
+	server := httptest.NewServer(http.HandlerFunc(k.HandleWebSocket))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	Tassert(t, err == nil, "Failed to connect: %v", err)
+	defer conn.Close()
+
+	var sent []*Message
+	var frame bytes.Buffer
+	enc := NewEncoder(&frame)
+	for i := 0; i < 2; i++ {
+		msg := newMsg()
+		err = enc.Encode(msg)
+		Tassert(t, err == nil, "Failed to encode: %v", err)
+		sent = append(sent, msg)
+	}
+	err = conn.WriteMessage(websocket.BinaryMessage, frame.Bytes())
+	Tassert(t, err == nil, "Failed to send: %v", err)
+	msg := newMsg()
+	data, err := Marshal(msg)
+	Tassert(t, err == nil, "Failed to marshal: %v", err)
+	err = conn.WriteMessage(websocket.TextMessage, data)
+	Tassert(t, err == nil, "Failed to send: %v", err)
+	sent = append(sent, msg)
+
+	for _, msg := range sent {
+		typ, r, err := conn.NextReader()
+		Tassert(t, err == nil && typ == websocket.BinaryMessage, "Failed to read reply: %v", err)
+		var reply Message
+		err = NewDecoder(r).Decode(&reply)
+		Tassert(t, err == nil, "Failed to decode reply: %v", err)
+		Tassert(t, reply.Payload == "world" && reply.Envelope.CorrelationID == msg.Envelope.CorrelationID,
+			"Unexpected reply %#v", reply)
+	}
+}
@@ -0,0 +1,188 @@
+package grid_cli
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/multiformats/go-varint"
+	. "github.com/stevegt/goadapt"
+)
+
+// Signature identifies the sender of a message.  The signature is
+// Ed25519ph (RFC 8032 pre-hashed Ed25519) over the SHA-512 of the
+// message's unsigned binary encoding, so it covers the promise, the
+// parameters, the envelope and the payload.  Pre-hashing lets a
+// stream decoder verify a payload it never holds in memory.
+type Signature struct {
+	PublicKey []byte // signer's key as a multikey; see EncodeMultikey
+	Sig       []byte
+}
+
+// ed25519PubCode is the multicodec code for an Ed25519 public key.
+const ed25519PubCode = 0xed
+
+var (
+	// ErrUnsigned is returned by Verify for a message with no signature.
+	ErrUnsigned = errors.New("message is unsigned")
+	// ErrBadSignature is returned when a signature doesn't match the
+	// message it is attached to.
+	ErrBadSignature = errors.New("invalid message signature")
+	// ErrUntrustedKey is returned by Verify when a message is signed
+	// by a key that isn't in the trusted set.
+	ErrUntrustedKey = errors.New("message signed by untrusted key")
+)
+
+var signOpts = &ed25519.Options{Hash: crypto.SHA512}
+
+// EncodeMultikey returns pub prefixed with the ed25519-pub
+// multicodec, so the key type travels with the key.
+func EncodeMultikey(pub ed25519.PublicKey) []byte {
+	return append(varint.ToUvarint(ed25519PubCode), pub...)
+}
+
+// DecodeMultikey returns the Ed25519 public key in a multikey.
+func DecodeMultikey(buf []byte) (pub ed25519.PublicKey, err error) {
+	code, n, err := varint.FromUvarint(buf)
+	if err != nil {
+		return nil, err
+	}
+	if code != ed25519PubCode {
+		return nil, fmt.Errorf("unsupported multikey codec: %#x", code)
+	}
+	if len(buf)-n != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid ed25519 key length: %d", len(buf)-n)
+	}
+	return ed25519.PublicKey(buf[n:]), nil
+}
+
+// Signed reports whether the message carries a signature.  A message
+// that Unmarshal accepted with a signature has a signature that
+// matches its content; whether the signer is trusted is up to Verify.
+func (msg *Message) Signed() bool {
+	return msg.Signature != nil
+}
+
+// Sign signs msg with priv, replacing any existing signature.
+func Sign(msg *Message, priv ed25519.PrivateKey) (err error) {
+	defer Return(&err)
+	h := sha512.New()
+	err = writeSigned(h, msg)
+	Ck(err)
+	sig, err := priv.Sign(nil, h.Sum(nil), signOpts)
+	Ck(err)
+	pub := priv.Public().(ed25519.PublicKey)
+	msg.Signature = &Signature{PublicKey: EncodeMultikey(pub), Sig: sig}
+	return nil
+}
+
+// Verify checks that msg is signed by one of trustedKeys and that
+// the signature matches the message.
+func Verify(msg *Message, trustedKeys []ed25519.PublicKey) (err error) {
+	if !msg.Signed() {
+		return ErrUnsigned
+	}
+	pub, err := DecodeMultikey(msg.Signature.PublicKey)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadSignature, err)
+	}
+	trusted := false
+	for _, key := range trustedKeys {
+		if pub.Equal(key) {
+			trusted = true
+			break
+		}
+	}
+	if !trusted {
+		return ErrUntrustedKey
+	}
+	return checkSignature(msg)
+}
+
+// checkSignature checks that a signed message's signature matches
+// its content and embedded key.
+func checkSignature(msg *Message) (err error) {
+	h := sha512.New()
+	err = writeSigned(h, msg)
+	if err != nil {
+		return err
+	}
+	return checkDigest(msg.Signature, h)
+}
+
+// checkDigest checks sig against a SHA-512 hash of the unsigned
+// message.
+func checkDigest(sig *Signature, h hash.Hash) (err error) {
+	pub, err := DecodeMultikey(sig.PublicKey)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadSignature, err)
+	}
+	err = ed25519.VerifyWithOptions(pub, h.Sum(nil), sig.Sig, signOpts)
+	if err != nil {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// writeSigned writes the bytes covered by msg's signature to w: the
+// binary encoding of msg with the signature left out.
+func writeSigned(w io.Writer, msg *Message) (err error) {
+	err = writeUnsignedHeader(w, msg, uint64(len(msg.Payload)))
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, msg.Payload)
+	return err
+}
+
+// writeUnsignedHeader writes the binary header of msg as it was
+// before it was signed.  The envelope's hop count changes in transit,
+// so it is left out of what is signed.
+func writeUnsignedHeader(w io.Writer, msg *Message, payloadLen uint64) (err error) {
+	unsigned := *msg
+	unsigned.Signature = nil
+	if msg.Envelope != nil {
+		env := *msg.Envelope
+		env.Hops = 0
+		unsigned.Envelope = &env
+	}
+	return writeBinaryHeader(w, &unsigned, payloadLen)
+}
+
+// verifyingReader verifies a signed message's signature as its
+// payload streams past, reporting a mismatch in place of io.EOF.
+type verifyingReader struct {
+	r   io.Reader
+	sig *Signature
+	h   hash.Hash
+}
+
+// newVerifyingReader returns a payload reader that checks msg's
+// signature once the payload has been read.
+func newVerifyingReader(msg *Message, payloadLen uint64, r io.Reader) (vr *verifyingReader, err error) {
+	var header bytes.Buffer
+	err = writeUnsignedHeader(&header, msg, payloadLen)
+	if err != nil {
+		return nil, err
+	}
+	h := sha512.New()
+	h.Write(header.Bytes())
+	return &verifyingReader{r: r, sig: msg.Signature, h: h}, nil
+}
+
+func (v *verifyingReader) Read(buf []byte) (n int, err error) {
+	n, err = v.r.Read(buf)
+	v.h.Write(buf[:n])
+	if err == io.EOF {
+		sigErr := checkDigest(v.sig, v.h)
+		if sigErr != nil {
+			return n, sigErr
+		}
+	}
+	return n, err
+}
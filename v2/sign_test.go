@@ -0,0 +1,72 @@
+package grid_cli
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// TestSignVerify tests signing a message and verifying it after a
+// round trip through both encodings
+func TestSignVerify(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	Tassert(t, err == nil, "Failed to generate key: %v", err)
+	otherPub, _, err := ed25519.GenerateKey(nil)
+	Tassert(t, err == nil, "Failed to generate key: %v", err)
+
+	msg, err := NewMessage("I will say hello", "sha256", []interface{}{"hello"}, "world")
+	Tassert(t, err == nil, "Failed to create message: %v", err)
+	Tassert(t, !msg.Signed(), "Expected new message to be unsigned")
+	err = Verify(msg, []ed25519.PublicKey{pub})
+	Tassert(t, errors.Is(err, ErrUnsigned), "Expected ErrUnsigned but got %v", err)
+
+	err = Sign(msg, priv)
+	Tassert(t, err == nil, "Failed to sign message: %v", err)
+
+	for _, marshal := range []func(*Message) ([]byte, error){Marshal, MarshalBinary} {
+		data, err := marshal(msg)
+		Tassert(t, err == nil, "Failed to marshal message: %v", err)
+
+		var got Message
+		err = Unmarshal(data, &got)
+		Tassert(t, err == nil, "Failed to unmarshal message: %v", err)
+		Tassert(t, got.Signed(), "Expected message to be signed")
+		err = Verify(&got, []ed25519.PublicKey{otherPub, pub})
+		Tassert(t, err == nil, "Failed to verify message: %v", err)
+		err = Verify(&got, []ed25519.PublicKey{otherPub})
+		Tassert(t, errors.Is(err, ErrUntrustedKey), "Expected ErrUntrustedKey but got %v", err)
+
+		// a forged payload must not unmarshal
+		forged := bytes.Replace(data, []byte("world"), []byte("wurld"), 1)
+		err = Unmarshal(forged, &got)
+		Tassert(t, errors.Is(err, ErrBadSignature), "Expected ErrBadSignature but got %v", err)
+	}
+}
+
+// TestDecoderSignature tests that a stream decoder checks signatures
+// as the payload streams past
+func TestDecoderSignature(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(nil)
+	Tassert(t, err == nil, "Failed to generate key: %v", err)
+	msg, err := NewMessage("I will say hello", "sha256", []interface{}{"hello"}, "world")
+	Tassert(t, err == nil, "Failed to create message: %v", err)
+	err = Sign(msg, priv)
+	Tassert(t, err == nil, "Failed to sign message: %v", err)
+	data, err := MarshalBinary(msg)
+	Tassert(t, err == nil, "Failed to marshal message: %v", err)
+
+	_, payload, err := NewDecoder(bytes.NewReader(data)).Next()
+	Tassert(t, err == nil, "Failed to read header: %v", err)
+	_, err = io.ReadAll(payload)
+	Tassert(t, err == nil, "Failed to read payload: %v", err)
+
+	forged := bytes.Replace(data, []byte("world"), []byte("wurld"), 1)
+	_, payload, err = NewDecoder(bytes.NewReader(forged)).Next()
+	Tassert(t, err == nil, "Failed to read header: %v", err)
+	_, err = io.ReadAll(payload)
+	Tassert(t, errors.Is(err, ErrBadSignature), "Expected ErrBadSignature but got %v", err)
+}
@@ -0,0 +1,144 @@
+package grid_cli
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// An Encoder writes a sequence of messages to an io.Writer.  Each
+// message is written in the binary encoding, which is self-framing,
+// so a stream of messages is just their concatenation.  The same
+// framing works for websocket frames, subprocess pipes and log
+// files.
+type Encoder struct {
+	w io.Writer
+}
+
+// NewEncoder returns an Encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes msg, including its payload, to the stream.
+func (e *Encoder) Encode(msg *Message) (err error) {
+	defer Return(&err)
+	buf, err := MarshalBinary(msg)
+	Ck(err)
+	_, err = e.w.Write(buf)
+	Ck(err)
+	return nil
+}
+
+// EncodeStream writes msg to the stream, taking exactly size bytes of
+// payload from r rather than from msg.Payload.  This lets a caller
+// send a payload that doesn't fit in memory.
+func (e *Encoder) EncodeStream(msg *Message, size int64, r io.Reader) (err error) {
+	defer Return(&err)
+	Assert(size >= 0, "invalid payload size %d", size)
+	err = writeBinaryHeader(e.w, msg, uint64(size))
+	Ck(err)
+	n, err := io.CopyN(e.w, r, size)
+	if err == io.EOF {
+		err = fmt.Errorf("payload short by %d bytes: %w", size-n, io.ErrUnexpectedEOF)
+	}
+	Ck(err)
+	return nil
+}
+
+// A Decoder reads a sequence of messages from an io.Reader.
+type Decoder struct {
+	r       *bufio.Reader
+	payload *io.LimitedReader
+}
+
+// NewDecoder returns a Decoder that reads from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r)}
+}
+
+// Next reads the header of the next message in the stream.  It
+// returns the message with its promise and parameters filled in and
+// its Payload left empty, along with a reader for the payload bytes.
+// The payload reader is only valid until the next call to Next or
+// Decode; any part of it left unread is discarded.  Next returns
+// io.EOF when the stream ends cleanly between messages.  If the
+// message is signed, the payload reader returns ErrBadSignature
+// instead of io.EOF when the signature doesn't match.
+func (d *Decoder) Next() (msg *Message, payload io.Reader, err error) {
+	err = d.skipPayload()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	marker, err := d.r.ReadByte()
+	if err == io.EOF {
+		return nil, nil, io.EOF
+	}
+
+	defer Return(&err)
+	Ck(err)
+	Assert(marker == BinaryMarker, "invalid binary message marker: %#x", marker)
+
+	msg = &Message{}
+	payloadLen, err := readBinaryHeader(d.r, msg, maxFieldSize)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	Ck(err)
+
+	d.payload = &io.LimitedReader{R: d.r, N: int64(payloadLen)}
+	payload = &payloadReader{d.payload}
+	if msg.Signed() {
+		// the signature is checked when the payload hits EOF
+		payload, err = newVerifyingReader(msg, payloadLen, payload)
+		Ck(err)
+	}
+	return msg, payload, nil
+}
+
+// Decode reads the next complete message, including its payload,
+// into msg.
+func (d *Decoder) Decode(msg *Message) (err error) {
+	m, payload, err := d.Next()
+	if err != nil {
+		return err
+	}
+	defer Return(&err)
+	buf, err := io.ReadAll(payload)
+	Ck(err)
+	*msg = *m
+	msg.Payload = string(buf)
+	return nil
+}
+
+// skipPayload discards whatever is left of the previous message's
+// payload.
+func (d *Decoder) skipPayload() (err error) {
+	if d.payload == nil {
+		return nil
+	}
+	_, err = io.Copy(io.Discard, d.payload)
+	if err == nil && d.payload.N > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	d.payload = nil
+	return err
+}
+
+// payloadReader reports a truncated stream as io.ErrUnexpectedEOF
+// rather than letting the caller mistake it for the end of the
+// payload.
+type payloadReader struct {
+	lr *io.LimitedReader
+}
+
+func (p *payloadReader) Read(buf []byte) (n int, err error) {
+	n, err = p.lr.Read(buf)
+	if err == io.EOF && p.lr.N > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
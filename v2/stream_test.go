@@ -0,0 +1,64 @@
+package grid_cli
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// TestEncoderDecoder tests framing a sequence of messages on a stream
+func TestEncoderDecoder(t *testing.T) {
+	promise, err := NewPromise("I will say hello", "sha256")
+	Tassert(t, err == nil, "Failed to create promise: %v", err)
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	err = enc.Encode(&Message{Promise: promise, Parms: []interface{}{"hello"}, Payload: "world"})
+	Tassert(t, err == nil, "Failed to encode message: %v", err)
+	big := strings.Repeat("x", 100000)
+	err = enc.EncodeStream(&Message{Promise: promise, Parms: []interface{}{"big"}}, int64(len(big)), strings.NewReader(big))
+	Tassert(t, err == nil, "Failed to encode stream: %v", err)
+	err = enc.Encode(&Message{Promise: promise})
+	Tassert(t, err == nil, "Failed to encode message: %v", err)
+
+	dec := NewDecoder(&buf)
+
+	var msg Message
+	err = dec.Decode(&msg)
+	Tassert(t, err == nil, "Failed to decode message: %v", err)
+	Tassert(t, msg.Parms[0] == "hello", "Expected parm %q but got %q", "hello", msg.Parms[0])
+	Tassert(t, msg.Payload == "world", "Expected payload %q but got %q", "world", msg.Payload)
+
+	// the header is available before the payload is read
+	m, payload, err := dec.Next()
+	Tassert(t, err == nil, "Failed to read header: %v", err)
+	Tassert(t, m.Parms[0] == "big", "Expected parm %q but got %q", "big", m.Parms[0])
+	part := make([]byte, 10)
+	_, err = io.ReadFull(payload, part)
+	Tassert(t, err == nil, "Failed to read payload: %v", err)
+
+	// the rest of the big payload is skipped
+	err = dec.Decode(&msg)
+	Tassert(t, err == nil, "Failed to decode message: %v", err)
+	Tassert(t, len(msg.Parms) == 0, "Expected no parms but got %v", msg.Parms)
+
+	_, _, err = dec.Next()
+	Tassert(t, err == io.EOF, "Expected io.EOF but got %v", err)
+}
+
+// TestDecoderTruncated tests that a stream cut off mid-payload is an error
+func TestDecoderTruncated(t *testing.T) {
+	promise, err := NewPromise("I will say hello", "sha256")
+	Tassert(t, err == nil, "Failed to create promise: %v", err)
+	data, err := MarshalBinary(&Message{Promise: promise, Payload: "world"})
+	Tassert(t, err == nil, "Failed to marshal message: %v", err)
+
+	dec := NewDecoder(bytes.NewReader(data[:len(data)-2]))
+	_, payload, err := dec.Next()
+	Tassert(t, err == nil, "Failed to read header: %v", err)
+	_, err = io.ReadAll(payload)
+	Tassert(t, err == io.ErrUnexpectedEOF, "Expected io.ErrUnexpectedEOF but got %v", err)
+}
@@ -0,0 +1,340 @@
+package grid_cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/multiformats/go-multihash"
+	"github.com/spf13/afero"
+	. "github.com/stevegt/goadapt"
+)
+
+// Modules ask the kernel for things by sending syscall requests on
+// their stdout port, as described in doc/323-syscalls.md and
+// doc/324-syscalls-sequences.md.  A request is a message under
+// SyscallPromise whose parameters name the syscall and give its
+// arguments, such as
+//
+//	fs read {name}            returns the file's contents
+//	fs write {name}           writes the payload to the file
+//	cache get {key}           returns the cached value
+//	cache put {key}           caches the payload
+//	peer send {peer}          sends the message in the payload to a peer
+//
+// The first right the request carries must be a send right for the
+// reply; requests without one are carried out but not answered.  The
+// reply is a message under SyscallPromise with the parameter "ok"
+// and the result as its payload, or the parameters "error" and the
+// error text.  A request's envelope correlation ID is copied into the
+// reply.  The kernel matches requests against a syscall tree of its
+// own, separate from the one Dispatch uses, after checking that the
+// module has been granted the syscall with Grant.  Syscalls act on
+// the Services set with SetServices.
+
+// SyscallPromise is the promise of syscall requests and replies.
+const SyscallPromise = "I will carry out the kernel syscall named by my parameters"
+
+var (
+	// ErrPermission is returned for a syscall the module hasn't been
+	// granted.
+	ErrPermission = errors.New("syscall not permitted")
+	// ErrNoService is returned for a syscall whose service isn't set.
+	ErrNoService = errors.New("syscall service not available")
+	// ErrCacheMiss is returned by a CacheStore for a missing key.
+	ErrCacheMiss = errors.New("not in cache")
+	// ErrSyscall wraps the error text of a failed syscall's reply.
+	ErrSyscall = errors.New("syscall failed")
+)
+
+// CacheStore is the cache behind the cache syscalls.
+type CacheStore interface {
+	Get(key string) (data []byte, err error)
+	Put(key string, data []byte) error
+}
+
+// PeerSender delivers messages to peers for the peer syscalls.
+type PeerSender interface {
+	SendToPeer(ctx context.Context, peer string, msg *Message) error
+}
+
+// Services are what the core syscalls act on.  A syscall whose
+// service is nil fails with ErrNoService.
+type Services struct {
+	// Fs is the filesystem for the fs syscalls.  Modules can reach
+	// anything on it, so it should be confined, for instance with
+	// afero.NewBasePathFs.
+	Fs    afero.Fs
+	Cache CacheStore
+	Peers PeerSender
+}
+
+// SetServices sets what the core syscalls act on.
+func (k *Kernel) SetServices(services Services) {
+	k.treeMu.Lock()
+	defer k.treeMu.Unlock()
+	k.services = services
+}
+
+// Grant lets the registered module with hash mh make the syscalls
+// whose parameters start with prefix, such as "fs", "read".  An
+// empty prefix grants every syscall.
+func (k *Kernel) Grant(mh multihash.Multihash, prefix ...interface{}) (err error) {
+	defer Return(&err)
+	_, err = k.module(mh)
+	Ck(err)
+	tokens, err := parmTokens(prefix)
+	Ck(err)
+	k.treeMu.Lock()
+	defer k.treeMu.Unlock()
+	key := parmKey(mh)
+	for _, grant := range k.grants[key] {
+		if equalTokens(grant, tokens) {
+			return nil
+		}
+	}
+	k.grants[key] = append(k.grants[key], tokens)
+	return nil
+}
+
+// Revoke removes a grant made with Grant.
+func (k *Kernel) Revoke(mh multihash.Multihash, prefix ...interface{}) (err error) {
+	defer Return(&err)
+	tokens, err := parmTokens(prefix)
+	Ck(err)
+	k.treeMu.Lock()
+	defer k.treeMu.Unlock()
+	key := parmKey(mh)
+	for i, grant := range k.grants[key] {
+		if equalTokens(grant, tokens) {
+			k.grants[key] = append(k.grants[key][:i:i], k.grants[key][i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no grant for %v", tokens)
+}
+
+// permitted reports whether the module with hash token key has been
+// granted the syscall with the given parameters.
+func (k *Kernel) permitted(key string, parms []interface{}) bool {
+	tokens, err := parmTokens(parms)
+	if err != nil {
+		return false
+	}
+	k.treeMu.Lock()
+	defer k.treeMu.Unlock()
+	for _, grant := range k.grants[key] {
+		if len(grant) <= len(tokens) && equalTokens(grant, tokens[:len(grant)]) {
+			return true
+		}
+	}
+	return false
+}
+
+// parmTokens returns the tokens for parms.
+func parmTokens(parms []interface{}) (tokens []string, err error) {
+	for _, p := range parms {
+		token, err := EncodeParm(p)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+func equalTokens(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ServeSyscalls carries out the syscall requests that the registered
+// module with hash mh sends on its stdout port, one at a time and in
+// order, until ctx is done or the port is destroyed.
+func (k *Kernel) ServeSyscalls(ctx context.Context, mh multihash.Multihash) (err error) {
+	key := parmKey(mh)
+	k.treeMu.Lock()
+	std, ok := k.ports[key]
+	k.treeMu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrModuleNotFound, key)
+	}
+	for {
+		rcvd, err := k.space.Receive(ctx, std.stdout)
+		if err != nil {
+			return err
+		}
+		k.syscall(ctx, key, rcvd)
+	}
+}
+
+// syscall carries out one request from the module with hash token
+// key and sends the reply.
+func (k *Kernel) syscall(ctx context.Context, key string, rcvd *Received) {
+	out, err := k.execSyscall(ctx, key, rcvd.Msg)
+	defer func() {
+		// the kernel keeps none of the rights a request carries, but
+		// keeps its own rights to the same ports
+		for i, name := range rcvd.Rights {
+			if rcvd.Carried[i] == RightReceive {
+				k.space.Destroy(name)
+			} else {
+				k.space.Deallocate(name)
+			}
+		}
+	}()
+	if len(rcvd.Rights) == 0 || k.space.Rights(rcvd.Rights[0])&RightSend == 0 {
+		return
+	}
+	parms := []interface{}{"ok"}
+	if err != nil {
+		parms = []interface{}{"error", err.Error()}
+		out = nil
+	}
+	reply, merr := NewMessage(SyscallPromise, "sha256", parms, string(out))
+	if merr != nil {
+		return
+	}
+	if env := rcvd.Msg.Envelope; env != nil && env.CorrelationID != "" {
+		reply.Envelope = &Envelope{CorrelationID: env.CorrelationID}
+	}
+	// a module that doesn't read its replies only loses them
+	k.space.Send(ctx, rcvd.Rights[0], reply)
+}
+
+// execSyscall checks a request and carries it out.
+func (k *Kernel) execSyscall(ctx context.Context, key string, msg *Message) (out []byte, err error) {
+	if msg == nil || msg.Promise == nil {
+		return nil, fmt.Errorf("invalid syscall request; missing promise")
+	}
+	want, err := NewPromise(SyscallPromise, "sha256")
+	if err != nil {
+		return nil, err
+	}
+	if msg.Promise.Code != want.Code || string(msg.Promise.Digest) != string(want.Digest) {
+		return nil, fmt.Errorf("invalid syscall request; wrong promise")
+	}
+	if !k.permitted(key, msg.Parms) {
+		return nil, fmt.Errorf("%w: %v", ErrPermission, msg.Parms)
+	}
+	k.treeMu.Lock()
+	services := k.services
+	k.treeMu.Unlock()
+	ctx = context.WithValue(ctx, servicesKey{}, services)
+	return syscallTree().Dispatch(ctx, msg)
+}
+
+// syscallFn carries out a core syscall, given the services, what the
+// segments of its path captured, and the request's payload.
+type syscallFn func(ctx context.Context, services Services, args []interface{}, payload string) ([]byte, error)
+
+// coreSyscall is a syscall carried out by the kernel itself.
+type coreSyscall struct {
+	fn syscallFn
+}
+
+func (s *coreSyscall) Accept(ctx context.Context, parms ...interface{}) (Message, error) {
+	return Message{}, nil
+}
+
+func (s *coreSyscall) HandleMessage(ctx context.Context, parms ...interface{}) ([]byte, error) {
+	msg, ok := MessageFromContext(ctx)
+	if !ok {
+		return nil, fmt.Errorf("no syscall request in context")
+	}
+	services, _ := ctx.Value(servicesKey{}).(Services)
+	return s.fn(ctx, services, Captures(ctx), msg.Payload)
+}
+
+// servicesKey is the context key for the services a core syscall
+// acts on.
+type servicesKey struct{}
+
+// syscallTree returns the tree of core syscalls.  It is built on
+// first use, and shared by every kernel.
+var syscallTree = sync.OnceValue(newSyscallTree)
+
+// newSyscallTree builds the tree of core syscalls.
+func newSyscallTree() (tree *Kernel) {
+	tree = NewKernel()
+	promise, err := NewPromise(SyscallPromise, "sha256")
+	Ck(err)
+	mh, err := multihash.Encode(promise.Digest, promise.Code)
+	Ck(err)
+	bind := func(fn syscallFn, path ...interface{}) {
+		path = append([]interface{}{multihash.Multihash(mh)}, path...)
+		err := tree.bindSyscall(&coreSyscall{fn: fn}, path...)
+		Ck(err)
+	}
+	bind(func(ctx context.Context, services Services, args []interface{}, payload string) ([]byte, error) {
+		if services.Fs == nil {
+			return nil, ErrNoService
+		}
+		return afero.ReadFile(services.Fs, args[0].(string))
+	}, "fs", "read", AnyString())
+	bind(func(ctx context.Context, services Services, args []interface{}, payload string) ([]byte, error) {
+		if services.Fs == nil {
+			return nil, ErrNoService
+		}
+		return nil, afero.WriteFile(services.Fs, args[0].(string), []byte(payload), 0644)
+	}, "fs", "write", AnyString())
+	bind(func(ctx context.Context, services Services, args []interface{}, payload string) ([]byte, error) {
+		if services.Cache == nil {
+			return nil, ErrNoService
+		}
+		return services.Cache.Get(args[0].(string))
+	}, "cache", "get", AnyString())
+	bind(func(ctx context.Context, services Services, args []interface{}, payload string) ([]byte, error) {
+		if services.Cache == nil {
+			return nil, ErrNoService
+		}
+		return nil, services.Cache.Put(args[0].(string), []byte(payload))
+	}, "cache", "put", AnyString())
+	bind(func(ctx context.Context, services Services, args []interface{}, payload string) ([]byte, error) {
+		if services.Peers == nil {
+			return nil, ErrNoService
+		}
+		msg := &Message{}
+		err := Unmarshal([]byte(payload), msg)
+		if err != nil {
+			return nil, err
+		}
+		return nil, services.Peers.SendToPeer(ctx, args[0].(string), msg)
+	}, "peer", "send", AnyString())
+	return tree
+}
+
+// NewSyscall returns a syscall request with the given parameters.
+func NewSyscall(payload string, parms ...interface{}) (msg *Message, err error) {
+	return NewMessage(SyscallPromise, "sha256", parms, payload)
+}
+
+// Syscall sends a syscall request with the given payload and
+// parameters on the module's stdout port, and waits for the reply on
+// a port allocated for it.  It returns the reply's payload, or an
+// error wrapping ErrSyscall with the reply's error text.
+func (p *ModulePorts) Syscall(ctx context.Context, payload string, parms ...interface{}) (out []byte, err error) {
+	defer Return(&err)
+	req, err := NewSyscall(payload, parms...)
+	Ck(err)
+	reply := p.Space.Allocate(1)
+	defer p.Space.Destroy(reply)
+	err = p.Space.Send(ctx, p.Stdout, req, Transfer{reply, MakeSend})
+	Ck(err)
+	rcvd, err := p.Space.Receive(ctx, reply)
+	Ck(err)
+	parms = rcvd.Msg.Parms
+	if len(parms) == 2 && parms[0] == "error" {
+		return nil, fmt.Errorf("%w: %v", ErrSyscall, parms[1])
+	}
+	Assert(len(parms) == 1 && parms[0] == "ok", "invalid syscall reply %v", parms)
+	return []byte(rcvd.Msg.Payload), nil
+}
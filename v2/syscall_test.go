@@ -0,0 +1,176 @@
+package grid_cli
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/spf13/afero"
+	. "github.com/stevegt/goadapt"
+)
+
+// mapCache is an in-memory CacheStore.
+type mapCache struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+func (c *mapCache) Get(key string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, ok := c.data[key]
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+	return data, nil
+}
+
+func (c *mapCache) Put(key string, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.data[key] = data
+	return nil
+}
+
+// fakePeers records the messages sent to peers.
+type fakePeers struct {
+	mu   sync.Mutex
+	sent map[string][]*Message
+}
+
+func (p *fakePeers) SendToPeer(ctx context.Context, peer string, msg *Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if peer == "offline" {
+		return errors.New("peer offline")
+	}
+	p.sent[peer] = append(p.sent[peer], msg)
+	return nil
+}
+
+// TestSyscalls tests the core syscalls made by a module on its
+// stdout port.
+func TestSyscalls(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	k := NewKernel()
+	fs := afero.NewMemMapFs()
+	cache := &mapCache{data: make(map[string][]byte)}
+	peers := &fakePeers{sent: make(map[string][]*Message)}
+	m := fakeModule{name: "syscalls", rec: &fakeRecord{}}
+	mh, err := k.RegisterModule(m)
+	Tassert(t, err == nil, "Failed to register module: %v", err)
+	ports := m.rec.ports[0]
+	served := make(chan error)
+	go func() {
+		served <- k.ServeSyscalls(ctx, mh)
+	}()
+
+	// nothing is permitted until granted
+	_, err = ports.Syscall(ctx, "", "fs", "read", "a.txt")
+	Tassert(t, errors.Is(err, ErrSyscall) && strings.Contains(err.Error(), ErrPermission.Error()),
+		"Expected a permission error but got %v", err)
+	err = k.Grant(mh, "fs")
+	Tassert(t, err == nil, "Failed to grant: %v", err)
+	err = k.Grant(mh, "cache", "get")
+	Tassert(t, err == nil, "Failed to grant: %v", err)
+	err = k.Grant(mh, "peer")
+	Tassert(t, err == nil, "Failed to grant: %v", err)
+
+	// services must be set
+	_, err = ports.Syscall(ctx, "", "fs", "read", "a.txt")
+	Tassert(t, errors.Is(err, ErrSyscall) && strings.Contains(err.Error(), ErrNoService.Error()),
+		"Expected ErrNoService but got %v", err)
+	k.SetServices(Services{Fs: fs, Cache: cache, Peers: peers})
+
+	_, err = ports.Syscall(ctx, "hello", "fs", "write", "a.txt")
+	Tassert(t, err == nil, "Failed to write: %v", err)
+	data, err := afero.ReadFile(fs, "a.txt")
+	Tassert(t, err == nil && string(data) == "hello", "Unexpected file %q: %v", data, err)
+	out, err := ports.Syscall(ctx, "", "fs", "read", "a.txt")
+	Tassert(t, err == nil && string(out) == "hello", "Unexpected read %q: %v", out, err)
+	_, err = ports.Syscall(ctx, "", "fs", "read", "missing.txt")
+	Tassert(t, errors.Is(err, ErrSyscall), "Expected an error reading a missing file but got %v", err)
+
+	cache.data["k"] = []byte("cached")
+	out, err = ports.Syscall(ctx, "", "cache", "get", "k")
+	Tassert(t, err == nil && string(out) == "cached", "Unexpected get %q: %v", out, err)
+	_, err = ports.Syscall(ctx, "", "cache", "get", "nope")
+	Tassert(t, errors.Is(err, ErrSyscall) && strings.Contains(err.Error(), ErrCacheMiss.Error()),
+		"Expected a cache miss but got %v", err)
+	_, err = ports.Syscall(ctx, "v", "cache", "put", "k")
+	Tassert(t, errors.Is(err, ErrSyscall), "Expected a permission error but got %v", err)
+	Tassert(t, string(cache.data["k"]) == "cached", "Cache changed without permission")
+
+	hello, err := NewMessage("I will say hello", "sha256", []interface{}{"hello"}, "")
+	Tassert(t, err == nil, "Failed to create message: %v", err)
+	buf, err := Marshal(hello)
+	Tassert(t, err == nil, "Failed to marshal message: %v", err)
+	_, err = ports.Syscall(ctx, string(buf), "peer", "send", "alice")
+	Tassert(t, err == nil, "Failed to send to peer: %v", err)
+	Tassert(t, len(peers.sent["alice"]) == 1 && peers.sent["alice"][0].Parms[0] == "hello",
+		"Unexpected peer messages %v", peers.sent)
+	_, err = ports.Syscall(ctx, string(buf), "peer", "send", "offline")
+	Tassert(t, errors.Is(err, ErrSyscall), "Expected an error from an offline peer but got %v", err)
+	_, err = ports.Syscall(ctx, "not a message", "peer", "send", "alice")
+	Tassert(t, errors.Is(err, ErrSyscall), "Expected an error for an invalid message but got %v", err)
+
+	// unknown syscalls and requests under other promises fail
+	err = k.Grant(mh)
+	Tassert(t, err == nil, "Failed to grant: %v", err)
+	_, err = ports.Syscall(ctx, "", "fs", "delete", "a.txt")
+	Tassert(t, errors.Is(err, ErrSyscall) && strings.Contains(err.Error(), ErrNoHandler.Error()),
+		"Expected ErrNoHandler but got %v", err)
+	reply := ports.Space.Allocate(0)
+	err = ports.Space.Send(ctx, ports.Stdout, hello, Transfer{reply, MakeSend})
+	Tassert(t, err == nil, "Failed to send: %v", err)
+	rcvd, err := ports.Space.Receive(ctx, reply)
+	Tassert(t, err == nil && rcvd.Msg.Parms[0] == "error", "Expected an error reply but got %v", rcvd.Msg.Parms)
+
+	// the correlation ID comes back in the reply
+	req, err := NewSyscall("", "fs", "read", "a.txt")
+	Tassert(t, err == nil, "Failed to create request: %v", err)
+	req.Envelope = &Envelope{CorrelationID: "42"}
+	err = ports.Space.Send(ctx, ports.Stdout, req, Transfer{reply, MakeSend})
+	Tassert(t, err == nil, "Failed to send: %v", err)
+	rcvd, err = ports.Space.Receive(ctx, reply)
+	Tassert(t, err == nil, "Failed to receive: %v", err)
+	Tassert(t, rcvd.Msg.Envelope != nil && rcvd.Msg.Envelope.CorrelationID == "42", "Expected the correlation ID")
+	Tassert(t, rcvd.Msg.Payload == "hello", "Unexpected payload %q", rcvd.Msg.Payload)
+
+	// requests without a reply port are carried out
+	req, err = NewSyscall("bye", "fs", "write", "b.txt")
+	Tassert(t, err == nil, "Failed to create request: %v", err)
+	err = ports.Space.Send(ctx, ports.Stdout, req)
+	Tassert(t, err == nil, "Failed to send: %v", err)
+	err = k.Revoke(mh)
+	Tassert(t, err == nil, "Failed to revoke: %v", err)
+	err = k.Revoke(mh)
+	Tassert(t, err != nil, "Expected an error revoking twice")
+	out, err = ports.Syscall(ctx, "", "fs", "read", "b.txt")
+	Tassert(t, err == nil && string(out) == "bye", "Unexpected read %q: %v", out, err)
+
+	// the kernel drops the rights a request carried, and keeps its
+	// own rights to the same ports
+	std := k.ports[parmKey(mh)]
+	req, err = NewSyscall("", "fs", "read", "a.txt")
+	Tassert(t, err == nil, "Failed to create request: %v", err)
+	carried := ports.Space.Allocate(0)
+	err = ports.Space.Send(ctx, ports.Stdout, req, Transfer{ports.Stdin, MakeSend}, Transfer{carried, MoveReceive})
+	Tassert(t, err == nil, "Failed to send: %v", err)
+	rcvd, err = ports.Space.Receive(ctx, ports.Stdin)
+	Tassert(t, err == nil && rcvd.Msg.Payload == "hello", "Unexpected reply %v: %v", rcvd.Msg, err)
+	// syscalls are served in turn, so the last one is cleaned up
+	// once the next is answered
+	_, err = ports.Syscall(ctx, "", "fs", "read", "a.txt")
+	Tassert(t, err == nil, "Failed to read: %v", err)
+	Tassert(t, k.space.Rights(std.stdin) == RightSend, "Expected the kernel's stdin right kept but got %v", k.space.Rights(std.stdin))
+	err = ports.Space.Send(ctx, carried, req)
+	Tassert(t, errors.Is(err, ErrDeadPort), "Expected the carried receive right destroyed but got %v", err)
+
+	cancel()
+	err = <-served
+	Tassert(t, errors.Is(err, context.Canceled), "Expected ServeSyscalls to stop but got %v", err)
+}
@@ -0,0 +1,164 @@
+package grid_cli
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/multiformats/go-multihash"
+	"github.com/spf13/afero"
+	. "github.com/stevegt/goadapt"
+)
+
+// Cache files are named by the hex of the multihash of their
+// content, so every read can check the content against the name.  A
+// file that fails is moved to a quarantine directory next to it,
+// where it can be examined, and is no longer served.
+
+// ErrCorrupt is returned for a cache file whose content doesn't match
+// the multihash it is named by.
+var ErrCorrupt = errors.New("corrupt cache file")
+
+// quarantineDir holds the files that failed verification, relative
+// to the directory they were found in.
+const quarantineDir = "quarantine"
+
+// ReadCacheFile reads the file name in dir and checks its content
+// against the multihash whose hex is name.  A mismatch is an error
+// wrapping ErrCorrupt.
+func ReadCacheFile(fs afero.Fs, dir, name string) (data []byte, err error) {
+	mh, err := hex.DecodeString(name)
+	if err != nil {
+		return nil, fmt.Errorf("cache file name %q is not a hash: %w", name, err)
+	}
+	data, err = afero.ReadFile(fs, filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	err = VerifyHash(mh, data)
+	if err != nil {
+		return nil, fmt.Errorf("%w %s: %v", ErrCorrupt, filepath.Join(dir, name), err)
+	}
+	return data, nil
+}
+
+// CheckCacheFile checks the file name in dir against the multihash
+// whose hex is name, as ReadCacheFile does, but streams it rather
+// than reading it into memory, for files such as large modules.
+func CheckCacheFile(fs afero.Fs, dir, name string) (err error) {
+	mh, err := hex.DecodeString(name)
+	if err != nil {
+		return fmt.Errorf("cache file name %q is not a hash: %w", name, err)
+	}
+	v, err := NewHashVerifier(mh)
+	if err != nil {
+		return err
+	}
+	f, err := fs.Open(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(v, f)
+	if err != nil {
+		return err
+	}
+	err = v.Verify()
+	if err != nil {
+		return fmt.Errorf("%w %s: %v", ErrCorrupt, filepath.Join(dir, name), err)
+	}
+	return nil
+}
+
+// Quarantine moves the file name in dir to dir's quarantine
+// directory, replacing any file quarantined there before, and
+// returns its new path.  A file that is already gone is not an
+// error.
+func Quarantine(fs afero.Fs, dir, name string) (path string, err error) {
+	defer Return(&err)
+	qdir := filepath.Join(dir, quarantineDir)
+	err = fs.MkdirAll(qdir, 0755)
+	Ck(err)
+	path = filepath.Join(qdir, name)
+	fs.Remove(path)
+	err = fs.Rename(filepath.Join(dir, name), path)
+	if os.IsNotExist(err) {
+		return path, nil
+	}
+	Ck(err)
+	return path, nil
+}
+
+// CacheProblem is a cache file or entry that failed verification.
+type CacheProblem struct {
+	Path string
+	Err  error
+	// Repaired is set if the problem was dealt with, by quarantining
+	// the file or dropping the entry.
+	Repaired bool
+}
+
+func (p CacheProblem) String() string {
+	s := Spf("%s: %v", p.Path, p.Err)
+	if p.Repaired {
+		s += " (repaired)"
+	}
+	return s
+}
+
+// VerifyCacheDir checks every file in dir that is named by the hex of
+// a multihash, and every block in dir's BlockDir, and returns how many
+// it checked and the problems it found.  If repair is set, corrupt
+// files are quarantined, blocks in the BlockDir's own quarantine.
+func VerifyCacheDir(fs afero.Fs, dir string, repair bool) (checked int, problems []CacheProblem, err error) {
+	defer Return(&err)
+	for _, sub := range []string{dir, filepath.Join(dir, BlockDir)} {
+		n, ps, err := verifyDir(fs, sub, repair)
+		Ck(err)
+		checked += n
+		problems = append(problems, ps...)
+	}
+	return checked, problems, nil
+}
+
+// verifyDir checks the files directly in dir for VerifyCacheDir.
+func verifyDir(fs afero.Fs, dir string, repair bool) (checked int, problems []CacheProblem, err error) {
+	defer Return(&err)
+	infos, err := afero.ReadDir(fs, dir)
+	if os.IsNotExist(err) {
+		return 0, nil, nil
+	}
+	Ck(err)
+	for _, info := range infos {
+		if info.IsDir() || !IsHashName(info.Name()) {
+			continue
+		}
+		checked++
+		err := CheckCacheFile(fs, dir, info.Name())
+		if err == nil {
+			continue
+		}
+		p := CacheProblem{Path: filepath.Join(dir, info.Name()), Err: err}
+		if repair && errors.Is(err, ErrCorrupt) {
+			_, err = Quarantine(fs, dir, info.Name())
+			Ck(err)
+			p.Repaired = true
+		}
+		problems = append(problems, p)
+	}
+	return checked, problems, nil
+}
+
+// IsHashName reports whether name is the hex of a multihash, as the
+// names of cache files are.
+func IsHashName(name string) bool {
+	buf, err := hex.DecodeString(name)
+	if err != nil {
+		return false
+	}
+	_, err = multihash.Cast(buf)
+	return err == nil
+}
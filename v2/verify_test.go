@@ -0,0 +1,160 @@
+package grid_cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	. "github.com/stevegt/goadapt"
+)
+
+// TestVerifyCacheDir tests checking cache files against their names
+// and quarantining the corrupt ones.
+func TestVerifyCacheDir(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	good := hex.EncodeToString(mustSum(t, "good"))
+	bad := hex.EncodeToString(mustSum(t, "bad"))
+	for name, data := range map[string]string{good: "good", bad: "tampered", "pins": "not a cache file"} {
+		err := afero.WriteFile(fs, filepath.Join("/cache", name), []byte(data), 0644)
+		Tassert(t, err == nil, "Failed to write: %v", err)
+	}
+
+	data, err := ReadCacheFile(fs, "/cache", good)
+	Tassert(t, err == nil && string(data) == "good", "Unexpected data %q: %v", data, err)
+	_, err = ReadCacheFile(fs, "/cache", bad)
+	Tassert(t, errors.Is(err, ErrCorrupt), "Expected ErrCorrupt but got %v", err)
+	_, err = ReadCacheFile(fs, "/cache", "pins")
+	Tassert(t, err != nil && !errors.Is(err, ErrCorrupt), "Expected an invalid name error but got %v", err)
+	err = CheckCacheFile(fs, "/cache", good)
+	Tassert(t, err == nil, "Expected the good file to check: %v", err)
+	err = CheckCacheFile(fs, "/cache", bad)
+	Tassert(t, errors.Is(err, ErrCorrupt), "Expected ErrCorrupt but got %v", err)
+
+	checked, problems, err := VerifyCacheDir(fs, "/cache", false)
+	Tassert(t, err == nil && checked == 2, "Expected 2 files checked but got %d: %v", checked, err)
+	Tassert(t, len(problems) == 1 && !problems[0].Repaired, "Unexpected problems %v", problems)
+	_, err = fs.Stat(filepath.Join("/cache", bad))
+	Tassert(t, err == nil, "Expected the corrupt file left alone without repair")
+
+	_, problems, err = VerifyCacheDir(fs, "/cache", true)
+	Tassert(t, err == nil && len(problems) == 1 && problems[0].Repaired, "Unexpected problems %v: %v", problems, err)
+	data, err = afero.ReadFile(fs, filepath.Join("/cache", quarantineDir, bad))
+	Tassert(t, err == nil && string(data) == "tampered", "Expected the file quarantined: %v", err)
+	checked, problems, err = VerifyCacheDir(fs, "/cache", false)
+	Tassert(t, err == nil && checked == 1 && problems == nil, "Unexpected problems %v: %v", problems, err)
+	_, err = Quarantine(fs, "/cache", bad)
+	Tassert(t, err == nil, "Expected quarantining a missing file to succeed: %v", err)
+
+	// blocks are checked too, and quarantined beside the block store
+	store := NewFsBlockStore(fs, filepath.Join("/cache", BlockDir))
+	_, err = store.PutBlock([]byte("good block"))
+	Tassert(t, err == nil, "Failed to put block: %v", err)
+	badBlock, err := store.PutBlock([]byte("bad block"))
+	Tassert(t, err == nil, "Failed to put block: %v", err)
+	err = afero.WriteFile(fs, store.path(badBlock), []byte("tampered block"), 0644)
+	Tassert(t, err == nil, "Failed to write: %v", err)
+	checked, problems, err = VerifyCacheDir(fs, "/cache", true)
+	Tassert(t, err == nil && checked == 3, "Expected 3 files checked but got %d: %v", checked, err)
+	Tassert(t, len(problems) == 1 && problems[0].Path == store.path(badBlock) && problems[0].Repaired, "Unexpected problems %v", problems)
+	Tassert(t, !store.HasBlock(badBlock), "Expected the corrupt block quarantined")
+	data, err = afero.ReadFile(fs, filepath.Join("/cache", BlockDir, quarantineDir, hex.EncodeToString(badBlock)))
+	Tassert(t, err == nil && string(data) == "tampered block", "Expected the block quarantined: %v", err)
+}
+
+// TestCacheCorruption tests that a corrupt completion is never
+// served.
+func TestCacheCorruption(t *testing.T) {
+	ctx := context.Background()
+	fs := afero.NewMemMapFs()
+	cache := NewLocalCacheModule(fs, "/grid/cache")
+	promise := mustSum(t, "I will say hello")
+	module := mustSum(t, "hello module")
+	key := []interface{}{promise, module, "hello"}
+	err := cache.Put([]byte("world"), key...)
+	Tassert(t, err == nil, "Failed to put: %v", err)
+	err = cache.Put([]byte("world"), promise, module, "again")
+	Tassert(t, err == nil, "Failed to put: %v", err)
+	blob := cache.blobPath(mustSum(t, "world"))
+	err = afero.WriteFile(fs, blob, []byte("wrong"), 0644)
+	Tassert(t, err == nil, "Failed to write: %v", err)
+
+	// Accept only checks that the blob is there
+	_, err = cache.Accept(ctx, key...)
+	Tassert(t, err == nil, "Expected the cache to accept: %v", err)
+	_, err = fs.Stat(blob)
+	Tassert(t, err == nil, "Expected the blob left alone by Accept: %v", err)
+
+	// the cache fails, and the module computes the completion
+	k := NewKernel()
+	computer := fakeModule{name: "computed", rec: &fakeRecord{}}
+	err = k.bindSyscall(computer, promise, module, Rest())
+	Tassert(t, err == nil, "Failed to bind: %v", err)
+	k.MountCache(cache)
+	msg := &Message{Promise: mustDecode(t, promise), Parms: []interface{}{module, "hello"}}
+	out, err := k.Dispatch(ctx, msg)
+	Tassert(t, err == nil && string(out) == "computed", "Unexpected output %q: %v", out, err)
+	_, err = fs.Stat(blob)
+	Tassert(t, err != nil, "Expected the blob quarantined")
+	_, err = fs.Stat(filepath.Join(cache.blobDir(), quarantineDir, filepath.Base(blob)))
+	Tassert(t, err == nil, "Expected the blob in quarantine: %v", err)
+	_, err = cache.HandleMessage(ctx, promise, module, "again")
+	Tassert(t, errors.Is(err, ErrCacheMiss), "Expected the blob's other key dropped but got %v", err)
+
+	// putting the completion again heals the cache, even over a
+	// corrupt blob
+	err = cache.Put([]byte("world"), key...)
+	Tassert(t, err == nil, "Failed to put: %v", err)
+	err = afero.WriteFile(fs, blob, []byte("wrong"), 0644)
+	Tassert(t, err == nil, "Failed to write: %v", err)
+	err = cache.Put([]byte("world"), key...)
+	Tassert(t, err == nil, "Failed to put: %v", err)
+	out, err = cache.HandleMessage(ctx, key...)
+	Tassert(t, err == nil && string(out) == "world", "Unexpected completion %q: %v", out, err)
+
+	// Verify finds corrupt blobs and keys without blobs
+	err = afero.WriteFile(fs, blob, []byte("wrong"), 0644)
+	Tassert(t, err == nil, "Failed to write: %v", err)
+	checked, problems, err := cache.Verify(false)
+	Tassert(t, err == nil && checked == 1 && len(problems) == 1, "Unexpected problems %v: %v", problems, err)
+	checked, problems, err = cache.Verify(true)
+	Tassert(t, err == nil && checked == 1 && len(problems) == 2, "Unexpected problems %v: %v", problems, err)
+	for _, p := range problems {
+		Tassert(t, p.Repaired, "Expected %v repaired", p)
+	}
+	index, err := cache.Index()
+	Tassert(t, err == nil && index.Len() == 0, "Expected the key dropped: %v", err)
+	_, problems, err = cache.Verify(false)
+	Tassert(t, err == nil && problems == nil, "Unexpected problems %v: %v", problems, err)
+}
+
+// TestCliCacheVerify tests the cache verify subcommand.
+func TestCliCacheVerify(t *testing.T) {
+	var out bytes.Buffer
+	fs := afero.NewMemMapFs()
+	c := &cli{fs: fs, dir: "/home/.grid", out: &out}
+	cache := NewLocalCacheModule(fs, "/home/.grid/cache")
+	err := cache.Put([]byte("world"), mustSum(t, "I will say hello"), mustSum(t, "hello module"), "hello")
+	Tassert(t, err == nil, "Failed to put: %v", err)
+	v1file := "/home/.grid/cache/" + hex.EncodeToString(mustSum(t, "module"))
+	err = afero.WriteFile(fs, v1file, []byte("tampered"), 0755)
+	Tassert(t, err == nil, "Failed to write: %v", err)
+
+	err = c.run([]string{"cache", "verify"})
+	Tassert(t, err != nil, "Expected an error for a corrupt cache")
+	Tassert(t, strings.HasSuffix(out.String(), "checked 2 files, 1 problems\n"), "Unexpected output %q", out.String())
+	Tassert(t, strings.HasPrefix(out.String(), v1file+": "), "Unexpected output %q", out.String())
+	out.Reset()
+	err = c.run([]string{"cache", "verify", "--repair"})
+	Tassert(t, err == nil, "Failed to repair: %v", err)
+	Tassert(t, strings.Contains(out.String(), "(repaired)"), "Unexpected output %q", out.String())
+	out.Reset()
+	err = c.run([]string{"cache", "verify"})
+	Tassert(t, err == nil && out.String() == "checked 1 files, 0 problems\n", "Unexpected output %q: %v", out.String(), err)
+	err = c.run([]string{"cache", "verify", "-x"})
+	Tassert(t, err != nil, "Expected a usage error")
+}